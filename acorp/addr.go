@@ -0,0 +1,309 @@
+package acorp
+
+// A Go port of the address evaluation logic from acme's addr.c, operating on a
+// slice of runes rather than an acme Text. This is what lets FakeWin make sense
+// of the sam addresses that our tools write to the addr file.
+//
+// Supported: line numbers (n), character offsets (#n), '.', '$', forward and
+// backward regexp searches (/re/ & ?re?), relative addresses (+ & -) and
+// compound ranges (a1,a2 & a1;a2). Regular expressions use Go syntax in
+// multi-line mode which is close enough to sam for the things we do with them.
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	dirNone rune = 0
+	dirFore rune = '+'
+	dirBack rune = '-'
+
+	sizeLine = 0
+	sizeChar = 1
+)
+
+var errAddrRange = errors.New("address out of range")
+
+// A span is a range of rune offsets [q0, q1) within a body of text.
+type span struct {
+	q0, q1 int
+}
+
+// evalAddr evaluates the sam address s against text, with ar being the current
+// value of addr.
+func evalAddr(text []rune, ar span, s string) (span, error) {
+	a := []rune(strings.TrimRight(s, " \t\n"))
+	r, q, err := address(text, ar, a, 0)
+	if err != nil {
+		return ar, err
+	}
+	if q < len(a) {
+		return ar, fmt.Errorf("bad address syntax: '%s'", s)
+	}
+	if r.q0 > r.q1 {
+		return ar, fmt.Errorf("addresses out of order")
+	}
+	return r, nil
+}
+
+func address(text []rune, ar span, a []rune, q int) (span, int, error) {
+	var (
+		c, prevc rune
+		err      error
+	)
+
+	r := ar
+	q0 := q
+	dir, size := dirNone, sizeLine
+
+	for q < len(a) {
+		prevc = c
+		c = a[q]
+		q++
+
+		switch c {
+		case ';', ',':
+			if c == ';' {
+				ar = r
+			}
+			if prevc == 0 { // lhs defaults to 0
+				r.q0 = 0
+			}
+			if q >= len(a) { // rhs defaults to $
+				r.q1 = len(text)
+			} else {
+				var nr span
+				if nr, q, err = address(text, ar, a, q); err != nil {
+					return r, q, err
+				}
+				r.q1 = nr.q1
+			}
+			return r, q, nil
+
+		case '+', '-':
+			if prevc == '+' || prevc == '-' {
+				if q >= len(a) || (a[q] != '#' && a[q] != '/' && a[q] != '?') {
+					// do the previous one
+					if r, err = number(text, r, 1, prevc, sizeLine); err != nil {
+						return r, q, err
+					}
+				}
+			}
+			dir = c
+
+		case '.', '$':
+			if q != q0+1 {
+				return r, q - 1, nil
+			}
+			if c == '.' {
+				r = ar
+			} else {
+				r = span{len(text), len(text)}
+			}
+			if q < len(a) {
+				dir = dirFore
+			} else {
+				dir = dirNone
+			}
+
+		case '#', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+			if c == '#' {
+				if q == len(a) || a[q] < '0' || a[q] > '9' {
+					return r, q - 1, nil
+				}
+				c = a[q]
+				q++
+				size = sizeChar
+			}
+
+			n := int(c - '0')
+			for q < len(a) && a[q] >= '0' && a[q] <= '9' {
+				n = n*10 + int(a[q]-'0')
+				q++
+			}
+			if r, err = number(text, r, n, dir, size); err != nil {
+				return r, q, err
+			}
+			dir, size = dirNone, sizeLine
+
+		case '?', '/':
+			if c == '?' {
+				dir = dirBack
+			}
+
+			var pat []rune
+		loop:
+			for q < len(a) {
+				nc := a[q]
+				q++
+				switch nc {
+				case '\n':
+					q--
+					break loop
+				case c:
+					break loop
+				case '\\':
+					if q < len(a) && a[q] == c {
+						// escaped delimiter: the regexp only needs the character itself
+						nc = a[q]
+						q++
+					} else if q < len(a) {
+						pat = append(pat, nc)
+						nc = a[q]
+						q++
+					}
+				}
+				pat = append(pat, nc)
+			}
+
+			if r, err = search(text, r, string(pat), dir); err != nil {
+				return r, q, err
+			}
+			dir, size = dirNone, sizeLine
+
+		default:
+			return r, q - 1, nil
+		}
+	}
+
+	if dir != dirNone {
+		if r, err = number(text, r, 1, dir, sizeLine); err != nil {
+			return r, q, err
+		}
+	}
+
+	return r, q, nil
+}
+
+// number resolves a line or character address relative to r.
+func number(text []rune, r span, n int, dir rune, size int) (span, error) {
+	nc := len(text)
+
+	if size == sizeChar {
+		switch dir {
+		case dirFore:
+			n = r.q1 + n
+		case dirBack:
+			if r.q0 == 0 && n > 0 {
+				r.q0 = nc
+			}
+			n = r.q0 - n
+		}
+		if n < 0 || n > nc {
+			return r, errAddrRange
+		}
+		return span{n, n}, nil
+	}
+
+	q0, q1 := r.q0, r.q1
+
+	switch dir {
+	case dirBack:
+		if q0 < nc {
+			for q0 > 0 && text[q0-1] != '\n' {
+				q0--
+			}
+		}
+		q1 = q0
+		for n > 0 && q0 > 0 {
+			if text[q0-1] == '\n' {
+				n--
+				if n >= 0 {
+					q1 = q0
+				}
+			}
+			q0--
+		}
+		// :1-1 is :0 = #0, but :1-2 is an error
+		if n > 1 {
+			return r, errAddrRange
+		}
+		for q0 > 0 && text[q0-1] != '\n' {
+			q0--
+		}
+		return span{q0, q1}, nil
+
+	case dirFore:
+		if q1 > 0 {
+			for q1 < nc && text[q1-1] != '\n' {
+				q1++
+			}
+		}
+		q0 = q1
+
+	default:
+		q0, q1 = 0, 0
+	}
+
+	for n > 0 && q1 < nc {
+		c := text[q1]
+		q1++
+		if c == '\n' || q1 == nc {
+			n--
+			if n > 0 {
+				q0 = q1
+			}
+		}
+	}
+	if n > 0 && !(n == 1 && q1 == nc) {
+		return r, errAddrRange
+	}
+
+	return span{q0, q1}, nil
+}
+
+// search finds the next (or previous) match of pat relative to r, wrapping
+// around the ends of text in the same way that acme does.
+func search(text []rune, r span, pat string, dir rune) (span, error) {
+	if pat == "" {
+		return r, fmt.Errorf("no previous regular expression")
+	}
+
+	re, err := regexp.Compile("(?m)" + pat)
+	if err != nil {
+		return r, fmt.Errorf("bad regexp in address: %s", err)
+	}
+
+	matches := runeMatches(text, re)
+	if len(matches) == 0 {
+		return r, fmt.Errorf("no match for regexp: '%s'", pat)
+	}
+
+	if dir == dirBack {
+		for i := len(matches) - 1; i >= 0; i-- {
+			m := matches[i]
+			if m.q1 <= r.q0 && !(m.q0 == m.q1 && m.q1 == r.q0) {
+				return m, nil
+			}
+		}
+		return matches[len(matches)-1], nil
+	}
+
+	for _, m := range matches {
+		if m.q0 >= r.q1 && !(m.q0 == m.q1 && m.q0 == r.q1) {
+			return m, nil
+		}
+	}
+	return matches[0], nil
+}
+
+// runeMatches returns all matches of re in text as rune offset spans.
+func runeMatches(text []rune, re *regexp.Regexp) []span {
+	s := string(text)
+	var spans []span
+
+	q, b := 0, 0
+	for _, ix := range re.FindAllStringIndex(s, -1) {
+		q += utf8.RuneCountInString(s[b:ix[0]])
+		q0 := q
+		q += utf8.RuneCountInString(s[ix[0]:ix[1]])
+		spans = append(spans, span{q0, q})
+		b = ix[1]
+	}
+
+	return spans
+}
@@ -0,0 +1,104 @@
+package acorp
+
+import "testing"
+
+func TestEvalAddr(t *testing.T) {
+	const text = "one\ntwo\nthree\n"
+
+	tests := []struct {
+		addr string
+		ar   span
+		want span
+	}{
+		{"0", span{}, span{0, 0}},
+		{"1", span{}, span{0, 4}},
+		{"2", span{}, span{4, 8}},
+		{"3", span{}, span{8, 14}},
+		{"$", span{}, span{14, 14}},
+		{".", span{2, 5}, span{2, 5}},
+		{",", span{}, span{0, 14}},
+		{";", span{}, span{0, 14}},
+		{"2,", span{}, span{4, 14}},
+		{",2", span{}, span{0, 8}},
+		{"2,3", span{}, span{4, 14}},
+		{"#5", span{}, span{5, 5}},
+		{"#1,#3", span{}, span{1, 3}},
+		{"#5-+", span{}, span{4, 8}},
+		{"2+", span{}, span{8, 14}},
+		{"3-", span{}, span{4, 8}},
+		{"2-#1", span{}, span{3, 3}},
+		{"2+#2", span{}, span{10, 10}},
+		{".+1", span{4, 8}, span{8, 14}},
+		{"/two/", span{}, span{4, 7}},
+		{"/o/", span{0, 1}, span{6, 7}},
+		{"/o/", span{14, 14}, span{0, 1}},
+		{"?o?", span{4, 4}, span{0, 1}},
+		{"?e?", span{0, 0}, span{12, 13}},
+		{"/^t/", span{}, span{4, 5}},
+		{"/e$/", span{4, 4}, span{12, 13}},
+		{"2;/e/", span{}, span{4, 12}},
+		{"0;/o/", span{}, span{0, 1}},
+		{"1 \n", span{}, span{0, 4}},
+	}
+
+	for _, tc := range tests {
+		got, err := evalAddr([]rune(text), tc.ar, tc.addr)
+		if err != nil {
+			t.Errorf("evalAddr(%q, %v) returned error: %s", tc.addr, tc.ar, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("evalAddr(%q, %v) = %v; want %v", tc.addr, tc.ar, got, tc.want)
+		}
+	}
+}
+
+func TestEvalAddrUnicode(t *testing.T) {
+	text := []rune("héllo\nwörld\n/x")
+
+	tests := []struct {
+		addr string
+		want span
+	}{
+		{"2", span{6, 12}},
+		{"/w.r/", span{6, 9}},
+		{"#3,#7", span{3, 7}},
+		{"/ö/-+", span{6, 12}},
+		{`/\/x/`, span{12, 14}},
+	}
+
+	for _, tc := range tests {
+		got, err := evalAddr(text, span{}, tc.addr)
+		if err != nil || got != tc.want {
+			t.Errorf("evalAddr(%q) = %v, %v; want %v", tc.addr, got, err, tc.want)
+		}
+	}
+}
+
+func TestEvalAddrErrors(t *testing.T) {
+	const text = "one\ntwo\nthree\n"
+
+	tests := []string{
+		"5",      // past the last line
+		"#99",    // past the end of the text
+		"1-2",    // before the first line
+		"3,1",    // out of order
+		"/zzz/",  // no match
+		"/(/",    // bad regexp
+		"//",     // no previous regexp
+		"x",      // not an address
+		"1 2 3z", // trailing junk
+	}
+
+	ar := span{1, 2}
+	for _, addr := range tests {
+		got, err := evalAddr([]rune(text), ar, addr)
+		if err == nil {
+			t.Errorf("evalAddr(%q) = %v; want an error", addr, got)
+			continue
+		}
+		if got != ar {
+			t.Errorf("evalAddr(%q) moved addr to %v on error", addr, got)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package acorp
+
+// The helpers in acorp only ever talk to acme through the handful of control
+// files that make up a window (addr, data, xdata, ctl, tag, event...) so rather
+// than tying everything to a concrete *acme.Win we program against the Window
+// interface below. The real implementation is a thin wrapper around *acme.Win,
+// while FakeAcme / FakeWin (see fake.go) provide an in-memory stand in that
+// lets us drive our tools without a running acme or plumber.
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+
+	"9fans.net/go/acme"
+	"9fans.net/go/plan9"
+	"9fans.net/go/plan9/client"
+)
+
+// A Window is a single acme window and the control files that back it. The
+// method set mirrors *acme.Win so that real windows can be used directly.
+type Window interface {
+	ID() int
+	Name(format string, args ...interface{}) error
+	Addr(format string, args ...interface{}) error
+	ReadAddr() (q0, q1 int, err error)
+	Ctl(format string, args ...interface{}) error
+	Read(file string, b []byte) (int, error)
+	ReadAll(file string) ([]byte, error)
+	Write(file string, b []byte) (int, error)
+	ReadEvent() (*acme.Event, error)
+	WriteEvent(e *acme.Event) error
+	Clear()
+	Del(sure bool) error
+	CloseFiles()
+}
+
+// A LogReader provides access to the acme log file. It is satisfied by
+// *acme.LogReader.
+type LogReader interface {
+	Read() (acme.LogEvent, error)
+	Close() error
+}
+
+// A Backend is something that can hand out acme windows: either acme itself
+// or an in-memory fake.
+type Backend interface {
+	New() (Window, error)
+	Open(id int) (Window, error)
+	Windows() ([]WindowInfo, error)
+	Log() (LogReader, error)
+}
+
+var (
+	_ Window    = (*acme.Win)(nil)
+	_ Window    = (*acmeWin)(nil)
+	_ LogReader = (*acme.LogReader)(nil)
+	_ Backend   = acmeBackend{}
+)
+
+// eventSize is the most text that acme includes in an event.
+const eventSize = 256
+
+// acmeBackend talks to a running acme instance via the 9fans.net/go/acme package.
+type acmeBackend struct{}
+
+// acme.New and acme.Open add the window to a package level list without
+// holding its lock so we make sure that only one of them runs at a time.
+var acmeMu sync.Mutex
+
+// Our own connection to acme for reading the index file: the one held by the
+// acme package isn't exported.
+var (
+	acmeFsys     *client.Fsys
+	acmeFsysErr  error
+	acmeFsysOnce sync.Once
+)
+
+func (acmeBackend) New() (Window, error) {
+	acmeMu.Lock()
+	defer acmeMu.Unlock()
+
+	w, err := acme.New()
+	if err != nil {
+		return nil, err
+	}
+	return &acmeWin{Win: w}, nil
+}
+
+func (acmeBackend) Open(id int) (Window, error) {
+	acmeMu.Lock()
+	defer acmeMu.Unlock()
+
+	w, err := acme.Open(id, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &acmeWin{Win: w}, nil
+}
+
+func mountAcme() (*client.Fsys, error) {
+	acmeFsysOnce.Do(func() { acmeFsys, acmeFsysErr = client.MountService("acme") })
+	return acmeFsys, acmeFsysErr
+}
+
+// An acmeWin is a window in a running acme. The event file is read through our
+// own connection rather than by *acme.Win, whose reader can't be closed while
+// a read is in flight: CloseFiles clears the buffer being read from under it.
+// We need to do just that to hand the event file back to acme as soon as a
+// Filter stops.
+type acmeWin struct {
+	*acme.Win
+
+	mu    sync.Mutex // guards event and ebuf
+	event *client.Fid
+	ebuf  *bufio.Reader
+}
+
+// eventFile returns the event file of w, opening it if needed.
+func (w *acmeWin) eventFile() (*client.Fid, *bufio.Reader, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.event == nil {
+		fsys, err := mountAcme()
+		if err != nil {
+			return nil, nil, err
+		}
+		fid, err := fsys.Open(fmt.Sprintf("%d/event", w.ID()), plan9.ORDWR)
+		if err != nil {
+			return nil, nil, err
+		}
+		w.event, w.ebuf = fid, bufio.NewReader(fid)
+	}
+	return w.event, w.ebuf, nil
+}
+
+// ReadEvent reads the next event from the event file.
+func (w *acmeWin) ReadEvent() (*acme.Event, error) {
+	_, r, err := w.eventFile()
+	if err != nil {
+		return nil, err
+	}
+	return readEvent(r)
+}
+
+// WriteEvent writes e back to the event file for acme to handle.
+func (w *acmeWin) WriteEvent(e *acme.Event) error {
+	fid, _, err := w.eventFile()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(fid, "%c%c%d %d \n", e.C1, e.C2, e.Q0, e.Q1)
+	return err
+}
+
+// CloseFiles closes the files of w, interrupting any ReadEvent in flight.
+func (w *acmeWin) CloseFiles() {
+	w.mu.Lock()
+	event := w.event
+	w.event, w.ebuf = nil, nil
+	w.mu.Unlock()
+
+	event.Close()
+	w.Win.CloseFiles()
+}
+
+// readEvent reads an event, merging in the expansion and chorded argument that
+// acme sends as separate messages in the same way as (*acme.Win).ReadEvent.
+func readEvent(r *bufio.Reader) (*acme.Event, error) {
+	e, err := readEventMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	e.OrigQ0, e.OrigQ1 = e.Q0, e.Q1
+
+	if e.Flag&FlagExpanded != 0 {
+		e2, err := readEventMessage(r)
+		if err != nil {
+			return nil, err
+		}
+		if e.Q0 == e.Q1 {
+			e2.OrigQ0, e2.OrigQ1, e2.Flag = e.Q0, e.Q1, e.Flag
+			e = e2
+		}
+	}
+
+	if e.Flag&FlagChordedArg != 0 {
+		arg, err := readEventMessage(r)
+		if err != nil {
+			return nil, err
+		}
+		loc, err := readEventMessage(r)
+		if err != nil {
+			return nil, err
+		}
+		e.Arg, e.Loc = arg.Text, loc.Text
+	}
+
+	return e, nil
+}
+
+// readEventMessage parses a single message from the event file: the origin and
+// type runes followed by q0, q1, the flags and the rune count of the text,
+// each terminated by a space, then the text and a newline.
+func readEventMessage(r *bufio.Reader) (*acme.Event, error) {
+	e := &acme.Event{}
+	var c rune
+	if _, err := fmt.Fscanf(r, "%c%c%d %d %d %d%c", &e.C1, &e.C2, &e.Q0, &e.Q1, &e.Flag, &e.Nr, &c); err != nil {
+		return nil, fmt.Errorf("malformed acme event: %s", err)
+	}
+	if c != ' ' || e.Nr < 0 || e.Nr > eventSize {
+		return nil, fmt.Errorf("malformed acme event")
+	}
+
+	text := make([]rune, e.Nr+1)
+	for i := range text {
+		var err error
+		if text[i], _, err = r.ReadRune(); err != nil {
+			return nil, err
+		}
+	}
+	if text[e.Nr] != '\n' {
+		return nil, fmt.Errorf("malformed acme event: missing newline")
+	}
+	e.Text = []byte(string(text[:e.Nr]))
+	return e, nil
+}
+
+// Windows reads the index file, which gives us the tag and dirty state of
+// every window without having to open each of them.
+func (acmeBackend) Windows() ([]WindowInfo, error) {
+	fsys, err := mountAcme()
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := fsys.Open("index", plan9.OREAD)
+	if err != nil {
+		return nil, err
+	}
+	defer index.Close()
+
+	data, err := ioutil.ReadAll(index)
+	if err != nil {
+		return nil, err
+	}
+	return parseIndex(string(data)), nil
+}
+
+// parseIndex parses the contents of acme's index file. Each line holds the
+// window id, tag length, body length, whether it is a directory and whether
+// it is dirty followed by the text of the tag, which starts with the name.
+func parseIndex(data string) []WindowInfo {
+	var info []WindowInfo
+	for _, line := range strings.Split(data, "\n") {
+		var fields []string
+		rest := line
+		for len(fields) < 5 {
+			rest = strings.TrimLeft(rest, " ")
+			ix := strings.IndexByte(rest, ' ')
+			if ix < 0 {
+				break
+			}
+			fields, rest = append(fields, rest[:ix]), rest[ix+1:]
+		}
+		tag := strings.Fields(rest)
+		if len(fields) < 5 || len(tag) == 0 {
+			continue
+		}
+
+		id, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		info = append(info, WindowInfo{ID: id, Name: tag[0], Tag: rest, Dirty: fields[4] == "1"})
+	}
+	return info
+}
+
+func (acmeBackend) Log() (LogReader, error) {
+	l, err := acme.Log()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+var backend Backend = acmeBackend{}
+
+// UseBackend swaps out the Backend used by acorp when it needs to locate or
+// create windows. Passing nil restores the default of talking to acme.
+func UseBackend(b Backend) {
+	if b == nil {
+		b = acmeBackend{}
+	}
+	backend = b
+}
+
+// NewWindow creates a new window using the current Backend.
+func NewWindow() (Window, error) {
+	return backend.New()
+}
+
+// OpenWindow connects to an existing window using the current Backend.
+func OpenWindow(id int) (Window, error) {
+	return backend.Open(id)
+}
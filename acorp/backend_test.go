@@ -0,0 +1,52 @@
+package acorp
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestReadEvent(t *testing.T) {
+	tests := []struct {
+		data string
+		want string // C1 C2 Q0 Q1 OrigQ0 OrigQ1 Flag Nr Text Arg Loc
+	}{
+		{"KI3 4 0 1 x\n", `KI 3 4 3 4 0 1 "x" "" ""`},
+		{"MX0 5 0 5 hello\n", `MX 0 5 0 5 0 5 "hello" "" ""`},
+		{"KI0 2 0 2 é\n\n", `KI 0 2 0 2 0 2 "é\n" "" ""`},
+		{"Ei0 3 0 3  Go\n", `Ei 0 3 0 3 0 3 " Go" "" ""`},
+		{"MX0 0 0 0 \n", `MX 0 0 0 0 0 0 "" "" ""`},
+		// A null selection expanded to the surrounding word
+		{"MX4 4 2 0 \nMX0 7 0 7 package\n", `MX 0 7 4 4 2 7 "package" "" ""`},
+		// A selection isn't replaced by its expansion
+		{"MX0 3 2 3 pac\nMX0 7 0 7 package\n", `MX 0 3 0 3 2 3 "pac" "" ""`},
+		{
+			"Mx10 14 8 4 Look\nMx0 0 0 2 go\nMx0 0 0 12 /src/f.go:#5\n",
+			`Mx 10 14 10 14 8 4 "Look" "go" "/src/f.go:#5"`,
+		},
+	}
+
+	for _, tc := range tests {
+		r := bufio.NewReader(strings.NewReader(tc.data))
+		e, err := readEvent(r)
+		if err != nil {
+			t.Errorf("%q: %s", tc.data, err)
+			continue
+		}
+		got := fmt.Sprintf("%c%c %d %d %d %d %d %d %q %q %q",
+			e.C1, e.C2, e.Q0, e.Q1, e.OrigQ0, e.OrigQ1, e.Flag, e.Nr, e.Text, e.Arg, e.Loc)
+		if got != tc.want {
+			t.Errorf("%q read as %s; want %s", tc.data, got, tc.want)
+		}
+		if _, err := r.ReadByte(); err == nil {
+			t.Errorf("%q: not all read", tc.data)
+		}
+	}
+
+	for _, data := range []string{"", "KI", "KIx 1 0 1 a\n", "KI0 1 0 2 a\n", "KI0 1 0 1 ab\n", "KI0 1 0 -1 \n", "KI0 1 0 999 \n"} {
+		if e, err := readEvent(bufio.NewReader(strings.NewReader(data))); err == nil {
+			t.Errorf("%q read as %+v; want an error", data, e)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package acorp
+
+// A client for the snooper (see snoop-acme) that lets programs running outside
+// of acme ask questions such as "which window currently has focus?". The
+// snooper may well not be running so dial failures are retried with a short
+// backoff and reported as ErrSnooperUnavailable, allowing callers to fall back
+// to something else.
+//
+// By default the snooper listens on a unix socket in the current name space
+// (only accessible to the current user) but it can be pointed at a TCP address
+// instead, in which case a shared secret can be required from clients.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"9fans.net/go/plan9/client"
+)
+
+const (
+	// SnooperAddrEnv is the environment variable used to override the address
+	// of the snooper: either 'unix:<path>' or '[tcp:]<host>:<port>'.
+	SnooperAddrEnv = "ACME_SNOOPER_ADDR"
+	// SnooperSecretEnv is the environment variable holding the shared secret
+	// used to authenticate TCP connections to the snooper.
+	SnooperSecretEnv  = "ACME_SNOOPER_SECRET"
+	snooperSocketName = "snooper"
+)
+
+var (
+	// ErrSnooperUnavailable is returned when we are unable to connect to the snooper.
+	ErrSnooperUnavailable = errors.New("snooper is unavailable")
+	// ErrNoActiveWindow is returned when the current window can not be determined.
+	ErrNoActiveWindow = errors.New("unable to determine current window ID")
+)
+
+// A SnooperError is an error or unexpected response from the snooper to a
+// request.
+type SnooperError struct {
+	Route    string
+	Status   int
+	Response string
+}
+
+func (e *SnooperError) Error() string {
+	if e.Status != StatusOK {
+		return fmt.Sprintf("snooper: '%s' failed (%d): %s", e.Route, e.Status, e.Response)
+	}
+	return fmt.Sprintf("snooper: unexpected response to '%s': %s", e.Route, e.Response)
+}
+
+// SnooperAddr returns the address of the snooper, taken from the environment
+// if set and otherwise a unix socket in the current name space.
+func SnooperAddr() string {
+	if addr := strings.TrimSpace(os.Getenv(SnooperAddrEnv)); addr != "" {
+		return addr
+	}
+	return "unix:" + filepath.Join(client.Namespace(), snooperSocketName)
+}
+
+// SnooperSecret returns the shared secret for the snooper from the
+// environment (if set).
+func SnooperSecret() string {
+	return strings.TrimSpace(os.Getenv(SnooperSecretEnv))
+}
+
+// ParseSnooperAddr splits a snooper address into the network and address
+// arguments expected by net.Dial.
+func ParseSnooperAddr(addr string) (network, address string) {
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		return "unix", strings.TrimPrefix(addr, "unix:")
+	case strings.HasPrefix(addr, "tcp:"):
+		return "tcp", strings.TrimPrefix(addr, "tcp:")
+	case strings.Contains(addr, "/"):
+		return "unix", addr
+	default:
+		return "tcp", addr
+	}
+}
+
+// A SnooperClient sends requests to a running snooper.
+type SnooperClient struct {
+	Addr        string
+	Secret      string
+	DialTimeout time.Duration
+	Timeout     time.Duration
+	Retries     int
+	Backoff     time.Duration
+}
+
+// NewSnooperClient initialises a SnooperClient for the address and secret
+// returned by SnooperAddr and SnooperSecret with default timeouts.
+func NewSnooperClient() *SnooperClient {
+	return &SnooperClient{
+		Addr:        SnooperAddr(),
+		Secret:      SnooperSecret(),
+		DialTimeout: 500 * time.Millisecond,
+		Timeout:     2 * time.Second,
+		Retries:     2,
+		Backoff:     50 * time.Millisecond,
+	}
+}
+
+// Send sends content to the given route and returns the response body. Use
+// Dial instead when making several requests.
+func (c *SnooperClient) Send(route, content string) (string, error) {
+	conn, err := c.Dial()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return conn.Send(route, content)
+}
+
+// Dial opens a persistent connection to the snooper.
+func (c *SnooperClient) Dial() (*SnooperConn, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	return &SnooperConn{
+		conn:    conn,
+		dec:     json.NewDecoder(conn),
+		enc:     json.NewEncoder(conn),
+		timeout: c.Timeout,
+		secret:  c.Secret,
+	}, nil
+}
+
+// ActiveWindow asks the snooper for the id of the currently focused window.
+func (c *SnooperClient) ActiveWindow() (int, error) {
+	s, err := c.Send("active", ".")
+	if err != nil {
+		return -1, err
+	}
+
+	id, err := strconv.Atoi(s)
+	if err != nil {
+		return -1, &SnooperError{Route: "active", Status: StatusOK, Response: s}
+	}
+	if id < 0 {
+		return -1, ErrNoActiveWindow
+	}
+	return id, nil
+}
+
+// A SnooperConn is a connection to the snooper that can be used for any number
+// of requests. It is not safe for concurrent use.
+type SnooperConn struct {
+	conn    net.Conn
+	dec     *json.Decoder
+	enc     *json.Encoder
+	timeout time.Duration
+	secret  string
+	id      int
+}
+
+// Send sends content to the given route and returns the response body. Error
+// responses are returned as a *SnooperError.
+func (sc *SnooperConn) Send(route, content string) (string, error) {
+	var b strings.Builder
+	if err := sc.request(route, content, false, &b); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// Stream sends content to the given route and copies the response body to w
+// as the snooper produces it. The timeout applies to each part of the body
+// rather than the whole response. Error responses are returned as a
+// *SnooperError.
+func (sc *SnooperConn) Stream(route, content string, w io.Writer) error {
+	return sc.request(route, content, true, w)
+}
+
+func (sc *SnooperConn) request(route, content string, stream bool, w io.Writer) error {
+	if sc.timeout > 0 {
+		sc.conn.SetDeadline(time.Now().Add(sc.timeout))
+	}
+
+	sc.id++
+	req := SnooperRequest{
+		Version: SnooperProtocolVersion,
+		ID:      sc.id,
+		Secret:  sc.secret,
+		Route:   route,
+		Content: content,
+		Stream:  stream,
+	}
+	if err := sc.enc.Encode(req); err != nil {
+		return err
+	}
+
+	// Keep reading after w fails so that the connection can still be used
+	var werr error
+	for {
+		var resp SnooperResponse
+		if err := sc.dec.Decode(&resp); err != nil {
+			return err
+		}
+		if resp.ID != req.ID {
+			return fmt.Errorf("snooper: response id %d does not match request id %d", resp.ID, req.ID)
+		}
+		if resp.Status != StatusOK {
+			return &SnooperError{Route: route, Status: resp.Status, Response: resp.Error}
+		}
+		if werr == nil {
+			_, werr = io.WriteString(w, resp.Body)
+		}
+		if !resp.More {
+			return werr
+		}
+		if sc.timeout > 0 {
+			sc.conn.SetDeadline(time.Now().Add(sc.timeout))
+		}
+	}
+}
+
+// Close closes the connection.
+func (sc *SnooperConn) Close() error {
+	return sc.conn.Close()
+}
+
+func (c *SnooperClient) dial() (net.Conn, error) {
+	var err error
+	backoff := c.Backoff
+	network, addr := ParseSnooperAddr(c.Addr)
+
+	for attempt := 0; attempt <= c.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		var conn net.Conn
+		if conn, err = net.DialTimeout(network, addr, c.DialTimeout); err == nil {
+			return conn, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrSnooperUnavailable, err)
+}
@@ -0,0 +1,241 @@
+package acorp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSnooperAddr(t *testing.T) {
+	tests := []struct {
+		addr, network, address string
+	}{
+		{"unix:/tmp/ns.me.0/snooper", "unix", "/tmp/ns.me.0/snooper"},
+		{"/tmp/ns.me.0/snooper", "unix", "/tmp/ns.me.0/snooper"},
+		{"unix:snooper", "unix", "snooper"},
+		{"tcp:localhost:7070", "tcp", "localhost:7070"},
+		{"localhost:7070", "tcp", "localhost:7070"},
+		{"tcp:[::1]:7070", "tcp", "[::1]:7070"},
+		{":7070", "tcp", ":7070"},
+	}
+
+	for _, tc := range tests {
+		if network, address := ParseSnooperAddr(tc.addr); network != tc.network || address != tc.address {
+			t.Errorf("%q parsed as %s %q; want %s %q", tc.addr, network, address, tc.network, tc.address)
+		}
+	}
+}
+
+func TestSnooperAddrFromEnv(t *testing.T) {
+	t.Setenv(SnooperAddrEnv, " tcp:localhost:7070\n")
+	t.Setenv(SnooperSecretEnv, " s3cret\n")
+
+	c := NewSnooperClient()
+	if c.Addr != "tcp:localhost:7070" || c.Secret != "s3cret" {
+		t.Errorf("client for %q with secret %q", c.Addr, c.Secret)
+	}
+
+	t.Setenv(SnooperAddrEnv, "")
+	if addr := SnooperAddr(); !strings.HasPrefix(addr, "unix:") || filepath.Base(addr) != snooperSocketName {
+		t.Errorf("default address %q", addr)
+	}
+}
+
+// serveSnooper stands in for the snooper, answering JSON requests on l with
+// respond until the test finishes. TCP clients must send secret (if set) in
+// their first request.
+func serveSnooper(t *testing.T, l net.Listener, secret string, respond func(req SnooperRequest) []SnooperResponse) {
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				dec, enc := json.NewDecoder(bufio.NewReader(conn)), json.NewEncoder(conn)
+				authenticated := secret == "" || l.Addr().Network() == "unix"
+
+				for {
+					var req SnooperRequest
+					if err := dec.Decode(&req); err != nil {
+						return
+					}
+					resps := []SnooperResponse{{Status: StatusUnauthorized, Error: "invalid or missing secret"}}
+					if authenticated = authenticated || req.Secret == secret; authenticated {
+						resps = respond(req)
+					}
+					for _, resp := range resps {
+						resp.Version, resp.ID = SnooperProtocolVersion, req.ID
+						enc.Encode(resp)
+					}
+				}
+			}()
+		}
+	}()
+}
+
+// activeWindow answers requests for the active window with id and echoes
+// anything else back in two parts.
+func activeWindow(id string) func(req SnooperRequest) []SnooperResponse {
+	return func(req SnooperRequest) []SnooperResponse {
+		switch req.Route {
+		case "active":
+			return []SnooperResponse{{Status: StatusOK, Body: id}}
+		case "echo":
+			return []SnooperResponse{
+				{Status: StatusOK, Body: req.Content, More: true},
+				{Status: StatusOK, Body: req.Content},
+			}
+		}
+		return []SnooperResponse{{Status: StatusNotFound, Error: "'" + req.Route + "' is not a known handler"}}
+	}
+}
+
+func testClient(addr, secret string) *SnooperClient {
+	c := NewSnooperClient()
+	c.Addr, c.Secret = addr, secret
+	return c
+}
+
+func TestSnooperClientUnix(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), snooperSocketName)
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveSnooper(t, l, "s3cret", activeWindow("4"))
+
+	// No secret is needed on the unix socket
+	c := testClient("unix:"+sock, "")
+	if id, err := c.ActiveWindow(); err != nil || id != 4 {
+		t.Errorf("ActiveWindow() = %d, %v; want 4", id, err)
+	}
+
+	conn, err := c.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Errors leave the connection open for the next request
+	_, err = conn.Send("nope", "")
+	var serr *SnooperError
+	if !errors.As(err, &serr) || serr.Status != StatusNotFound || serr.Route != "nope" {
+		t.Errorf("unknown route returned %v", err)
+	}
+	var b strings.Builder
+	if err := conn.Stream("echo", "hi\n", &b); err != nil || b.String() != "hi\nhi\n" {
+		t.Errorf("streamed %q, %v", b.String(), err)
+	}
+	if s, err := conn.Send("echo", " hi "); err != nil || s != "hi  hi" {
+		t.Errorf("sent %q, %v", s, err)
+	}
+}
+
+func TestSnooperClientTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveSnooper(t, l, "s3cret", activeWindow("7"))
+	addr := "tcp:" + l.Addr().String()
+
+	if id, err := testClient(addr, "s3cret").ActiveWindow(); err != nil || id != 7 {
+		t.Errorf("ActiveWindow() with the secret = %d, %v; want 7", id, err)
+	}
+
+	for _, secret := range []string{"", "guess"} {
+		_, err := testClient(addr, secret).ActiveWindow()
+		var serr *SnooperError
+		if !errors.As(err, &serr) || serr.Status != StatusUnauthorized {
+			t.Errorf("ActiveWindow() with secret %q returned %v", secret, err)
+		}
+	}
+}
+
+func TestSnooperClientBadResponses(t *testing.T) {
+	tests := []struct {
+		body string
+		err  error
+	}{
+		{"-1", ErrNoActiveWindow},
+		{"four", &SnooperError{Route: "active", Status: StatusOK, Response: "four"}},
+	}
+
+	for _, tc := range tests {
+		sock := filepath.Join(t.TempDir(), snooperSocketName)
+		l, err := net.Listen("unix", sock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serveSnooper(t, l, "", activeWindow(tc.body))
+
+		id, err := testClient(sock, "").ActiveWindow()
+		if id != -1 || err == nil || err.Error() != tc.err.Error() {
+			t.Errorf("active window %q: got %d, %v; want %v", tc.body, id, err, tc.err)
+		}
+	}
+}
+
+func TestSnooperUnavailable(t *testing.T) {
+	for _, addr := range []string{
+		"unix:" + filepath.Join(t.TempDir(), "missing"),
+		"tcp:127.0.0.1:1",
+		"tcp:not an address",
+		"",
+	} {
+		c := testClient(addr, "")
+		c.DialTimeout, c.Backoff = 100*time.Millisecond, time.Millisecond
+		if _, err := c.Send("active", "."); !errors.Is(err, ErrSnooperUnavailable) {
+			t.Errorf("%q: %v; want %v", addr, err, ErrSnooperUnavailable)
+		}
+	}
+}
+
+func TestCurrentWindowID(t *testing.T) {
+	fa := NewFakeAcme()
+	fa.NewWin("/src/main.go", "")
+	fa.NewWin("/src/", "")
+	fa.NewWin("+Errors", "")
+	UseBackend(fa)
+	defer UseBackend(nil)
+
+	sock := filepath.Join(t.TempDir(), snooperSocketName)
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveSnooper(t, l, "", activeWindow("2"))
+
+	// The snooper knows which window has focus
+	t.Setenv("winid", "")
+	t.Setenv(SnooperAddrEnv, "unix:"+sock)
+	if id, err := CurrentWindowID(); err != nil || id != 2 {
+		t.Errorf("from the snooper: %d, %v; want 2", id, err)
+	}
+
+	// acme tells the programs it runs
+	t.Setenv("winid", "9")
+	if id, err := CurrentWindowID(); err != nil || id != 9 {
+		t.Errorf("from $winid: %d, %v; want 9", id, err)
+	}
+	t.Setenv("winid", "nine")
+	if _, err := CurrentWindowID(); err == nil {
+		t.Errorf("non numeric $winid accepted")
+	}
+
+	// Otherwise we guess from the newest file window
+	t.Setenv("winid", "")
+	t.Setenv(SnooperAddrEnv, "unix:"+filepath.Join(t.TempDir(), "missing"))
+	if id, err := CurrentWindowID(); err != nil || id != 1 {
+		t.Errorf("without the snooper: %d, %v; want 1", id, err)
+	}
+}
@@ -0,0 +1,150 @@
+package acorp
+
+// A line based diff used by ApplyText to find the smallest set of changes that
+// will turn one window body into another. This is Myers' O((N+M)D) algorithm
+// (http://www.xmailserver.org/diff2.pdf) run after stripping any common prefix
+// and suffix: most of the time we are looking at a formatter touching a handful
+// of lines so D is small. If the bodies have very little in common we give up
+// and report a single hunk covering everything in between.
+
+import "strings"
+
+// maxDiffEdits bounds the number of edits we search for before falling back to
+// replacing the whole changed region.
+const maxDiffEdits = 1000
+
+// A hunk replaces lines a0 up to a1 of the old text with lines b0 up to b1 of
+// the new text.
+type hunk struct {
+	a0, a1 int
+	b0, b1 int
+}
+
+// splitLines splits s into lines, each keeping its trailing newline.
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines returns the hunks needed to turn a into b, in order.
+func diffLines(a, b []string) []hunk {
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+
+	hunks := myers(a[pre:len(a)-suf], b[pre:len(b)-suf])
+	for i := range hunks {
+		hunks[i].a0 += pre
+		hunks[i].a1 += pre
+		hunks[i].b0 += pre
+		hunks[i].b1 += pre
+	}
+	return hunks
+}
+
+// diffOp is a single deletion of a[x] or insertion of b[y].
+type diffOp struct {
+	x, y int
+	del  bool
+}
+
+func myers(a, b []string) []hunk {
+	n, m := len(a), len(b)
+	if n == 0 && m == 0 {
+		return nil
+	}
+	everything := []hunk{{0, n, 0, m}}
+	if n == 0 || m == 0 {
+		return everything
+	}
+
+	// v[max+k] is the furthest x reached on diagonal k. trace[d] holds the
+	// values of v for k in [-d, d] once round d is complete.
+	max := n + m
+	v := make([]int, 2*max+2)
+	var trace [][]int
+
+	for d := 0; d <= max && d <= maxDiffEdits; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[max+k-1] < v[max+k+1]) {
+				x = v[max+k+1]
+			} else {
+				x = v[max+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[max+k] = x
+
+			if x >= n && y >= m {
+				trace = append(trace, append([]int{}, v[max-d:max+d+1]...))
+				return groupOps(backtrack(trace, n, m))
+			}
+		}
+		trace = append(trace, append([]int{}, v[max-d:max+d+1]...))
+	}
+
+	return everything
+}
+
+// backtrack walks back through trace from (n, m) to recover the edits made,
+// returning them in order.
+func backtrack(trace [][]int, n, m int) []diffOp {
+	var ops []diffOp
+	x, y := n, m
+
+	for d := len(trace) - 1; d > 0; d-- {
+		prev := trace[d-1]
+		get := func(k int) int { return prev[k+d-1] }
+
+		k := x - y
+		var pk int
+		if k == -d || (k != d && get(k-1) < get(k+1)) {
+			pk = k + 1
+		} else {
+			pk = k - 1
+		}
+		px := get(pk)
+		py := px - pk
+
+		if pk == k+1 {
+			ops = append(ops, diffOp{x: px, y: py, del: false})
+		} else {
+			ops = append(ops, diffOp{x: px, y: py, del: true})
+		}
+		x, y = px, py
+	}
+
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// groupOps merges runs of adjacent edits into hunks.
+func groupOps(ops []diffOp) []hunk {
+	var hunks []hunk
+	for _, op := range ops {
+		if len(hunks) == 0 || op.x != hunks[len(hunks)-1].a1 || op.y != hunks[len(hunks)-1].b1 {
+			hunks = append(hunks, hunk{op.x, op.x, op.y, op.y})
+		}
+		h := &hunks[len(hunks)-1]
+		if op.del {
+			h.a1++
+		} else {
+			h.b1++
+		}
+	}
+	return hunks
+}
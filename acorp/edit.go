@@ -3,41 +3,168 @@ package acorp
 import (
 	"fmt"
 	"strings"
+	"unicode/utf8"
 
 	"9fans.net/go/acme"
 )
 
+// A Range is a section of a window body along with the rune offsets that it
+// was read from. Q0 and Q1 use the same units as the Q0 and Q1 fields of an
+// acme.Event so the two can be compared directly.
+type Range struct {
+	Q0, Q1 int
+	Text   string
+}
+
+// Slice returns the text between the window offsets q0 and q1, clamped to the
+// bounds of r.
+func (r *Range) Slice(q0, q1 int) string {
+	runes := []rune(r.Text)
+	q0, q1 = clampOffset(q0-r.Q0, len(runes)), clampOffset(q1-r.Q0, len(runes))
+	if q0 >= q1 {
+		return ""
+	}
+	return string(runes[q0:q1])
+}
+
+func clampOffset(q, max int) int {
+	if q < 0 {
+		return 0
+	}
+	if q > max {
+		return max
+	}
+	return q
+}
+
+// StashAddr records the current addr and dot of w, returning a function that
+// will restore them. Anything that needs to move addr around in order to read
+// or modify a window should stash it first so that the user's selection (and
+// any other program's use of addr) is left untouched.
+func StashAddr(w Window) (func() error, error) {
+	a0, a1, err := w.ReadAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = w.Ctl("addr=dot"); err != nil {
+		return nil, err
+	}
+	d0, d1, err := w.ReadAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		if err := w.Addr("#%d,#%d", d0, d1); err != nil {
+			return err
+		}
+		if err := w.Ctl("dot=addr"); err != nil {
+			return err
+		}
+		return w.Addr("#%d,#%d", a0, a1)
+	}, nil
+}
+
+// ReadAddress reads the section of the body of w selected by the sam address
+// addr, leaving addr and dot as they were.
+func ReadAddress(w Window, addr string) (r *Range, err error) {
+	restore, err := StashAddr(w)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if rerr := restore(); err == nil {
+			err = rerr
+		}
+	}()
+
+	if err = w.Addr("%s", addr); err != nil {
+		return nil, err
+	}
+	q0, q1, err := w.ReadAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := w.ReadAll("xdata")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Range{Q0: q0, Q1: q1, Text: string(b)}, nil
+}
+
+// ReadRange reads the body of w between the rune offsets q0 and q1.
+func ReadRange(w Window, q0, q1 int) (*Range, error) {
+	return ReadAddress(w, fmt.Sprintf("#%d,#%d", q0, q1))
+}
+
+// ReadLines reads lines from through to (inclusive, counting from 1) of the
+// body of w.
+func ReadLines(w Window, from, to int) (*Range, error) {
+	return ReadAddress(w, fmt.Sprintf("%d,%d", from, to))
+}
+
 // SetCursorEOL will position the current window cursor at the end of line.
-func SetCursorEOL(w *acme.Win, line int) {
+func SetCursorEOL(w Window, line int) {
 	w.Addr(fmt.Sprintf("%d-#1", line+1))
 	w.Ctl("dot=addr")
 	w.Ctl("show")
 }
 
 // SetCursorBOL will position the current window cursor at the beginning of line.
-func SetCursorBOL(w *acme.Win, line int) {
+func SetCursorBOL(w Window, line int) {
 	w.Addr(fmt.Sprintf("%d-#0", line))
 	w.Ctl("dot=addr")
 	w.Ctl("show")
 }
 
 // WindowBody reads the body of the current window as single string
-func WindowBody(w *acme.Win) (string, error) {
-	var (
-		body []byte
-		err  error
-	)
-
-	// TODO: stash and restore current addr
-	w.Addr(",")
-	if body, err = w.ReadAll("data"); err != nil {
+func WindowBody(w Window) (string, error) {
+	r, err := ReadAddress(w, ",")
+	if err != nil {
 		return "", err
 	}
-	return string(body), nil
+	return r.Text, nil
+}
+
+// ApplyText replaces the body of w with body by rewriting only the lines that
+// have changed. The changes are written from the bottom up as a single undo
+// step which leaves acme free to keep dot and the scroll position where they
+// were, and addr is moved back to where it was (allowing for the changes) in
+// the same way as StashAddr. If body matches the current contents w is left
+// untouched so a clean window stays clean.
+func ApplyText(w Window, body string) error {
+	old, err := WindowBody(w)
+	if err != nil || old == body {
+		return err
+	}
+	a0, a1, err := w.ReadAddr()
+	if err != nil {
+		return err
+	}
+
+	a, b := splitLines(old), splitLines(body)
+	starts := make([]int, len(a)+1)
+	for i, line := range a {
+		starts[i+1] = starts[i] + utf8.RuneCountInString(line)
+	}
+
+	hunks := diffLines(a, b)
+	edits := make([]samEdit, len(hunks))
+	for i, h := range hunks {
+		edits[i] = samEdit{starts[h.a0], starts[h.a1], []rune(strings.Join(b[h.b0:h.b1], ""))}
+	}
+
+	if err = writeEdits(w, edits); err != nil {
+		return err
+	}
+	return w.Addr("#%d,#%d", shiftEdited(a0, edits), shiftEdited(a1, edits))
 }
 
 // WindowBodyLines reads the body of the current window as an array of strings split on newline
-func WindowBodyLines(w *acme.Win) ([]string, error) {
+func WindowBodyLines(w Window) ([]string, error) {
 	body, err := WindowBody(w)
 	if err != nil {
 		return nil, err
@@ -45,13 +172,14 @@ func WindowBodyLines(w *acme.Win) ([]string, error) {
 	return strings.Split(body, "\n"), nil
 }
 
-// EventLineNumber returns the line that a e occurred on in w
-func EventLineNumber(w *acme.Win, e *acme.Event) (int, error) {
-	body, err := WindowBody(w)
+// EventLineNumber returns the line (counting from 0) that e occurred on in w.
+// Only the text before the event is read from acme: if you need to look up
+// positions for many events, build a PositionIndex instead.
+func EventLineNumber(w Window, e *acme.Event) (int, error) {
+	upToCursor, err := ReadRange(w, 0, e.Q0)
 	if err != nil {
 		return -1, err
 	}
 
-	upToCursor := body[:e.Q0]
-	return strings.Count(upToCursor, "\n"), nil
+	return strings.Count(upToCursor.Text, "\n"), nil
 }
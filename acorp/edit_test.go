@@ -0,0 +1,239 @@
+package acorp
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+var applyLines = []string{
+	"package main\n", "\n", "func main() {\n", "\tfmt.Println(\"héllo\")\n",
+	"}\n", "// ünïcode ✓\n", "x := 1\n", "\n", "return\n",
+}
+
+// randomBody builds a body from n random lines, sometimes without a trailing
+// newline.
+func randomBody(rng *rand.Rand, n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		b.WriteString(applyLines[rng.Intn(len(applyLines))])
+	}
+	s := b.String()
+	if rng.Intn(4) == 0 {
+		s = strings.TrimSuffix(s, "\n")
+	}
+	return s
+}
+
+// mutate makes a few random line level changes to body.
+func mutate(rng *rand.Rand, body string) string {
+	lines := strings.SplitAfter(body, "\n")
+	for n := rng.Intn(4); n >= 0; n-- {
+		i := rng.Intn(len(lines) + 1)
+		switch rng.Intn(3) {
+		case 0: // insert
+			lines = append(lines[:i], append([]string{applyLines[rng.Intn(len(applyLines))]}, lines[i:]...)...)
+		case 1: // delete
+			if i < len(lines) {
+				lines = append(lines[:i], lines[i+1:]...)
+			}
+		case 2: // change
+			if i < len(lines) {
+				lines[i] = strings.ToUpper(lines[i])
+			}
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+func TestApplyTextRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 500; i++ {
+		old := randomBody(rng, rng.Intn(12))
+		body := old
+		if rng.Intn(10) > 0 {
+			body = mutate(rng, old)
+		}
+
+		w := NewFakeWin(1, "f", old)
+		w.Select(0, 1)
+		w.Ctl("clean")
+
+		if err := ApplyText(w, body); err != nil {
+			t.Fatalf("ApplyText(%q, %q): %s", old, body, err)
+		}
+		if got := w.Body(); got != body {
+			t.Fatalf("ApplyText(%q, %q) left %q", old, body, got)
+		}
+		if q0, q1, _ := w.ReadAddr(); q0 != 0 || q1 != 0 {
+			t.Fatalf("ApplyText(%q, %q) moved addr to %d,%d", old, body, q0, q1)
+		}
+		if q0, _ := w.Dot(); q0 != 0 {
+			t.Fatalf("ApplyText(%q, %q) moved dot to %d", old, body, q0)
+		}
+		if w.Dirty() != (old != body) {
+			t.Fatalf("ApplyText(%q, %q): dirty = %v", old, body, w.Dirty())
+		}
+	}
+}
+
+func TestApplyText(t *testing.T) {
+	tests := []struct {
+		old, body string
+		addr      string
+		q0, q1    int // addr afterwards
+	}{
+		{"a\nb\nc\n", "a\nb\nc\n", "2", 2, 4},
+		{"a\nb\nc\n", "a\nB\nc\n", "3", 4, 6},
+		{"a\nb\nc\n", "A\nb\nC\n", "2", 2, 4},
+		{"a\nb\nc\n", "a\nb\nc\nd\n", "1", 0, 2},
+		{"a\nb\nc\n", "x\ny\na\nb\nc\n", "2", 6, 8},
+		{"a\nb\nc\n", "a\nc\n", "3", 2, 4},
+		{"a\nb\nc\n", "a\nc\n", "2", 2, 2},
+		{"é\nb\nc", "é\nb\nç", "#1,#3", 1, 3},
+	}
+
+	for _, tc := range tests {
+		w := NewFakeWin(1, "f", tc.old)
+		w.Addr("%s", tc.addr)
+
+		if err := ApplyText(w, tc.body); err != nil {
+			t.Fatalf("ApplyText(%q, %q): %s", tc.old, tc.body, err)
+		}
+		if got := w.Body(); got != tc.body {
+			t.Errorf("ApplyText(%q, %q) left %q", tc.old, tc.body, got)
+		}
+		if q0, q1, _ := w.ReadAddr(); q0 != tc.q0 || q1 != tc.q1 {
+			t.Errorf("ApplyText(%q, %q) with addr %s: addr = %d,%d; want %d,%d",
+				tc.old, tc.body, tc.addr, q0, q1, tc.q0, tc.q1)
+		}
+
+		// All of the changes should be a single undo step
+		marks := 0
+		for _, msg := range w.CtlLog() {
+			if msg == "nomark" {
+				marks++
+			}
+		}
+		want := 1
+		if tc.old == tc.body {
+			want = 0
+		}
+		if marks != want {
+			t.Errorf("ApplyText(%q, %q) wrote %d undo steps; want %d", tc.old, tc.body, marks, want)
+		}
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		a, b  string
+		hunks []hunk
+	}{
+		{"a\nb\nc\n", "a\nb\nc\n", nil},
+		{"a\nb\nc\n", "a\nB\nc\n", []hunk{{1, 2, 1, 2}}},
+		{"a\nb\nc\n", "a\nc\n", []hunk{{1, 2, 1, 1}}},
+		{"a\nb\nc\n", "a\nb\nx\nc\n", []hunk{{2, 2, 2, 3}}},
+		{"a\nb\nc\nd\n", "A\nb\nc\nD\n", []hunk{{0, 1, 0, 1}, {3, 4, 3, 4}}},
+		{"", "a\n", []hunk{{0, 0, 0, 1}}},
+		{"a\n", "", []hunk{{0, 1, 0, 0}}},
+		{"a\nb", "a\nb\n", []hunk{{1, 2, 1, 2}}},
+	}
+
+	for _, tc := range tests {
+		got := diffLines(splitLines(tc.a), splitLines(tc.b))
+		if len(got) != len(tc.hunks) {
+			t.Errorf("diffLines(%q, %q) = %v; want %v", tc.a, tc.b, got, tc.hunks)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.hunks[i] {
+				t.Errorf("diffLines(%q, %q) = %v; want %v", tc.a, tc.b, got, tc.hunks)
+				break
+			}
+		}
+	}
+}
+
+func TestDiffLinesRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+
+	for i := 0; i < 500; i++ {
+		old := randomBody(rng, rng.Intn(30))
+		body := mutate(rng, old)
+		a, b := splitLines(old), splitLines(body)
+
+		// Applying the hunks from the bottom up must give us b
+		lines := append([]string{}, a...)
+		hunks := diffLines(a, b)
+		for j := len(hunks) - 1; j >= 0; j-- {
+			h := hunks[j]
+			tail := append(append([]string{}, b[h.b0:h.b1]...), lines[h.a1:]...)
+			lines = append(lines[:h.a0], tail...)
+		}
+		if got := strings.Join(lines, ""); got != body {
+			t.Fatalf("diffLines(%q, %q) produced %q", old, body, got)
+		}
+		for j := 1; j < len(hunks); j++ {
+			if hunks[j].a0 < hunks[j-1].a1 || hunks[j].b0 < hunks[j-1].b1 {
+				t.Fatalf("diffLines(%q, %q) produced overlapping hunks: %v", old, body, hunks)
+			}
+		}
+	}
+}
+
+func TestReadAddressKeepsAddrAndDot(t *testing.T) {
+	tests := []struct {
+		addr string
+		want Range
+	}{
+		{",", Range{0, 14, editText}},
+		{"2", Range{4, 8, "two\n"}},
+		{"#1,#3", Range{1, 3, "ne"}},
+		{"/thr/-+", Range{8, 14, "three\n"}},
+		{"$", Range{14, 14, ""}},
+	}
+
+	for _, tc := range tests {
+		w := NewFakeWin(1, "f", editText)
+		w.Select(1, 2)
+		w.Addr("3")
+
+		r, err := ReadAddress(w, tc.addr)
+		if err != nil || *r != tc.want {
+			t.Errorf("ReadAddress(%q) = %v, %v; want %v", tc.addr, r, err, tc.want)
+		}
+		if q0, q1 := w.Dot(); q0 != 1 || q1 != 2 {
+			t.Errorf("ReadAddress(%q) moved dot to %d,%d", tc.addr, q0, q1)
+		}
+		if q0, q1, _ := w.ReadAddr(); q0 != 8 || q1 != 14 {
+			t.Errorf("ReadAddress(%q) moved addr to %d,%d", tc.addr, q0, q1)
+		}
+	}
+
+	w := NewFakeWin(1, "f", editText)
+	if _, err := ReadAddress(w, "9"); err == nil {
+		t.Errorf("expected an error reading past the end of the body")
+	}
+}
+
+func TestRangeSlice(t *testing.T) {
+	r := &Range{Q0: 4, Q1: 8, Text: "twö\n"}
+
+	tests := []struct {
+		q0, q1 int
+		want   string
+	}{
+		{4, 8, "twö\n"},
+		{5, 7, "wö"},
+		{0, 6, "tw"},
+		{7, 99, "\n"},
+		{6, 5, ""},
+	}
+	for _, tc := range tests {
+		if got := r.Slice(tc.q0, tc.q1); got != tc.want {
+			t.Errorf("Slice(%d, %d) = %q; want %q", tc.q0, tc.q1, got, tc.want)
+		}
+	}
+}
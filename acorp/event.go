@@ -1,28 +1,186 @@
 package acorp
 
 import (
+	"context"
 	"fmt"
+	"sync"
+	"time"
 
 	"9fans.net/go/acme"
 )
 
-// A handler fucntion that processes an Acme event and takes an action. Passthrough must be explicitly
-// carried out by the handler function itself.
-type handler = func(*acme.Win, *acme.Event, func() error) error
+// Flag bits set by acme on events. See acme(4) for the full details.
+const (
+	// FlagBuiltin is set on X/x events when the text is an acme builtin command
+	// and on L/l events when acme can handle the action without loading new text.
+	FlagBuiltin = 1
+	// FlagExpanded is set when Q0/Q1 hold acme's expansion of a null selection.
+	FlagExpanded = 2
+	// FlagFileName is set on L/l events when the text is a file or window name.
+	FlagFileName = 4
+	// FlagChordedArg is set on X/x events that have a chorded argument.
+	FlagChordedArg = 8
+)
+
+// An EventKind identifies an acme event by its origin (E: writes to the body or
+// tag files, F: other writes to the window's files, K: keyboard, M: mouse) and
+// type (I/i: insert, D/d: delete, X/x: execute, L/l: look, where lower case is
+// the tag and upper case the body). "MX" is a button 2 click in the body.
+type EventKind string
+
+// KindOf returns the EventKind of e.
+func KindOf(e *acme.Event) EventKind {
+	return EventKind([]rune{e.C1, e.C2})
+}
+
+// IsBuiltin reports whether e has FlagBuiltin set.
+func IsBuiltin(e *acme.Event) bool {
+	return e.Flag&FlagBuiltin != 0
+}
+
+// IsExpanded reports whether e is an expansion of a null selection, in which
+// case OrigQ0 and OrigQ1 hold the location of the original click.
+func IsExpanded(e *acme.Event) bool {
+	return e.Flag&FlagExpanded != 0
+}
+
+// IsFileName reports whether e has FlagFileName set.
+func IsFileName(e *acme.Event) bool {
+	return e.Flag&FlagFileName != 0
+}
+
+// ChordedArg returns the chorded argument of an execute event along with the
+// location it was taken from (of the form 'window:#q0,#q1').
+func ChordedArg(e *acme.Event) (arg, loc string, ok bool) {
+	if e.Flag&FlagChordedArg == 0 {
+		return "", "", false
+	}
+	return string(e.Arg), string(e.Loc), true
+}
+
+// A Handler is a function that processes an Acme event and takes an action. Passthrough must be
+// explicitly carried out by the handler function itself. Calling done marks the filter as complete
+// once the handler returns.
+type Handler = func(w Window, e *acme.Event, done func() error) error
 
 // An EventFilter takes hold of an acme window's event file and passes all events
-// it sees through a set of filter functions if they are defined. Unmatched events
-// are passed through to acme.
+// it sees through a set of filter functions if they are defined. Handlers in the
+// Handlers map take priority over the named fields, which are shorthand for the
+// most commonly used event kinds. Events without a handler are passed to
+// Unhandled if it is set and otherwise passed through to acme.
+//
+// Before reaching the handlers, each event is passed down the Middleware stack
+// (outermost first) so that common behaviour can be shared between tools.
 type EventFilter struct {
 	complete           bool
-	KeyboardInputBody  handler
-	KeyboardDeleteBody handler
-	KeyboardInputTag   handler
-	KeyboardDeleteTag  handler
-	Mouse2Body         handler
-	Mouse3Body         handler
-	Mouse2Tag          handler
-	Mouse3Tag          handler
+	mu                 sync.Mutex // guards run and deferred
+	run                int        // the number of times the filter has stopped
+	deferred           []*deferredCall
+	wake               chan struct{} // signalled when a call is deferred
+	Middleware         []Middleware
+	Handlers           map[EventKind]Handler
+	Unhandled          Handler
+	KeyboardInputBody  Handler
+	KeyboardDeleteBody Handler
+	KeyboardInputTag   Handler
+	KeyboardDeleteTag  Handler
+	Mouse2Body         Handler
+	Mouse3Body         Handler
+	Mouse2Tag          Handler
+	Mouse3Tag          Handler
+}
+
+// Handle registers h as the handler for events of the given kind.
+func (ef *EventFilter) Handle(kind EventKind, h Handler) {
+	if ef.Handlers == nil {
+		ef.Handlers = make(map[EventKind]Handler)
+	}
+	ef.Handlers[kind] = h
+}
+
+// Use appends mw to the middleware stack.
+func (ef *EventFilter) Use(mw ...Middleware) {
+	ef.Middleware = append(ef.Middleware, mw...)
+}
+
+// A deferredCall is a call from After that is due to run on the event loop.
+type deferredCall struct {
+	f         func() error
+	cancelled bool
+}
+
+// After schedules f to run on the event loop once d has elapsed, returning a
+// function that cancels it. An error returned by f stops the filter in the same
+// way as an error from a Handler. Calls made while the filter isn't running
+// wait for it to start while those still pending when it stops are discarded.
+func (ef *EventFilter) After(d time.Duration, f func() error) (cancel func()) {
+	c := &deferredCall{f: f}
+	ef.mu.Lock()
+	run := ef.run
+	ef.mu.Unlock()
+
+	t := time.AfterFunc(d, func() {
+		ef.mu.Lock()
+		defer ef.mu.Unlock()
+
+		if ef.run != run || c.cancelled {
+			return
+		}
+		ef.deferred = append(ef.deferred, c)
+		select {
+		case ef.wakeChan() <- struct{}{}:
+		default:
+		}
+	})
+
+	return func() {
+		t.Stop()
+		ef.mu.Lock()
+		c.cancelled = true
+		ef.mu.Unlock()
+	}
+}
+
+// wakeChan returns the channel used to wake the event loop when a call is
+// deferred. ef.mu must be held.
+func (ef *EventFilter) wakeChan() chan struct{} {
+	if ef.wake == nil {
+		ef.wake = make(chan struct{}, 1)
+	}
+	return ef.wake
+}
+
+// runDeferred runs the calls that are due until one fails or completes the
+// filter.
+func (ef *EventFilter) runDeferred() error {
+	for !ef.complete {
+		ef.mu.Lock()
+		var f func() error
+		for f == nil && len(ef.deferred) > 0 {
+			if c := ef.deferred[0]; !c.cancelled {
+				f = c.f
+			}
+			ef.deferred = ef.deferred[1:]
+		}
+		ef.mu.Unlock()
+
+		if f == nil {
+			return nil
+		}
+		if err := f(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stop discards any calls still waiting to run on the event loop.
+func (ef *EventFilter) stop() {
+	ef.mu.Lock()
+	defer ef.mu.Unlock()
+
+	ef.run++
+	ef.deferred = nil
 }
 
 func (ef *EventFilter) markComplete() error {
@@ -30,18 +188,45 @@ func (ef *EventFilter) markComplete() error {
 	return nil
 }
 
-func (ef *EventFilter) applyOrPassthrough(f handler, w *acme.Win, e *acme.Event) error {
-	if f != nil {
-		return f(w, e, ef.markComplete)
+// Filter runs the event filter until a handler marks it as complete, an error
+// is encountered or ctx is cancelled (in which case ctx.Err() is returned). In
+// all cases the window event file is released back to acme before returning.
+// The window being deleted is not an error.
+func (ef *EventFilter) Filter(ctx context.Context, w Window) error {
+	ef.complete = false
+	ef.mu.Lock()
+	wake := ef.wakeChan()
+	ef.mu.Unlock()
+	defer ef.stop()
+
+	h := ef.chain()
+	r, err := readEvents(w)
+	if err != nil {
+		return err
 	}
+	defer r.release()
 
-	return w.WriteEvent(e)
-}
+	for {
+		var err error
 
-// Filter runs the event filter, releasing the window event file on the first error encountered
-func (ef *EventFilter) Filter(w *acme.Win) error {
-	for e := range w.EventChan() {
-		if err := ef.filterSingle(w, e); err != nil {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case e, ok := <-r.c:
+			if !ok {
+				if isDeleted(w) {
+					return nil
+				}
+				return fmt.Errorf("lost event channel")
+			}
+			err = ef.filterSingle(w, e, h)
+
+		case <-wake:
+			err = ef.runDeferred()
+		}
+
+		if err != nil {
 			return err
 		}
 
@@ -49,40 +234,215 @@ func (ef *EventFilter) Filter(w *acme.Win) error {
 			return nil
 		}
 	}
+}
+
+// isDeleted reports whether w has been deleted: acme refuses to read any of a
+// window's files once it has gone.
+func isDeleted(w Window) bool {
+	_, err := w.ReadAll("ctl")
+	return err != nil
+}
 
-	return fmt.Errorf("lost event channel")
+// An eventReader reads the event file of a window on behalf of Filter. We
+// can't use the channel from acme.Win.EventChan as the reader behind it can
+// only be stopped by closing the window's files, which races with the read in
+// flight and is undone by that read re-opening the event file. Instead, when a
+// Filter releases the reader the event file is closed straight away if it is
+// waiting on a read. Otherwise it is busy handing over an event, which it
+// writes back before closing the file itself. If another Filter starts on the
+// window before the reader has exited it picks up the same reader.
+type eventReader struct {
+	w       Window
+	c       chan *acme.Event // closed if the window goes away
+	stop    chan struct{}    // closed by release
+	held    bool             // a Filter is reading from c
+	reading bool             // waiting on ReadEvent
+	closing bool             // release has closed the event file under ReadEvent
 }
 
-// Currently dropping E and F events that are generated by writes from other programs to the acme
-// control files.
-func (ef *EventFilter) filterSingle(w *acme.Win, e *acme.Event) error {
+var (
+	readersMu sync.Mutex // guards readers and the state of each reader
+	readers   = make(map[Window]*eventReader)
+)
+
+// readEvents returns the eventReader for w, starting one if there isn't one.
+// Only one Filter can read the events of a window at a time.
+func readEvents(w Window) (*eventReader, error) {
+	readersMu.Lock()
+	defer readersMu.Unlock()
+
+	r, ok := readers[w]
+	if ok && r.held {
+		return nil, fmt.Errorf("window %d already has a filter reading its events", w.ID())
+	}
+	if !ok {
+		r = &eventReader{w: w, c: make(chan *acme.Event)}
+		readers[w] = r
+		go r.run()
+	}
+
+	r.held, r.stop = true, make(chan struct{})
+	return r, nil
+}
+
+// release hands the event file back to acme. It is safe to call more than
+// once.
+func (r *eventReader) release() {
+	readersMu.Lock()
+	defer readersMu.Unlock()
+
+	if !r.held {
+		return
+	}
+	r.held = false
+	close(r.stop)
+
+	// Closed under the lock so that it can't interrupt the read of a Filter
+	// that picks the reader up again
+	if r.reading && !r.closing {
+		r.closing = true
+		r.w.CloseFiles()
+	}
+}
+
+func (r *eventReader) run() {
+	for {
+		readersMu.Lock()
+		if !r.held {
+			r.exit()
+			readersMu.Unlock()
+			return
+		}
+		r.reading = true
+		readersMu.Unlock()
+
+		e, err := r.w.ReadEvent()
+
+		readersMu.Lock()
+		closed := r.closing
+		r.reading, r.closing = false, false
+		switch {
+		case err != nil && !closed:
+			// The window has gone
+			delete(readers, r.w)
+			close(r.c)
+			readersMu.Unlock()
+			return
+		case err != nil:
+			// Closed by release: carry on if the window has been picked up again
+			readersMu.Unlock()
+			continue
+		case !r.held:
+			// Read just as release closed the file
+			Passthrough(r.w, e)
+			r.exit()
+			readersMu.Unlock()
+			return
+		}
+		readersMu.Unlock()
+
+		for !r.deliver(e) {
+			readersMu.Lock()
+			if !r.held {
+				Passthrough(r.w, e)
+				r.exit()
+				readersMu.Unlock()
+				return
+			}
+			readersMu.Unlock()
+		}
+	}
+}
+
+// deliver sends e to the Filter reading from r, reporting false if r has been
+// released instead.
+func (r *eventReader) deliver(e *acme.Event) bool {
+	readersMu.Lock()
+	stop := r.stop
+	readersMu.Unlock()
+
+	select {
+	case r.c <- e:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// exit closes the event file of a released reader and forgets it so that the
+// next Filter on the window starts a new one. readersMu must be held.
+func (r *eventReader) exit() {
+	delete(readers, r.w)
+	r.w.CloseFiles()
+}
+
+// chain wraps dispatch in the middleware stack. Middleware may hold state
+// between events so this is done once per call to Filter.
+func (ef *EventFilter) chain() Handler {
+	h := ef.dispatch
+	for i := len(ef.Middleware) - 1; i >= 0; i-- {
+		h = ef.Middleware[i](h)
+	}
+	return h
+}
+
+func (ef *EventFilter) filterSingle(w Window, e *acme.Event, h Handler) error {
+	return h(w, e, ef.markComplete)
+}
+
+func (ef *EventFilter) dispatch(w Window, e *acme.Event, done func() error) error {
+	if f := ef.handlerFor(e); f != nil {
+		return f(w, e, done)
+	}
+	if ef.Unhandled != nil {
+		return ef.Unhandled(w, e, done)
+	}
+
+	return Passthrough(w, e)
+}
+
+func (ef *EventFilter) handlerFor(e *acme.Event) Handler {
+	if f, ok := ef.Handlers[KindOf(e)]; ok {
+		return f
+	}
+
 	switch e.C1 {
 	case 'K':
 		switch e.C2 {
 		case 'I':
-			ef.applyOrPassthrough(ef.KeyboardInputBody, w, e)
+			return ef.KeyboardInputBody
 		case 'D':
-			ef.applyOrPassthrough(ef.KeyboardDeleteBody, w, e)
+			return ef.KeyboardDeleteBody
 		case 'i':
-			ef.applyOrPassthrough(ef.KeyboardInputTag, w, e)
+			return ef.KeyboardInputTag
 		case 'd':
-			ef.applyOrPassthrough(ef.KeyboardDeleteTag, w, e)
+			return ef.KeyboardDeleteTag
 		}
-		return nil
 
 	case 'M':
 		switch e.C2 {
 		case 'X':
-			return ef.applyOrPassthrough(ef.Mouse2Body, w, e)
+			return ef.Mouse2Body
 		case 'L':
-			return ef.applyOrPassthrough(ef.Mouse3Body, w, e)
+			return ef.Mouse3Body
 		case 'x':
-			return ef.applyOrPassthrough(ef.Mouse2Tag, w, e)
+			return ef.Mouse2Tag
 		case 'l':
-			return ef.applyOrPassthrough(ef.Mouse3Tag, w, e)
+			return ef.Mouse3Tag
 		}
 	}
 
-	w.WriteEvent(e)
+	return nil
+}
+
+// Passthrough hands e back to acme for default processing. Only execute and
+// look events can be written back to the event file: insertions and deletions
+// have already been applied by the time we see them so there is nothing more
+// for acme to do.
+func Passthrough(w Window, e *acme.Event) error {
+	switch e.C2 {
+	case 'X', 'x', 'L', 'l':
+		return w.WriteEvent(e)
+	}
 	return nil
 }
@@ -0,0 +1,354 @@
+package acorp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"9fans.net/go/acme"
+)
+
+// countingFilter returns a filter that handles keyboard input in the body,
+// counting the events and completing after the nth in each run.
+func countingFilter(n int, seen *int) *EventFilter {
+	ef := &EventFilter{}
+	run := 0
+	ef.Handle("KI", func(w Window, e *acme.Event, done func() error) error {
+		*seen++
+		if run++; run == n {
+			run = 0
+			return done()
+		}
+		return nil
+	})
+	return ef
+}
+
+// typed is the event for typing r at the start of the body.
+func typed(r rune) *acme.Event {
+	return &acme.Event{C1: 'K', C2: 'I', Q0: 0, Q1: 1, Nr: 1, Text: []byte(string(r))}
+}
+
+func TestFilterCompletesEachRun(t *testing.T) {
+	w := NewFakeWin(1, "f", "")
+	seen := 0
+	ef := countingFilter(2, &seen)
+
+	for run := 1; run <= 3; run++ {
+		// Events only reach the filter once it has the event file, so type
+		// from inside the loop.
+		ef.After(0, func() error {
+			w.Send(typed('a'))
+			w.Send(typed('b'))
+			return nil
+		})
+		if err := ef.Filter(context.Background(), w); err != nil {
+			t.Fatalf("run %d: %s", run, err)
+		}
+		if seen != 2*run {
+			t.Fatalf("run %d: handled %d events; want %d", run, seen, 2*run)
+		}
+	}
+}
+
+func TestFilterWindowDeleted(t *testing.T) {
+	fa := NewFakeAcme()
+	w := fa.NewWin("f", "")
+	seen := 0
+	ef := countingFilter(10, &seen)
+
+	w.Send(typed('a'))
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		w.Del(true)
+	}()
+
+	if err := ef.Filter(context.Background(), w); err != nil {
+		t.Errorf("deleting the window should not be an error: %s", err)
+	}
+
+	sup := NewSupervisor(context.Background())
+	w = fa.NewWin("g", "")
+	sup.Go(w, countingFilter(10, &seen))
+	w.Del(true)
+	if err := sup.Wait(); err != nil {
+		t.Errorf("supervisor recorded %s for a deleted window", err)
+	}
+}
+
+// released waits for the event file of w to be closed and its reader to exit.
+func released(t *testing.T, w *FakeWin) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		w.mu.Lock()
+		reading := w.reading
+		w.mu.Unlock()
+		readersMu.Lock()
+		_, ok := readers[w]
+		readersMu.Unlock()
+
+		if !reading && !ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("event file still held (reading %v, reader running %v)", reading, ok)
+		}
+	}
+}
+
+func TestFilterReleasesEventFile(t *testing.T) {
+	w := NewFakeWin(1, "f", "")
+	seen := 0
+	ef := countingFilter(1, &seen)
+
+	w.Send(typed('a'))
+	if err := ef.Filter(context.Background(), w); err != nil {
+		t.Fatal(err)
+	}
+
+	// Acme handles clicks itself from now on rather than waiting for the
+	// reader to wake up and write them back
+	released(t, w)
+	w.Type("b")
+	if err := w.MouseTag('x', "Snarf"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if len(w.Written()) != 0 || seen != 1 {
+		t.Errorf("after release: handled %d events and wrote back %v", seen, w.Written())
+	}
+}
+
+func TestFilterWritesBackAfterRelease(t *testing.T) {
+	w := NewFakeWin(1, "f", "")
+	ef := &EventFilter{}
+	ef.Handle("KI", func(_ Window, e *acme.Event, done func() error) error {
+		// Wait for the reader to pick up the click
+		for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+			w.mu.Lock()
+			n := len(w.pending)
+			w.mu.Unlock()
+			if n == 0 || time.Now().After(deadline) {
+				break
+			}
+		}
+		return done()
+	})
+
+	// The click is read before the filter completes but never handled, so it
+	// must be handed back to acme rather than dropped.
+	w.Send(typed('a'))
+	w.Send(&acme.Event{C1: 'M', C2: 'X', Q0: 0, Q1: 0})
+	if err := ef.Filter(context.Background(), w); err != nil {
+		t.Fatal(err)
+	}
+	released(t, w)
+
+	if len(w.Written()) != 1 {
+		t.Fatalf("wrote back %v; want the click", w.Written())
+	}
+	if e := w.Written()[0]; KindOf(e) != "MX" {
+		t.Errorf("wrote back %s; want MX", KindOf(e))
+	}
+}
+
+func TestFilterTwiceOnOneWindow(t *testing.T) {
+	w := NewFakeWin(1, "f", "")
+	started := make(chan struct{})
+	first := &EventFilter{}
+	first.Handle("KI", func(w Window, e *acme.Event, done func() error) error {
+		if string(e.Text) == "a" {
+			close(started)
+			return nil
+		}
+		return done()
+	})
+
+	errc := make(chan error)
+	go func() { errc <- first.Filter(context.Background(), w) }()
+	w.Send(typed('a'))
+	<-started
+
+	// Only one filter can read the events at a time
+	seen := 0
+	second := countingFilter(1, &seen)
+	err := second.Filter(context.Background(), w)
+	if err == nil || !strings.Contains(err.Error(), "already has a filter") {
+		t.Errorf("second filter returned %v", err)
+	}
+
+	w.Send(typed('b'))
+	if err := <-errc; err != nil {
+		t.Fatalf("first filter: %s", err)
+	}
+
+	// Once the first has finished the second can take over
+	second.After(0, func() error {
+		w.Send(typed('c'))
+		return nil
+	})
+	if err := second.Filter(context.Background(), w); err != nil || seen != 1 {
+		t.Errorf("second filter returned %v after handling %d events", err, seen)
+	}
+	released(t, w)
+}
+
+func TestFilterAfter(t *testing.T) {
+	w := NewFakeWin(1, "f", "")
+	ef := &EventFilter{}
+	errStop := errors.New("stop")
+
+	for run := 0; run < 3; run++ {
+		go ef.After(time.Millisecond, func() error { return errStop })
+		if err := ef.Filter(context.Background(), w); err != errStop {
+			t.Errorf("run %d: Filter returned %v; want %v", run, err, errStop)
+		}
+	}
+}
+
+func TestFilterRouting(t *testing.T) {
+	fa := NewFakeAcme()
+	w := fa.NewWin("/src/f.go", "package f\n")
+	var routed []string
+
+	record := func(route string) Handler {
+		return func(w Window, e *acme.Event, done func() error) error {
+			routed = append(routed, fmt.Sprintf("%s:%s:%s", route, KindOf(e), e.Text))
+			return nil
+		}
+	}
+
+	ef := &EventFilter{}
+	ef.Handle("EI", record("writes"))
+	ef.Handle("FD", record("writes"))
+	ef.Handle("FI", record("writes"))
+	ef.Handle("KI", record("handlers")) // takes priority over the named field
+	ef.KeyboardInputBody = record("named")
+	ef.KeyboardDeleteBody = record("named")
+	ef.Mouse3Tag = record("named")
+	ef.Mouse2Body = func(w Window, e *acme.Event, done func() error) error {
+		arg, loc, ok := ChordedArg(e)
+		routed = append(routed, fmt.Sprintf("named:MX:%s:%q:%q:%v", e.Text, arg, loc, ok))
+		return nil
+	}
+	ef.Unhandled = record("unhandled")
+
+	runFilter(t, ef, w, func() {
+		w.Write("body", []byte("var x int\n"))
+		w.Addr("#0,#7")
+		w.Write("data", []byte("package g"))
+		w.Type("x")
+		w.Backspace()
+		w.MouseTag('l', "Snarf")
+		w.MouseBody('X', 0, 7)
+		w.Send(&acme.Event{
+			C1: 'M', C2: 'X', Q0: 0, Q1: 7, Flag: FlagChordedArg,
+			Text: []byte("package"), Arg: []byte("g"), Loc: []byte("/src/f.go:#8,#9"),
+		})
+		w.MouseBody('L', 8, 9)
+		w.Write("tag", []byte(" Put"))
+	})
+
+	want := []string{
+		"writes:EI:var x int\n",
+		"writes:FD:",
+		"writes:FI:package g",
+		"handlers:KI:x",
+		"named:KD:",
+		"named:Ml:Snarf",
+		`named:MX:package:"":"":false`,
+		`named:MX:package:"g":"/src/f.go:#8,#9":true`,
+		"unhandled:ML:g",
+		"unhandled:Ei: Put",
+	}
+	if got, want := strings.Join(routed, "\n"), strings.Join(want, "\n"); got != want {
+		t.Errorf("routed:\n%s\nwant:\n%s", got, want)
+	}
+	if len(w.Written()) != 0 {
+		t.Errorf("events written back: %v", w.Written())
+	}
+}
+
+func TestFilterPassthrough(t *testing.T) {
+	fa := NewFakeAcme()
+	w := fa.NewWin("/src/f.go", "package f\n")
+	var typed string
+
+	// Without Unhandled, execute and look events go back to acme and
+	// everything else is dropped
+	ef := &EventFilter{}
+	ef.Handle("KI", func(w Window, e *acme.Event, done func() error) error {
+		typed += string(e.Text)
+		return nil
+	})
+	runFilter(t, ef, w, func() {
+		w.Type("a")
+		w.Backspace()
+		w.MouseBody('L', 0, 7)
+		w.MouseTag('x', "Snarf")
+		w.Write("body", []byte("b"))
+	})
+
+	var written []string
+	for _, e := range w.Written() {
+		written = append(written, fmt.Sprintf("%s %d %d", KindOf(e), e.Q0, e.Q1))
+	}
+	if got := strings.Join(written, ", "); got != "ML 0 7, Mx 14 19" {
+		t.Errorf("written back %q", got)
+	}
+	if typed != "a" {
+		t.Errorf("typed %q", typed)
+	}
+}
+
+func TestFilterAfterStopped(t *testing.T) {
+	w := NewFakeWin(1, "f", "")
+	ef := &EventFilter{}
+	errStop := errors.New("stop")
+	var ran []string
+	record := func(name string) func() error {
+		return func() error {
+			ran = append(ran, name)
+			return nil
+		}
+	}
+
+	// A call that is due after the filter stops is dropped
+	ef.After(50*time.Millisecond, record("late"))
+	ef.After(0, func() error { return errStop })
+	if err := ef.Filter(context.Background(), w); err != errStop {
+		t.Fatalf("Filter returned %v; want %v", err, errStop)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// While nothing is running calls wait for the next run without tying up a
+	// goroutine each
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		ef.After(0, record("between"))
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := runtime.NumGoroutine(); n > before+5 {
+		t.Errorf("%d goroutines waiting to run calls on a stopped filter; had %d", n, before)
+	}
+
+	// Cancelling a call that is due but hasn't run yet stops it running
+	var cancel func()
+	ef.After(0, func() error {
+		cancel = ef.After(0, record("cancelled"))
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+		return nil
+	})
+	ef.After(100*time.Millisecond, func() error { return errStop })
+	if err := ef.Filter(context.Background(), w); err != errStop {
+		t.Fatalf("Filter returned %v; want %v", err, errStop)
+	}
+	if len(ran) != 100 || ran[0] != "between" || ran[99] != "between" {
+		t.Errorf("ran %d calls: %q", len(ran), ran)
+	}
+}
@@ -0,0 +1,872 @@
+package acorp
+
+// An in-memory implementation of Backend and Window that understands enough
+// of acme's file interface to drive our tools from tests or a headless box.
+//
+// FakeWin keeps a body and tag as runes along with addr, dot and dirty state.
+// The addr file accepts the subset of sam addresses implemented in addr.go and
+// data/xdata reads and writes behave the same way as they do in acme. Events
+// are queued up using the helper methods (Type, Backspace, MouseBody, MouseTag
+// or Send) and delivered via ReadEvent, while events written back to acme are
+// recorded so that callers can check what was passed through. Executing Edit
+// commands is supported via the interpreter in fakeedit.go, with any output
+// going to a +Errors window as it would in acme.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"9fans.net/go/acme"
+)
+
+const fakeTagCommands = "Del Snarf |"
+
+// A FakeAcme is an in-memory Backend that hands out FakeWins and maintains a
+// log of window events.
+type FakeAcme struct {
+	mu      sync.Mutex
+	nextID  int
+	windows map[int]*FakeWin
+	logs    []*fakeLog
+}
+
+var _ Backend = (*FakeAcme)(nil)
+
+// NewFakeAcme initialises an empty FakeAcme
+func NewFakeAcme() *FakeAcme {
+	return &FakeAcme{
+		nextID:  1,
+		windows: make(map[int]*FakeWin),
+	}
+}
+
+// New creates a new, empty window.
+func (fa *FakeAcme) New() (Window, error) {
+	return fa.NewWin("", ""), nil
+}
+
+// NewWin creates a new window with the given name and body.
+func (fa *FakeAcme) NewWin(name, body string) *FakeWin {
+	fa.mu.Lock()
+	w := NewFakeWin(fa.nextID, name, body)
+	w.fa = fa
+	fa.windows[w.id] = w
+	fa.nextID++
+	fa.mu.Unlock()
+
+	fa.Emit(w.id, "new")
+	return w
+}
+
+// Open returns a new handle on the existing window with the given id. As with
+// acme.Open the handle has its own event file, so closing its files does not
+// interfere with anyone else reading events from the window.
+func (fa *FakeAcme) Open(id int) (Window, error) {
+	if w := fa.Win(id); w != nil {
+		return &fakeHandle{FakeWin: w}, nil
+	}
+	return nil, fmt.Errorf("%d/ctl: file does not exist", id)
+}
+
+// Win returns the FakeWin with the given id or nil if there is no such window.
+func (fa *FakeAcme) Win(id int) *FakeWin {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+	return fa.windows[id]
+}
+
+// Windows returns the currently open windows ordered by id.
+func (fa *FakeAcme) Windows() ([]WindowInfo, error) {
+	fa.mu.Lock()
+	wins := make([]*FakeWin, 0, len(fa.windows))
+	for _, w := range fa.windows {
+		wins = append(wins, w)
+	}
+	fa.mu.Unlock()
+
+	info := make([]WindowInfo, 0, len(wins))
+	for _, w := range wins {
+		info = append(info, WindowInfo{ID: w.ID(), Name: w.FileName(), Tag: w.Tag(), Dirty: w.Dirty()})
+	}
+	sort.Slice(info, func(i, j int) bool { return info[i].ID < info[j].ID })
+
+	return info, nil
+}
+
+// Log returns a reader for the log events generated from this point onwards.
+func (fa *FakeAcme) Log() (LogReader, error) {
+	l := &fakeLog{}
+	l.cond = sync.NewCond(&l.mu)
+
+	fa.mu.Lock()
+	fa.logs = append(fa.logs, l)
+	fa.mu.Unlock()
+
+	return l, nil
+}
+
+// Emit writes a log event for the given window to all open log readers.
+func (fa *FakeAcme) Emit(id int, op string) {
+	name := ""
+	if w := fa.Win(id); w != nil {
+		name = w.FileName()
+	}
+
+	fa.mu.Lock()
+	logs := fa.logs
+	fa.mu.Unlock()
+
+	for _, l := range logs {
+		l.push(acme.LogEvent{ID: id, Op: op, Name: name})
+	}
+}
+
+// Focus emits a focus log event for the given window.
+func (fa *FakeAcme) Focus(id int) {
+	fa.Emit(id, "focus")
+}
+
+// Close closes all open log readers, mimicking acme exiting.
+func (fa *FakeAcme) Close() {
+	fa.mu.Lock()
+	logs := fa.logs
+	fa.logs = nil
+	fa.mu.Unlock()
+
+	for _, l := range logs {
+		l.Close()
+	}
+}
+
+func (fa *FakeAcme) remove(id int) {
+	fa.Emit(id, "del")
+	fa.mu.Lock()
+	delete(fa.windows, id)
+	fa.mu.Unlock()
+}
+
+// fakeLog is an unbounded queue of log events
+type fakeLog struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []acme.LogEvent
+	closed bool
+}
+
+func (l *fakeLog) push(e acme.LogEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.closed {
+		l.queue = append(l.queue, e)
+		l.cond.Signal()
+	}
+}
+
+func (l *fakeLog) Read() (acme.LogEvent, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for len(l.queue) == 0 && !l.closed {
+		l.cond.Wait()
+	}
+	if len(l.queue) == 0 {
+		return acme.LogEvent{}, io.EOF
+	}
+
+	e := l.queue[0]
+	l.queue = l.queue[1:]
+	return e, nil
+}
+
+func (l *fakeLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	l.cond.Broadcast()
+	return nil
+}
+
+// A FakeWin is an in-memory acme window.
+type FakeWin struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	fa      *FakeAcme
+	id      int
+	name    string
+	tag     []rune
+	body    []rune
+	addr    span
+	dot     span
+	dirty   bool
+	deleted bool
+	offsets map[string]int
+	ctls    []string
+	errors  bytes.Buffer
+	pending []*acme.Event
+	written []*acme.Event
+	reading bool
+	gen     int
+}
+
+var _ Window = (*FakeWin)(nil)
+
+// NewFakeWin creates a standalone FakeWin that is not tracked by a FakeAcme.
+func NewFakeWin(id int, name, body string) *FakeWin {
+	w := &FakeWin{
+		id:      id,
+		name:    name,
+		body:    []rune(body),
+		offsets: make(map[string]int),
+	}
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+// ID returns the window id.
+func (w *FakeWin) ID() int {
+	return w.id
+}
+
+// Name sets the window name.
+func (w *FakeWin) Name(format string, args ...interface{}) error {
+	return w.Ctl("name %s", fmt.Sprintf(format, args...))
+}
+
+// Addr writes format, ... to the window's addr file.
+func (w *FakeWin) Addr(format string, args ...interface{}) error {
+	_, err := w.Write("addr", []byte(fmt.Sprintf(format, args...)))
+	return err
+}
+
+// ReadAddr returns the current value of addr.
+func (w *FakeWin) ReadAddr() (q0, q1 int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.addr.q0, w.addr.q1, nil
+}
+
+// Ctl writes format, ... to the window's ctl file.
+func (w *FakeWin) Ctl(format string, args ...interface{}) error {
+	_, err := w.Write("ctl", []byte(fmt.Sprintf(format, args...)))
+	return err
+}
+
+// Read reads from the named file in the same way that reading the equivalent
+// acme file would.
+func (w *FakeWin) Read(file string, b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.deleted {
+		return 0, w.deletedErr(file)
+	}
+
+	switch file {
+	case "body", "tag", "ctl", "addr":
+		s := w.fileContents(file)
+		off := w.offsets[file]
+		if off >= len(s) {
+			return 0, io.EOF
+		}
+		n := copy(b, s[off:])
+		w.offsets[file] = off + n
+		return n, nil
+
+	case "data", "xdata":
+		w.addr = w.clamp(w.addr)
+		q1 := len(w.body)
+		if file == "xdata" {
+			q1 = w.addr.q1
+		}
+		n, nr := 0, 0
+		for _, r := range w.body[w.addr.q0:q1] {
+			if n+utf8.RuneLen(r) > len(b) {
+				break
+			}
+			n += utf8.EncodeRune(b[n:], r)
+			nr++
+		}
+		if n == 0 {
+			return 0, io.EOF
+		}
+		w.addr.q0 += nr
+		if file == "data" {
+			w.addr.q1 = w.addr.q0
+		}
+		return n, nil
+	}
+
+	return 0, fmt.Errorf("%d/%s: permission denied", w.id, file)
+}
+
+// ReadAll reads the entire contents of the named file.
+func (w *FakeWin) ReadAll(file string) ([]byte, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.deleted {
+		return nil, w.deletedErr(file)
+	}
+
+	switch file {
+	case "body", "tag", "ctl", "addr":
+		return []byte(w.fileContents(file)), nil
+
+	case "data", "xdata":
+		w.addr = w.clamp(w.addr)
+		q1 := len(w.body)
+		if file == "xdata" {
+			q1 = w.addr.q1
+		}
+		b := []byte(string(w.body[w.addr.q0:q1]))
+		w.addr.q0 = q1
+		if file == "data" {
+			w.addr.q1 = w.addr.q0
+		}
+		return b, nil
+	}
+
+	return nil, fmt.Errorf("%d/%s: permission denied", w.id, file)
+}
+
+// Write writes b to the named file in the same way that writing to the
+// equivalent acme file would.
+func (w *FakeWin) Write(file string, b []byte) (int, error) {
+	w.mu.Lock()
+
+	if w.deleted {
+		w.mu.Unlock()
+		return 0, w.deletedErr(file)
+	}
+
+	var err error
+	var logOp, errs string
+
+	switch file {
+	case "addr":
+		w.addr, err = evalAddr(w.body, w.addr, string(b))
+
+	case "body":
+		q := len(w.body)
+		w.insert(q, []rune(string(b)), 'E')
+
+	case "data", "xdata":
+		r := []rune(string(b))
+		w.addr = w.clamp(w.addr)
+		q0 := w.addr.q0
+		w.delete(q0, w.addr.q1, 'F')
+		w.insert(q0, r, 'F')
+		w.addr = span{q0 + len(r), q0 + len(r)}
+
+	case "tag":
+		r := []rune(string(b))
+		w.event('E', 'i', len(w.fullTag()), r)
+		w.tag = append(w.tag, r...)
+
+	case "ctl":
+		for _, line := range strings.Split(string(b), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				var op string
+				if op, err = w.ctl(line); err != nil {
+					break
+				}
+				if op != "" {
+					logOp = op
+				}
+			}
+		}
+
+	case "errors":
+		w.errors.Write(b)
+
+	case "event":
+		e := &acme.Event{}
+		if _, err = fmt.Sscanf(string(b), "%c%c%d %d", &e.C1, &e.C2, &e.Q0, &e.Q1); err == nil {
+			e.OrigQ0, e.OrigQ1 = e.Q0, e.Q1
+			w.written = append(w.written, e)
+			logOp, errs = w.execute(e)
+		}
+
+	default:
+		err = fmt.Errorf("%d/%s: permission denied", w.id, file)
+	}
+
+	w.mu.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+	if logOp != "" {
+		w.log(logOp)
+	}
+	if errs != "" {
+		w.reportErrors(errs)
+	}
+	return len(b), nil
+}
+
+// ReadEvent blocks until the next event is available. As with acme, an error
+// is returned once the window has been deleted or if the event file is closed
+// while waiting.
+func (w *FakeWin) ReadEvent() (*acme.Event, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.reading = true
+	gen := w.gen
+	for len(w.pending) == 0 && !w.deleted && w.gen == gen {
+		w.cond.Wait()
+	}
+	if w.gen != gen || len(w.pending) == 0 {
+		return nil, w.deletedErr("event")
+	}
+
+	e := w.pending[0]
+	w.pending = w.pending[1:]
+	return e, nil
+}
+
+// WriteEvent writes an event back to the window's event file, indicating to
+// acme that the event should be handled internally.
+func (w *FakeWin) WriteEvent(e *acme.Event) error {
+	_, err := w.Write("event", []byte(fmt.Sprintf("%c%c%d %d \n", e.C1, e.C2, e.Q0, e.Q1)))
+	return err
+}
+
+// Clear clears the window body.
+func (w *FakeWin) Clear() {
+	w.Addr(",")
+	w.Write("data", nil)
+}
+
+// Del deletes the window, refusing to do so if it is dirty unless sure is true.
+func (w *FakeWin) Del(sure bool) error {
+	if sure {
+		return w.Ctl("delete")
+	}
+	return w.Ctl("del")
+}
+
+// CloseFiles releases the event file: any undelivered events are discarded
+// and a blocked ReadEvent returns an error.
+func (w *FakeWin) CloseFiles() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.reading {
+		w.reading = false
+		w.pending = nil
+		w.gen++
+		w.cond.Broadcast()
+	}
+}
+
+// Body returns the current contents of the window body.
+func (w *FakeWin) Body() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return string(w.body)
+}
+
+// Tag returns the current contents of the window tag.
+func (w *FakeWin) Tag() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return string(w.fullTag())
+}
+
+// FileName returns the current window name.
+func (w *FakeWin) FileName() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.name
+}
+
+// Dot returns the current selection in the window body.
+func (w *FakeWin) Dot() (q0, q1 int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.dot.q0, w.dot.q1
+}
+
+// Select sets the current selection in the window body.
+func (w *FakeWin) Select(q0, q1 int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.dot = w.clamp(span{q0, q1})
+}
+
+// Dirty reports whether the window has unsaved changes.
+func (w *FakeWin) Dirty() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.dirty
+}
+
+// Deleted reports whether the window has been deleted.
+func (w *FakeWin) Deleted() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.deleted
+}
+
+// CtlLog returns every ctl message that has been written to the window.
+func (w *FakeWin) CtlLog() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string{}, w.ctls...)
+}
+
+// Written returns every event that has been written back to the window.
+func (w *FakeWin) Written() []*acme.Event {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]*acme.Event{}, w.written...)
+}
+
+// Errors returns everything that has been written to the window's errors file.
+func (w *FakeWin) Errors() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.errors.String()
+}
+
+// Send queues e for delivery on the event channel as is.
+func (w *FakeWin) Send(e *acme.Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.send(e)
+}
+
+// Type mimics the user typing s into the body at dot, replacing the current
+// selection if there is one. A KI event is generated for each rune typed.
+func (w *FakeWin) Type(s string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, r := range s {
+		w.delete(w.dot.q0, w.dot.q1, 'K')
+		w.insert(w.dot.q0, []rune{r}, 'K')
+		w.dot = span{w.dot.q0 + 1, w.dot.q0 + 1}
+	}
+}
+
+// Backspace mimics the user deleting the rune before dot (or the selection if
+// it is non-empty).
+func (w *FakeWin) Backspace() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	q0, q1 := w.dot.q0, w.dot.q1
+	if q0 == q1 {
+		if q0 == 0 {
+			return
+		}
+		q0--
+	}
+	w.delete(q0, q1, 'K')
+	w.dot = span{q0, q0}
+}
+
+// MouseBody mimics a button 2 ('X') or button 3 ('L') click on the body
+// between q0 and q1. Null selections are expanded to the surrounding word.
+func (w *FakeWin) MouseBody(c2 rune, q0, q1 int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.mouse(c2, w.body, w.clamp(span{q0, q1}))
+}
+
+// MouseTag mimics a button 2 ('x') or button 3 ('l') click on the first
+// occurrence of text in the tag.
+func (w *FakeWin) MouseTag(c2 rune, text string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	tag := w.fullTag()
+	ix := strings.Index(string(tag), text)
+	if ix < 0 {
+		return fmt.Errorf("'%s' not found in tag", text)
+	}
+	q0 := utf8.RuneCountInString(string(tag)[:ix])
+	w.mouse(c2, tag, span{q0, q0 + utf8.RuneCountInString(text)})
+	return nil
+}
+
+func (w *FakeWin) mouse(c2 rune, text []rune, s span) {
+	e := &acme.Event{C1: 'M', C2: c2, Q0: s.q0, Q1: s.q1, OrigQ0: s.q0, OrigQ1: s.q1}
+
+	if s.q0 == s.q1 {
+		for s.q0 > 0 && !unicode.IsSpace(text[s.q0-1]) {
+			s.q0--
+		}
+		for s.q1 < len(text) && !unicode.IsSpace(text[s.q1]) {
+			s.q1++
+		}
+		e.Q0, e.Q1 = s.q0, s.q1
+		e.Flag |= 2
+	}
+
+	setEventText(e, text[s.q0:s.q1])
+	w.send(e)
+}
+
+// The following helpers all expect w.mu to be held.
+
+func (w *FakeWin) deletedErr(file string) error {
+	return fmt.Errorf("%d/%s: file does not exist", w.id, file)
+}
+
+func (w *FakeWin) send(e *acme.Event) {
+	if w.deleted {
+		return
+	}
+	w.pending = append(w.pending, e)
+	w.cond.Broadcast()
+}
+
+// event generates an event if a client is reading from the event file.
+func (w *FakeWin) event(c1, c2 rune, q0 int, text []rune) {
+	if !w.reading {
+		return
+	}
+	e := &acme.Event{C1: c1, C2: c2, Q0: q0, Q1: q0 + len(text), OrigQ0: q0, OrigQ1: q0 + len(text)}
+	if unicode.IsUpper(c2) || c2 == 'i' {
+		setEventText(e, text)
+	}
+	w.send(e)
+}
+
+func setEventText(e *acme.Event, text []rune) {
+	if len(text) > eventSize {
+		return
+	}
+	e.Text = []byte(string(text))
+	e.Nr = len(text)
+	e.Nb = len(e.Text)
+}
+
+func (w *FakeWin) insert(q int, r []rune, c1 rune) {
+	if len(r) == 0 {
+		return
+	}
+
+	body := make([]rune, 0, len(w.body)+len(r))
+	body = append(body, w.body[:q]...)
+	body = append(body, r...)
+	w.body = append(body, w.body[q:]...)
+	w.dirty = true
+
+	if q < w.dot.q0 {
+		w.dot.q0 += len(r)
+	}
+	if q < w.dot.q1 {
+		w.dot.q1 += len(r)
+	}
+
+	w.event(c1, 'I', q, r)
+}
+
+func (w *FakeWin) delete(q0, q1 int, c1 rune) {
+	if q0 >= q1 {
+		return
+	}
+
+	w.body = append(w.body[:q0:q0], w.body[q1:]...)
+	w.dirty = true
+	w.dot = span{shiftDeleted(w.dot.q0, q0, q1), shiftDeleted(w.dot.q1, q0, q1)}
+
+	if w.reading {
+		w.send(&acme.Event{C1: c1, C2: 'D', Q0: q0, Q1: q1, OrigQ0: q0, OrigQ1: q1})
+	}
+}
+
+func shiftDeleted(q, q0, q1 int) int {
+	switch {
+	case q >= q1:
+		return q - (q1 - q0)
+	case q > q0:
+		return q0
+	default:
+		return q
+	}
+}
+
+func (w *FakeWin) clamp(s span) span {
+	if s.q1 > len(w.body) {
+		s.q1 = len(w.body)
+	}
+	if s.q0 > s.q1 {
+		s.q0 = s.q1
+	}
+	return s
+}
+
+func (w *FakeWin) fullTag() []rune {
+	return []rune(fmt.Sprintf("%s %s%s", w.name, fakeTagCommands, string(w.tag)))
+}
+
+func (w *FakeWin) fileContents(file string) string {
+	switch file {
+	case "body":
+		return string(w.body)
+	case "tag":
+		return string(w.fullTag())
+	case "addr":
+		return fmt.Sprintf("%11d %11d ", w.addr.q0, w.addr.q1)
+	default:
+		dirty := 0
+		if w.dirty {
+			dirty = 1
+		}
+		return fmt.Sprintf(
+			"%11d %11d %11d %11d %11d %11d %s %11d ",
+			w.id, len(w.fullTag()), len(w.body), 0, dirty, 800, "fake", 4,
+		)
+	}
+}
+
+// ctl applies a single ctl message, returning the log operation it implies.
+func (w *FakeWin) ctl(msg string) (string, error) {
+	w.ctls = append(w.ctls, msg)
+	cmd, arg := msg, ""
+	if i := strings.IndexAny(msg, " \t"); i >= 0 {
+		cmd, arg = msg[:i], strings.TrimSpace(msg[i+1:])
+	}
+
+	switch cmd {
+	case "addr=dot":
+		w.addr = w.dot
+	case "dot=addr":
+		w.dot = w.addr
+	case "clean":
+		w.dirty = false
+	case "dirty":
+		w.dirty = true
+	case "cleartag":
+		w.tag = nil
+	case "name":
+		w.name = arg
+	case "get":
+		w.dirty = false
+		return "get", nil
+	case "put":
+		w.dirty = false
+		return "put", nil
+	case "del", "delete":
+		if cmd == "del" && w.dirty {
+			return "", fmt.Errorf("%s modified", w.name)
+		}
+		w.deleted = true
+		w.cond.Broadcast()
+		return "del", nil
+	case "show", "mark", "nomark", "menu", "nomenu", "scroll", "noscroll",
+		"limit=addr", "font", "dump", "dumpdir":
+		// accepted but have no effect on a fake window
+	default:
+		return "", fmt.Errorf("%d/ctl: bad control message '%s'", w.id, msg)
+	}
+
+	return "", nil
+}
+
+// execute emulates acme handling a subset of builtin commands when mouse
+// events are written back to the event file, returning the log operation
+// implied and any output destined for +Errors.
+func (w *FakeWin) execute(e *acme.Event) (string, string) {
+	if e.C1 != 'M' || (e.C2 != 'x' && e.C2 != 'X') {
+		return "", ""
+	}
+
+	text := w.body
+	if e.C2 == 'x' {
+		text = w.fullTag()
+	}
+	if e.Q0 > e.Q1 || e.Q1 > len(text) {
+		return "", ""
+	}
+
+	cmd := strings.TrimSpace(string(text[e.Q0:e.Q1]))
+	switch {
+	case cmd == "Del":
+		op, _ := w.ctl("del")
+		return op, ""
+	case cmd == "Delete":
+		op, _ := w.ctl("delete")
+		return op, ""
+	case strings.HasPrefix(cmd, "Edit "):
+		return "", w.edit(strings.TrimPrefix(cmd, "Edit "))
+	}
+	return "", ""
+}
+
+func (w *FakeWin) log(op string) {
+	if w.fa == nil {
+		return
+	}
+	if op == "del" {
+		w.fa.remove(w.id)
+		return
+	}
+	w.fa.Emit(w.id, op)
+}
+
+// reportErrors writes s to the +Errors window for w (creating it if needed) in
+// the same way that acme reports the output of commands. Standalone windows
+// record s in their errors file instead.
+func (w *FakeWin) reportErrors(s string) {
+	if w.fa == nil {
+		w.mu.Lock()
+		w.errors.WriteString(s)
+		w.mu.Unlock()
+		return
+	}
+
+	name := errorsWindowName(w.FileName())
+	var ew *FakeWin
+	if info, _ := w.fa.Windows(); info != nil {
+		for _, i := range info {
+			if i.Name == name {
+				ew = w.fa.Win(i.ID)
+				break
+			}
+		}
+	}
+	if ew == nil {
+		ew = w.fa.NewWin(name, "")
+	}
+	ew.Write("body", []byte(s))
+	ew.Ctl("clean")
+}
+
+// A fakeHandle is a window returned by FakeAcme.Open. It shares the state of
+// the underlying FakeWin but only releases the event file on CloseFiles if it
+// was the handle reading events.
+type fakeHandle struct {
+	*FakeWin
+	hmu     sync.Mutex
+	reading bool
+}
+
+func (h *fakeHandle) ReadEvent() (*acme.Event, error) {
+	h.hmu.Lock()
+	h.reading = true
+	h.hmu.Unlock()
+	return h.FakeWin.ReadEvent()
+}
+
+func (h *fakeHandle) CloseFiles() {
+	h.hmu.Lock()
+	reading := h.reading
+	h.reading = false
+	h.hmu.Unlock()
+
+	if reading {
+		h.FakeWin.CloseFiles()
+	}
+}
@@ -0,0 +1,170 @@
+package acorp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFakeWinReadAddr(t *testing.T) {
+	tests := []struct {
+		addr    string
+		file    string
+		want    string
+		q0After int
+		q1After int
+	}{
+		{"2", "xdata", "two\n", 8, 8},
+		{"2", "data", "two\nthree\n", 14, 14},
+		{"#1,#3", "xdata", "ne", 3, 3},
+		{"$", "xdata", "", 14, 14},
+		{"/thr/", "data", "three\n", 14, 14},
+	}
+
+	for _, tc := range tests {
+		w := NewFakeWin(1, "f", editText)
+		if err := w.Addr("%s", tc.addr); err != nil {
+			t.Fatalf("Addr(%q): %s", tc.addr, err)
+		}
+
+		b, err := w.ReadAll(tc.file)
+		if err != nil || string(b) != tc.want {
+			t.Errorf("%s then ReadAll(%s) = %q, %v; want %q", tc.addr, tc.file, b, err, tc.want)
+		}
+		if q0, q1, _ := w.ReadAddr(); q0 != tc.q0After || q1 != tc.q1After {
+			t.Errorf("%s then ReadAll(%s) left addr at %d,%d; want %d,%d",
+				tc.addr, tc.file, q0, q1, tc.q0After, tc.q1After)
+		}
+	}
+}
+
+func TestFakeWinChunkedRead(t *testing.T) {
+	w := NewFakeWin(1, "f", "aé€b\n")
+	w.Addr(",")
+
+	var chunks []string
+	b := make([]byte, 3)
+	for {
+		n, err := w.Read("xdata", b)
+		if err != nil {
+			break
+		}
+		chunks = append(chunks, string(b[:n]))
+	}
+
+	// Runes are never split across reads
+	if got := strings.Join(chunks, "|"); got != "aé|€|b\n" {
+		t.Errorf("chunks = %q", got)
+	}
+}
+
+func TestFakeWinWrite(t *testing.T) {
+	tests := []struct {
+		addr string
+		file string
+		text string
+		want string
+		q0   int
+		q1   int
+	}{
+		{"2", "data", "TWO\n", "one\nTWO\nthree\n", 8, 8},
+		{"2", "xdata", "2\n", "one\n2\nthree\n", 6, 6},
+		{"#3", "data", "!", "one!\ntwo\nthree\n", 4, 4},
+		{",", "data", "", "", 0, 0},
+		{"1", "body", "four\n", editText + "four\n", 0, 4},
+	}
+
+	for _, tc := range tests {
+		w := NewFakeWin(1, "f", editText)
+		w.Addr("%s", tc.addr)
+		if _, err := w.Write(tc.file, []byte(tc.text)); err != nil {
+			t.Fatalf("Write(%s): %s", tc.file, err)
+		}
+
+		if body := w.Body(); body != tc.want {
+			t.Errorf("%s then Write(%s, %q): body = %q; want %q", tc.addr, tc.file, tc.text, body, tc.want)
+		}
+		if q0, q1, _ := w.ReadAddr(); q0 != tc.q0 || q1 != tc.q1 {
+			t.Errorf("%s then Write(%s, %q): addr = %d,%d; want %d,%d",
+				tc.addr, tc.file, tc.text, q0, q1, tc.q0, tc.q1)
+		}
+		if !w.Dirty() {
+			t.Errorf("%s then Write(%s, %q) left the window clean", tc.addr, tc.file, tc.text)
+		}
+	}
+}
+
+func TestFakeWinAddrDot(t *testing.T) {
+	w := NewFakeWin(1, "f", editText)
+	w.Select(1, 3)
+
+	if err := w.Ctl("addr=dot"); err != nil {
+		t.Fatal(err)
+	}
+	if q0, q1, _ := w.ReadAddr(); q0 != 1 || q1 != 3 {
+		t.Errorf("addr=dot: addr = %d,%d; want 1,3", q0, q1)
+	}
+
+	w.Addr("3")
+	if err := w.Ctl("dot=addr"); err != nil {
+		t.Fatal(err)
+	}
+	if q0, q1 := w.Dot(); q0 != 8 || q1 != 14 {
+		t.Errorf("dot=addr: dot = %d,%d; want 8,14", q0, q1)
+	}
+
+	// Edits before dot move it along with the text
+	w.Addr("1")
+	w.Write("data", nil)
+	if q0, q1 := w.Dot(); q0 != 4 || q1 != 10 {
+		t.Errorf("after deleting line 1: dot = %d,%d; want 4,10", q0, q1)
+	}
+}
+
+func TestFakeWinBadAddr(t *testing.T) {
+	w := NewFakeWin(1, "f", editText)
+	w.Addr("2")
+
+	if err := w.Addr("/nope/"); err == nil {
+		t.Errorf("expected an error for an address with no match")
+	}
+	if q0, q1, _ := w.ReadAddr(); q0 != 4 || q1 != 8 {
+		t.Errorf("addr = %d,%d after a bad address; want 4,8", q0, q1)
+	}
+}
+
+func TestFakeWinFiles(t *testing.T) {
+	w := NewFakeWin(7, "/src/f.go", editText)
+	w.Addr("2")
+
+	if b, _ := w.ReadAll("addr"); string(b) != "          4           8 " {
+		t.Errorf("addr = %q", b)
+	}
+	if b, _ := w.ReadAll("tag"); !strings.HasPrefix(string(b), "/src/f.go Del Snarf |") {
+		t.Errorf("tag = %q", b)
+	}
+
+	fields := func() []string {
+		b, _ := w.ReadAll("ctl")
+		return strings.Fields(string(b))
+	}
+	if f := fields(); f[0] != "7" || f[2] != "14" || f[4] != "0" {
+		t.Errorf("ctl = %q", f)
+	}
+	w.Write("body", []byte("x"))
+	if f := fields(); f[2] != "15" || f[4] != "1" {
+		t.Errorf("ctl after write = %q", f)
+	}
+
+	if _, err := w.Write("nope", nil); err == nil {
+		t.Errorf("expected an error writing to an unknown file")
+	}
+	if err := w.Ctl("nope"); err == nil {
+		t.Errorf("expected an error for an unknown ctl message")
+	}
+	if err := w.Del(false); err == nil || w.Deleted() {
+		t.Errorf("del of a dirty window should fail")
+	}
+	if err := w.Del(true); err != nil || !w.Deleted() {
+		t.Errorf("delete should always succeed: %v", err)
+	}
+}
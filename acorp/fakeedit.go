@@ -0,0 +1,447 @@
+package acorp
+
+// A small interpreter for acme's Edit command language. Edit (see sam.go) uses
+// it to run commands against a window through its addr, xdata and data files
+// and FakeWin uses it to respond to 'Edit ...' being executed in the same way
+// that acme does. Only the commands that our sam builder can produce are
+// supported: x, g, v, s, a, c, i, d, p, =, |, <, > and {} blocks. As in sam,
+// all changes are computed against the original text and then applied in one
+// go.
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+type samCmd struct {
+	addr   string
+	name   rune
+	re     string
+	text   string
+	global bool
+	sub    *samCmd
+	block  []*samCmd
+}
+
+type samParser struct {
+	s []rune
+	q int
+}
+
+// parseSam parses a newline separated list of sam commands.
+func parseSam(s string) ([]*samCmd, error) {
+	p := &samParser{s: []rune(s)}
+	return p.cmds(false)
+}
+
+func (p *samParser) cmds(inBlock bool) ([]*samCmd, error) {
+	var cmds []*samCmd
+
+	for {
+		p.skip(" \t\n")
+		if p.q >= len(p.s) {
+			if inBlock {
+				return nil, fmt.Errorf("missing '}'")
+			}
+			return cmds, nil
+		}
+		if p.s[p.q] == '}' {
+			if !inBlock {
+				return nil, fmt.Errorf("unexpected '}'")
+			}
+			p.q++
+			return cmds, nil
+		}
+
+		c, err := p.cmd()
+		if err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, c)
+	}
+}
+
+func (p *samParser) cmd() (*samCmd, error) {
+	var err error
+
+	p.skip(" \t")
+	start := p.q
+	p.skipAddr()
+	c := &samCmd{addr: string(p.s[start:p.q])}
+
+	p.skip(" \t")
+	if p.q >= len(p.s) || p.s[p.q] == '\n' || p.s[p.q] == '}' {
+		// a bare address sets dot
+		c.name = 'k'
+		return c, nil
+	}
+
+	c.name = p.s[p.q]
+	p.q++
+
+	switch c.name {
+	case 'x', 'g', 'v':
+		if c.re, err = p.delimited(); err != nil {
+			return nil, err
+		}
+		p.skip(" \t")
+		if p.q >= len(p.s) || p.s[p.q] == '\n' || p.s[p.q] == '}' {
+			c.sub = &samCmd{name: 'p'}
+		} else if c.sub, err = p.cmd(); err != nil {
+			return nil, err
+		}
+		return c, nil
+
+	case 's':
+		if c.re, err = p.delimited(); err != nil {
+			return nil, err
+		}
+		p.q-- // the closing delimiter of the regexp opens the replacement
+		if c.text, err = p.delimited(); err != nil {
+			return nil, err
+		}
+		if p.q < len(p.s) && p.s[p.q] == 'g' {
+			c.global = true
+			p.q++
+		}
+
+	case 'a', 'c', 'i':
+		var raw string
+		if raw, err = p.delimited(); err != nil {
+			return nil, err
+		}
+		c.text = unescapeText(raw)
+
+	case 'd', 'p', '=':
+
+	case '|', '<', '>':
+		start := p.q
+		for p.q < len(p.s) && p.s[p.q] != '\n' {
+			p.q++
+		}
+		c.text = strings.TrimSpace(string(p.s[start:p.q]))
+
+	case '{':
+		if c.block, err = p.cmds(true); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown command %c", c.name)
+	}
+
+	return c, nil
+}
+
+func (p *samParser) skip(chars string) {
+	for p.q < len(p.s) && strings.ContainsRune(chars, p.s[p.q]) {
+		p.q++
+	}
+}
+
+// skipAddr moves past an address without evaluating it.
+func (p *samParser) skipAddr() {
+	for p.q < len(p.s) {
+		c := p.s[p.q]
+		switch {
+		case c == '/' || c == '?':
+			p.q++
+			for p.q < len(p.s) && p.s[p.q] != c && p.s[p.q] != '\n' {
+				if p.s[p.q] == '\\' {
+					p.q++
+				}
+				p.q++
+			}
+			p.q++
+		case strings.ContainsRune("0123456789#.$+-,;", c):
+			p.q++
+		default:
+			return
+		}
+	}
+}
+
+// delimited reads text up to a matching delimiter, the delimiter being the
+// next character. Escaped delimiters are unescaped, other escapes are kept.
+func (p *samParser) delimited() (string, error) {
+	if p.q >= len(p.s) {
+		return "", fmt.Errorf("missing delimiter")
+	}
+	delim := p.s[p.q]
+	p.q++
+
+	var b strings.Builder
+	for p.q < len(p.s) {
+		c := p.s[p.q]
+		p.q++
+		switch c {
+		case delim:
+			return b.String(), nil
+		case '\n':
+			p.q--
+			return b.String(), nil
+		case '\\':
+			if p.q < len(p.s) && p.s[p.q] == delim {
+				c = delim
+				p.q++
+			} else if p.q < len(p.s) {
+				b.WriteRune(c)
+				c = p.s[p.q]
+				p.q++
+			}
+		}
+		b.WriteRune(c)
+	}
+
+	return b.String(), nil
+}
+
+func unescapeText(s string) string {
+	var b strings.Builder
+	r := []rune(s)
+	for i := 0; i < len(r); i++ {
+		if r[i] == '\\' && i+1 < len(r) {
+			i++
+			if r[i] == 'n' {
+				b.WriteRune('\n')
+				continue
+			}
+		}
+		b.WriteRune(r[i])
+	}
+	return b.String()
+}
+
+type samEdit struct {
+	q0, q1 int
+	text   []rune
+}
+
+type samExec struct {
+	text  []rune
+	name  string
+	edits []samEdit
+	out   strings.Builder
+}
+
+func (ex *samExec) run(c *samCmd, dot span) error {
+	var err error
+
+	if c.addr != "" {
+		if dot, err = evalAddr(ex.text, dot, c.addr); err != nil {
+			return err
+		}
+	}
+
+	switch c.name {
+	case 'k':
+
+	case 'x', 'g', 'v':
+		re, err := regexp.Compile("(?m)" + c.re)
+		if err != nil {
+			return fmt.Errorf("bad regexp: %s", err)
+		}
+		matches := ex.matches(re, dot)
+		switch {
+		case c.name == 'x':
+			for _, m := range matches {
+				if err = ex.run(c.sub, m); err != nil {
+					return err
+				}
+			}
+		case (c.name == 'g') == (len(matches) > 0):
+			return ex.run(c.sub, dot)
+		}
+
+	case 's':
+		re, err := regexp.Compile("(?m)" + c.re)
+		if err != nil {
+			return fmt.Errorf("bad regexp: %s", err)
+		}
+		matches := ex.matches(re, dot)
+		if len(matches) == 0 {
+			return fmt.Errorf("no substitution")
+		}
+		for _, m := range matches {
+			ex.edits = append(ex.edits, samEdit{m.q0, m.q1, []rune(ex.substitute(re, m, c.text))})
+			if !c.global {
+				break
+			}
+		}
+
+	case 'a':
+		ex.edits = append(ex.edits, samEdit{dot.q1, dot.q1, []rune(c.text)})
+	case 'i':
+		ex.edits = append(ex.edits, samEdit{dot.q0, dot.q0, []rune(c.text)})
+	case 'c':
+		ex.edits = append(ex.edits, samEdit{dot.q0, dot.q1, []rune(c.text)})
+	case 'd':
+		ex.edits = append(ex.edits, samEdit{dot.q0, dot.q1, nil})
+
+	case 'p':
+		ex.out.WriteString(string(ex.text[dot.q0:dot.q1]))
+
+	case '=':
+		l0 := strings.Count(string(ex.text[:dot.q0]), "\n") + 1
+		l1 := l0 + strings.Count(string(ex.text[dot.q0:dot.q1]), "\n")
+		if dot.q1 > dot.q0 && ex.text[dot.q1-1] == '\n' {
+			l1--
+		}
+		if l1 > l0 {
+			fmt.Fprintf(&ex.out, "%s:%d,%d\n", ex.name, l0, l1)
+		} else {
+			fmt.Fprintf(&ex.out, "%s:%d\n", ex.name, l0)
+		}
+
+	case '|', '<', '>':
+		cmd := exec.Command("sh", "-c", c.text)
+		if dir := path.Dir(ex.name); strings.HasPrefix(dir, "/") {
+			cmd.Dir = dir
+		}
+		if c.name != '<' {
+			cmd.Stdin = strings.NewReader(string(ex.text[dot.q0:dot.q1]))
+		}
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		ex.out.Write(stderr.Bytes())
+		if c.name == '>' {
+			ex.out.Write(out)
+		} else if err == nil {
+			ex.edits = append(ex.edits, samEdit{dot.q0, dot.q1, []rune(string(out))})
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", c.text, err)
+		}
+
+	case '{':
+		for _, sub := range c.block {
+			if err = ex.run(sub, dot); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// matches returns the matches of re within dot in the same way as
+// regexp.FindAllStringIndex would, but searching from dot.q0 with the text
+// before it as context: matches that start inside dot aren't lost to one that
+// starts before it, and ^ still only matches at the start of a line.
+func (ex *samExec) matches(re *regexp.Regexp, dot span) []span {
+	// Each search starts on the rune before the search position (the newline
+	// we add for the start of the text), which the prefix consumes along with
+	// anything that doesn't match, leaving the match itself in group 1.
+	from := regexp.MustCompile(`\A(?s:.)(?s:.*?)(` + re.String() + `)`)
+	s := "\n" + string(ex.text[:dot.q1])
+
+	var matches []span
+	q, b := dot.q0, 1+len(string(ex.text[:dot.q0]))
+	for prevEnd := -1; q <= dot.q1; {
+		_, w := utf8.DecodeLastRuneInString(s[:b])
+		m := from.FindStringSubmatchIndex(s[b-w:])
+		if m == nil {
+			break
+		}
+		b0, b1 := b-w+m[2], b-w+m[3]
+		q0 := q + utf8.RuneCountInString(s[b:b0])
+		q1 := q0 + utf8.RuneCountInString(s[b0:b1])
+
+		// As with FindAll, an empty match next to the previous one is skipped
+		// and we move on a rune after an empty match.
+		accept := true
+		if q1 == q {
+			accept = q0 != prevEnd
+			_, w = utf8.DecodeRuneInString(s[b:])
+			q, b = q+1, b+w
+		} else {
+			q, b = q1, b1
+		}
+		prevEnd = q1
+
+		if accept {
+			matches = append(matches, span{q0, q1})
+		}
+	}
+	return matches
+}
+
+func (ex *samExec) substitute(re *regexp.Regexp, m span, repl string) string {
+	match := string(ex.text[m.q0:m.q1])
+	groups := re.FindStringSubmatch(match)
+
+	var b strings.Builder
+	r := []rune(repl)
+	for i := 0; i < len(r); i++ {
+		switch {
+		case r[i] == '&':
+			b.WriteString(match)
+		case r[i] == '\\' && i+1 < len(r):
+			i++
+			switch {
+			case r[i] >= '1' && r[i] <= '9':
+				if n := int(r[i] - '0'); n < len(groups) {
+					b.WriteString(groups[n])
+				}
+			case r[i] == 'n':
+				b.WriteRune('\n')
+			default:
+				b.WriteRune(r[i])
+			}
+		default:
+			b.WriteRune(r[i])
+		}
+	}
+	return b.String()
+}
+
+// runSam runs cmd against text, the body of the window name, with dot set.
+// The changes it makes are returned ordered by position along with any output
+// from commands such as p and =. Output produced before an error is returned
+// along with it.
+func runSam(cmd, name string, text []rune, dot span) ([]samEdit, string, error) {
+	cmds, err := parseSam(cmd)
+	if err != nil {
+		return nil, "", err
+	}
+
+	ex := &samExec{text: text, name: name}
+	for _, c := range cmds {
+		if err = ex.run(c, dot); err != nil {
+			return nil, ex.out.String(), err
+		}
+	}
+
+	sort.SliceStable(ex.edits, func(i, j int) bool { return ex.edits[i].q0 < ex.edits[j].q0 })
+	for i := 1; i < len(ex.edits); i++ {
+		if ex.edits[i].q0 < ex.edits[i-1].q1 {
+			return nil, ex.out.String(), fmt.Errorf("changes not in sequence")
+		}
+	}
+
+	return ex.edits, ex.out.String(), nil
+}
+
+// edit runs cmd against the body of w, returning anything that acme would have
+// written to the +Errors window. Expects w.mu to be held.
+func (w *FakeWin) edit(cmd string) string {
+	edits, out, err := runSam(cmd, w.name, w.body, w.dot)
+	if err != nil {
+		return out + fmt.Sprintf("Edit: %s\n", err)
+	}
+
+	for i := len(edits) - 1; i >= 0; i-- {
+		e := edits[i]
+		w.delete(e.q0, e.q1, 'M')
+		w.insert(e.q0, e.text, 'M')
+	}
+
+	return out
+}
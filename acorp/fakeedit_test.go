@@ -0,0 +1,211 @@
+package acorp
+
+import (
+	"strings"
+	"testing"
+)
+
+const editText = "one\ntwo\nthree\n"
+
+func TestEdit(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		body string
+		out  string
+	}{
+		{",x/o/c/0/", "0ne\ntw0\nthree\n", ""},
+		{",x/^t/c/T/", "one\nTwo\nThree\n", ""},
+		{",x/e$/p", editText, "ee"},
+		{",x/o/=", editText, "/src/f.go:1\n/src/f.go:2\n"},
+		{",=", editText, "/src/f.go:1,3\n"},
+		{"2=", editText, "/src/f.go:2\n"},
+		{"#5=", editText, "/src/f.go:2\n"},
+		{"2c/TWO\\n/", "one\nTWO\nthree\n", ""},
+		{"2c/a\\/b\\n/", "one\na/b\nthree\n", ""},
+		{"2d", "one\nthree\n", ""},
+		{"$a/four\\n/", editText + "four\n", ""},
+		{"1i/zero\\n/", "zero\n" + editText, ""},
+		{",s/o/0/", "0ne\ntwo\nthree\n", ""},
+		{",s/o/0/g", "0ne\ntw0\nthree\n", ""},
+		{",s/(t)(w)/\\2\\1&/", "one\nwttwo\nthree\n", ""},
+		{",g/two/2d", "one\nthree\n", ""},
+		{",v/two/2d", editText, ""},
+		{"{\n1d\n3d\n}", "two\n", ""},
+		{",x/t/{\ni/[/\na/]/\n}", "one\n[t]wo\n[t]hree\n", ""},
+	}
+
+	for _, tc := range tests {
+		w := NewFakeWin(1, "/src/f.go", editText)
+		out, err := Edit(w, tc.cmd)
+		if err != nil {
+			t.Errorf("Edit(%q) returned error: %s", tc.cmd, err)
+			continue
+		}
+		if body := w.Body(); body != tc.body {
+			t.Errorf("Edit(%q) body = %q; want %q", tc.cmd, body, tc.body)
+		}
+		if out != tc.out {
+			t.Errorf("Edit(%q) output = %q; want %q", tc.cmd, out, tc.out)
+		}
+	}
+}
+
+func TestEditMatchesInDot(t *testing.T) {
+	tests := []struct {
+		text   string
+		q0, q1 int // dot
+		cmd    string
+		body   string
+	}{
+		{"aaa", 1, 3, "x/aa/c/X/", "aX"},
+		{"aaa", 0, 3, "x/aa/c/X/", "Xa"},
+		{"aaaa", 1, 4, "x/a/c/b/", "abbb"},
+		{editText, 5, 14, "x/^t/c/T/", "one\ntwo\nThree\n"},
+		{editText, 4, 14, "x/^t/c/T/", "one\nTwo\nThree\n"},
+		{editText, 5, 13, "x/$/c/!/", "one\ntwo!\nthree!\n"},
+		{"héé\nées", 2, 6, "x/é+/c/E/", "héE\nEes"},
+		{"abc", 1, 1, "x/b*/c/-/", "a-bc"},
+	}
+
+	for _, tc := range tests {
+		w := NewFakeWin(1, "/src/f", tc.text)
+		w.Select(tc.q0, tc.q1)
+		if _, err := Edit(w, tc.cmd); err != nil {
+			t.Errorf("Edit(%q) returned error: %s", tc.cmd, err)
+			continue
+		}
+		if body := w.Body(); body != tc.body {
+			t.Errorf("Edit(%q) on %q with dot #%d,#%d: body = %q; want %q",
+				tc.cmd, tc.text, tc.q0, tc.q1, body, tc.body)
+		}
+	}
+}
+
+func TestEditPipes(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		cmd  string
+		body string
+		out  string
+	}{
+		{"2|tr a-z A-Z", "one\nTWO\nthree\n", ""},
+		{"2<echo 2", "one\n2\nthree\n", ""},
+		{"2>cat", editText, "two\n"},
+		{"2>pwd", editText, dir + "\n"},
+		{"2|echo oops >&2; exit 1", editText, "oops\n"},
+	}
+
+	for _, tc := range tests {
+		w := NewFakeWin(1, dir+"/f.go", editText)
+		out, _ := Edit(w, tc.cmd)
+		if body := w.Body(); body != tc.body {
+			t.Errorf("Edit(%q) body = %q; want %q", tc.cmd, body, tc.body)
+		}
+		if out != tc.out {
+			t.Errorf("Edit(%q) output = %q; want %q", tc.cmd, out, tc.out)
+		}
+	}
+}
+
+func TestEditErrors(t *testing.T) {
+	tests := []struct {
+		cmd string
+		msg string
+	}{
+		{"z", "unknown command z"},
+		{"{\n1d", "missing '}'"},
+		{"}", "unexpected '}'"},
+		{"5d", "address out of range"},
+		{",s/zzz/y/", "no substitution"},
+		{",x/(/d", "bad regexp"},
+		{"1,2d\n2d", "changes not in sequence"},
+		{"2p\n9d", "address out of range"},
+	}
+
+	for _, tc := range tests {
+		w := NewFakeWin(1, "/src/f.go", editText)
+		_, err := Edit(w, tc.cmd)
+
+		ee, ok := err.(*EditError)
+		if !ok {
+			t.Errorf("Edit(%q) returned %v; want an *EditError", tc.cmd, err)
+			continue
+		}
+		if ee.Cmd != tc.cmd || !strings.Contains(ee.Msg, tc.msg) {
+			t.Errorf("Edit(%q) returned %q; want %q", tc.cmd, err, tc.msg)
+		}
+		if body := w.Body(); body != editText {
+			t.Errorf("Edit(%q) modified the body on error: %q", tc.cmd, body)
+		}
+	}
+}
+
+func TestEditKeepsAddrAndDot(t *testing.T) {
+	w := NewFakeWin(1, "/src/f.go", editText)
+	w.Select(9, 11) // "hr"
+	if err := w.Addr("3"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Edit(w, "1c/ONE!!\\n/"); err != nil {
+		t.Fatal(err)
+	}
+
+	if q0, q1 := w.Dot(); q0 != 11 || q1 != 13 {
+		t.Errorf("dot = %d,%d; want 11,13", q0, q1)
+	}
+	if q0, q1, _ := w.ReadAddr(); q0 != 10 || q1 != 16 {
+		t.Errorf("addr = %d,%d; want 10,16", q0, q1)
+	}
+}
+
+func TestEditOutputOnError(t *testing.T) {
+	w := NewFakeWin(1, "/src/f.go", editText)
+	out, err := Edit(w, "2p\n9d")
+	if err == nil || out != "two\n" {
+		t.Errorf("Edit returned %q, %v; want the output from before the error", out, err)
+	}
+}
+
+func TestExecuteEdit(t *testing.T) {
+	fa := NewFakeAcme()
+	w := fa.NewWin("/src/f.go", editText)
+	w.Write("tag", []byte(" Edit ,x/o/c/0/ Edit 9d"))
+
+	if err := w.MouseTag('x', "Edit ,x/o/c/0/"); err != nil {
+		t.Fatal(err)
+	}
+	e, err := w.ReadEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteEvent(e); err != nil {
+		t.Fatal(err)
+	}
+	if body := w.Body(); body != "0ne\ntw0\nthree\n" {
+		t.Errorf("body = %q", body)
+	}
+
+	if err := w.MouseTag('x', "Edit 9d"); err != nil {
+		t.Fatal(err)
+	}
+	for KindOf(e) != "Mx" || string(e.Text) != "Edit 9d" {
+		if e, err = w.ReadEvent(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.WriteEvent(e); err != nil {
+		t.Fatal(err)
+	}
+
+	var errs *FakeWin
+	info, _ := fa.Windows()
+	for _, i := range info {
+		if i.Name == "/src/+Errors" {
+			errs = fa.Win(i.ID)
+		}
+	}
+	if errs == nil || errs.Body() != "Edit: address out of range\n" {
+		t.Errorf("expected the error in /src/+Errors, got %v", info)
+	}
+}
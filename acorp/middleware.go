@@ -0,0 +1,151 @@
+package acorp
+
+// Middleware sits between the event channel of a window and the Handlers of an
+// EventFilter. Each Middleware is handed the next Handler in the chain and can
+// consume an event (by not calling next), mutate it before calling next, or
+// simply observe it and pass it on. This lets us share behaviour such as Del
+// handling and logging between tools rather than re-implementing it in each
+// of their handlers.
+
+import (
+	"strings"
+	"time"
+
+	"9fans.net/go/acme"
+)
+
+// A Middleware wraps a Handler to produce a new Handler.
+type Middleware = func(next Handler) Handler
+
+// LogEvents logs every event that passes through it using logf (log.Printf
+// for example) before passing it on.
+func LogEvents(logf func(format string, args ...interface{})) Middleware {
+	return func(next Handler) Handler {
+		return func(w Window, e *acme.Event, done func() error) error {
+			logf("%d: %s %d %d flag=%d %q\n", w.ID(), KindOf(e), e.Q0, e.Q1, e.Flag, e.Text)
+			return next(w, e, done)
+		}
+	}
+}
+
+// HandleDel deletes the window and completes the filter when Del or Delete are
+// executed in the tag. If the window refuses to be deleted (because it is dirty)
+// the event is passed to acme so that the user sees the usual warning.
+func HandleDel(next Handler) Handler {
+	return func(w Window, e *acme.Event, done func() error) error {
+		if e.C1 != 'M' || e.C2 != 'x' {
+			return next(w, e, done)
+		}
+
+		cmd := strings.TrimSpace(string(e.Text))
+		if cmd != "Del" && cmd != "Delete" {
+			return next(w, e, done)
+		}
+
+		if err := w.Del(cmd == "Delete"); err != nil {
+			return w.WriteEvent(e)
+		}
+		return done()
+	}
+}
+
+// Commands routes execute events (button 2 in either the tag or the body)
+// whose first word matches a key of cmds to the corresponding Handler. Anything
+// else is passed on.
+func Commands(cmds map[string]Handler) Middleware {
+	return func(next Handler) Handler {
+		return func(w Window, e *acme.Event, done func() error) error {
+			if e.C2 != 'x' && e.C2 != 'X' {
+				return next(w, e, done)
+			}
+
+			fields := strings.Fields(string(e.Text))
+			if len(fields) == 0 {
+				return next(w, e, done)
+			}
+			if h, ok := cmds[fields[0]]; ok {
+				return h(w, e, done)
+			}
+			return next(w, e, done)
+		}
+	}
+}
+
+// KeyChord calls h when the runes in seq are typed into the body in quick
+// succession (with no other edits or clicks in between). The event passed to h
+// spans the full chord so that it can be removed from the body if required.
+// The individual key presses that make up the chord are still passed on as
+// they arrive.
+func KeyChord(seq string, h Handler) Middleware {
+	chord := []rune(seq)
+
+	return func(next Handler) Handler {
+		var typed []rune
+		last := -1
+
+		return func(w Window, e *acme.Event, done func() error) error {
+			if e.C1 != 'K' || e.C2 != 'I' {
+				typed, last = typed[:0], -1
+				return next(w, e, done)
+			}
+
+			if e.Q0 != last {
+				typed = typed[:0]
+			}
+			// Only the last len(chord) runes can be part of the chord
+			typed = append(typed, []rune(string(e.Text))...)
+			if n := len(typed) - len(chord); n > 0 {
+				typed = append(typed[:0], typed[n:]...)
+			}
+			last = e.Q1
+
+			if string(typed) != seq {
+				return next(w, e, done)
+			}
+
+			if err := next(w, e, done); err != nil {
+				return err
+			}
+
+			typed, last = typed[:0], -1
+			c := *e
+			c.Q0, c.OrigQ0 = e.Q1-len(chord), e.Q1-len(chord)
+			c.Text, c.Nr, c.Nb = []byte(seq), len(chord), len(seq)
+			return h(w, &c, done)
+		}
+	}
+}
+
+// Debounce holds back events of the given kinds (all events if none are
+// specified) until none have arrived for d, at which point only the most
+// recent one is passed on. Events are delivered on the event loop of ef so
+// handlers do not need to worry about concurrent access.
+func (ef *EventFilter) Debounce(d time.Duration, kinds ...EventKind) Middleware {
+	matches := func(e *acme.Event) bool {
+		if len(kinds) == 0 {
+			return true
+		}
+		for _, k := range kinds {
+			if KindOf(e) == k {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(next Handler) Handler {
+		cancel := func() {}
+
+		return func(w Window, e *acme.Event, done func() error) error {
+			if !matches(e) {
+				return next(w, e, done)
+			}
+
+			cancel()
+			cancel = ef.After(d, func() error {
+				return next(w, e, done)
+			})
+			return nil
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package acorp
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"9fans.net/go/acme"
+)
+
+// script acts as the user once the filter is reading events: input is run
+// when Start is executed in the tag and the filter completes when Stop is,
+// ahead of any other middleware.
+func script(input func()) Middleware {
+	return func(next Handler) Handler {
+		return func(w Window, e *acme.Event, done func() error) error {
+			if e.C1 != 'M' || e.C2 != 'x' {
+				return next(w, e, done)
+			}
+			switch string(e.Text) {
+			case "Start":
+				input()
+				return nil
+			case "Stop":
+				return done()
+			}
+			return next(w, e, done)
+		}
+	}
+}
+
+func tagCommand(cmd string) *acme.Event {
+	return &acme.Event{C1: 'M', C2: 'x', Text: []byte(cmd), Nr: len(cmd), Nb: len(cmd)}
+}
+
+// runFilter runs ef over w while input acts as the user, stopping once the
+// events input caused have been handled.
+func runFilter(t *testing.T, ef *EventFilter, w *FakeWin, input func()) {
+	t.Helper()
+	ef.Middleware = append([]Middleware{script(func() {
+		input()
+		w.Send(tagCommand("Stop"))
+	})}, ef.Middleware...)
+	w.Send(tagCommand("Start"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ef.Filter(ctx, w); err != nil {
+		t.Fatalf("Filter: %s", err)
+	}
+}
+
+func TestKeyChord(t *testing.T) {
+	type call struct{ q0, q1 int }
+
+	tests := []struct {
+		name  string
+		input func(w *FakeWin)
+		body  string
+		keys  int // KI events passed on
+		calls []call
+	}{
+		{"typed", func(w *FakeWin) { w.Type("ajk") }, "ajk", 3, []call{{1, 3}}},
+		{"twice", func(w *FakeWin) { w.Type("jkxjk") }, "jkxjk", 5, []call{{0, 2}, {3, 5}}},
+		{"repeated first rune", func(w *FakeWin) { w.Type("jjjk") }, "jjjk", 4, []call{{2, 4}}},
+		{"no chord", func(w *FakeWin) { w.Type("kj") }, "kj", 2, nil},
+		{
+			"long input",
+			func(w *FakeWin) { w.Type(strings.Repeat("é", 500) + "jk") },
+			strings.Repeat("é", 500) + "jk", 502,
+			[]call{{500, 502}},
+		},
+		{
+			"interrupted by a deletion",
+			func(w *FakeWin) {
+				w.Type("jx")
+				w.Backspace()
+				w.Type("k")
+			},
+			"jk", 3, nil,
+		},
+		{
+			"interrupted by a click",
+			func(w *FakeWin) {
+				w.Type("j")
+				w.MouseBody('L', 0, 1)
+				w.Type("k")
+			},
+			"jk", 2, nil,
+		},
+		{
+			"typed somewhere else",
+			func(w *FakeWin) {
+				w.Type("j")
+				w.Select(0, 0)
+				w.Type("k")
+			},
+			"kj", 2, nil,
+		},
+	}
+
+	for _, tc := range tests {
+		w := NewFakeWin(1, "f", "")
+		var calls []call
+		keys := 0
+
+		ef := &EventFilter{}
+		ef.Use(KeyChord("jk", func(w Window, e *acme.Event, done func() error) error {
+			if string(e.Text) != "jk" || e.Nr != 2 {
+				t.Errorf("%s: chord event has text %q (%d runes)", tc.name, e.Text, e.Nr)
+			}
+			calls = append(calls, call{e.Q0, e.Q1})
+			return nil
+		}))
+		ef.KeyboardInputBody = func(w Window, e *acme.Event, done func() error) error {
+			keys++
+			return nil
+		}
+		runFilter(t, ef, w, func() { tc.input(w) })
+
+		if w.Body() != tc.body {
+			t.Errorf("%s: body = %q; want %q", tc.name, w.Body(), tc.body)
+		}
+		if keys != tc.keys {
+			t.Errorf("%s: %d key presses passed on; want %d", tc.name, keys, tc.keys)
+		}
+		if len(calls) != len(tc.calls) {
+			t.Errorf("%s: chord handled at %v; want %v", tc.name, calls, tc.calls)
+			continue
+		}
+		for i := range calls {
+			if calls[i] != tc.calls[i] {
+				t.Errorf("%s: chord handled at %v; want %v", tc.name, calls, tc.calls)
+			}
+		}
+	}
+}
+
+func TestDebounce(t *testing.T) {
+	w := NewFakeWin(1, "f", "")
+	var inputs []string
+	var clicks int
+
+	ef := &EventFilter{}
+	ef.Use(ef.Debounce(50*time.Millisecond, "KI"))
+	ef.KeyboardInputBody = func(w Window, e *acme.Event, done func() error) error {
+		inputs = append(inputs, string(e.Text))
+		return nil
+	}
+	ef.Mouse3Body = func(w Window, e *acme.Event, done func() error) error {
+		clicks++
+		return nil
+	}
+
+	// The second burst is typed from a timer on the event loop, once the first
+	// has been handled
+	ef.Middleware = append([]Middleware{script(func() {
+		w.Type("abc")
+		w.MouseBody('L', 0, 1) // not debounced
+		ef.After(200*time.Millisecond, func() error {
+			w.Type("d")
+			return nil
+		})
+		ef.After(400*time.Millisecond, func() error {
+			w.Send(tagCommand("Stop"))
+			return nil
+		})
+	})}, ef.Middleware...)
+	w.Send(tagCommand("Start"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ef.Filter(ctx, w); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := strings.Join(inputs, " "); got != "c d" {
+		t.Errorf("debounced input = %q; want \"c d\"", got)
+	}
+	if clicks != 1 {
+		t.Errorf("saw %d clicks; want 1", clicks)
+	}
+}
+
+func TestHandleDel(t *testing.T) {
+	tests := []struct {
+		cmd     string
+		dirty   bool
+		deleted bool
+	}{
+		{"Del", false, true},
+		{"Del", true, false},
+		{"Delete", true, true},
+	}
+
+	for _, tc := range tests {
+		fa := NewFakeAcme()
+		w := fa.NewWin("f", "")
+		w.Write("tag", []byte(" Delete"))
+		if tc.dirty {
+			w.Ctl("dirty")
+		}
+
+		ef := &EventFilter{}
+		ef.Use(HandleDel)
+		runFilter(t, ef, w, func() { w.MouseTag('x', tc.cmd) })
+
+		if w.Deleted() != tc.deleted {
+			t.Errorf("%s with dirty %v: deleted = %v", tc.cmd, tc.dirty, w.Deleted())
+		}
+		// A refused Del goes to acme so that it can warn about the changes
+		if written := len(w.Written()) > 0; written == tc.deleted {
+			t.Errorf("%s with dirty %v: written back %v", tc.cmd, tc.dirty, w.Written())
+		}
+	}
+}
+
+func TestCommands(t *testing.T) {
+	w := NewFakeWin(1, "f", "Lint ./... Build\n")
+	w.Write("tag", []byte(" Lint Look"))
+	var ran []string
+	var passed []string
+
+	record := func(name string) Handler {
+		return func(w Window, e *acme.Event, done func() error) error {
+			ran = append(ran, name+":"+string(e.Text))
+			return nil
+		}
+	}
+
+	ef := &EventFilter{}
+	ef.Use(Commands(map[string]Handler{"Lint": record("lint"), "Build": record("build")}))
+	ef.Unhandled = func(w Window, e *acme.Event, done func() error) error {
+		passed = append(passed, string(KindOf(e))+":"+string(e.Text))
+		return nil
+	}
+	runFilter(t, ef, w, func() {
+		w.MouseTag('x', "Lint")
+		w.MouseTag('x', "Look")
+		w.MouseBody('X', 0, 10)  // 'Lint ./...'
+		w.MouseBody('X', 12, 12) // expands to 'Build'
+		w.MouseBody('L', 0, 4)   // button 3 isn't a command
+		w.Type("x")
+	})
+
+	if got := strings.Join(ran, " "); got != "lint:Lint lint:Lint ./... build:Build" {
+		t.Errorf("ran %q", got)
+	}
+	if got := strings.Join(passed, " "); got != "Mx:Look ML:Lint KI:x" {
+		t.Errorf("passed on %q", got)
+	}
+}
@@ -0,0 +1,200 @@
+package acorp
+
+// acme reports positions within a window as rune offsets (the Q0 and Q1 of an
+// event, the values read back from addr) but Go strings are indexed by byte
+// and humans think in terms of lines and columns. A PositionIndex is built
+// from a single snapshot of a window body and converts between all three.
+// Rather than re-reading the body from acme each time it changes, the index
+// can be kept up to date by applying the I/D events read from the window's
+// event file.
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"unicode/utf8"
+
+	"9fans.net/go/acme"
+)
+
+// ErrStaleIndex is returned when an event can not be applied to a PositionIndex
+// (normally because acme omitted the text of a large insertion). The index
+// should be rebuilt from the current window body.
+var ErrStaleIndex = errors.New("position index is out of date with the window body")
+
+// A PositionIndex maps between rune offsets, byte offsets and line:column
+// positions within a body of text. Lines and columns are counted from 0 and
+// columns are measured in runes.
+type PositionIndex struct {
+	text       []rune
+	lineStarts []int // rune offset of the start of each line
+	lineBytes  []int // byte offset of the start of each line
+}
+
+// NewPositionIndex builds a PositionIndex for body.
+func NewPositionIndex(body string) *PositionIndex {
+	p := &PositionIndex{text: []rune(body)}
+	p.reindexFrom(0)
+	return p
+}
+
+// IndexWindow builds a PositionIndex from the current body of w.
+func IndexWindow(w Window) (*PositionIndex, error) {
+	body, err := WindowBody(w)
+	if err != nil {
+		return nil, err
+	}
+	return NewPositionIndex(body), nil
+}
+
+// String returns the indexed text.
+func (p *PositionIndex) String() string {
+	return string(p.text)
+}
+
+// Len returns the length of the indexed text in runes.
+func (p *PositionIndex) Len() int {
+	return len(p.text)
+}
+
+// Lines returns the number of lines in the indexed text.
+func (p *PositionIndex) Lines() int {
+	return len(p.lineStarts)
+}
+
+// Line returns the line containing the rune offset q.
+func (p *PositionIndex) Line(q int) int {
+	q = clampOffset(q, len(p.text))
+	return sort.SearchInts(p.lineStarts, q+1) - 1
+}
+
+// LineCol returns the line and column of the rune offset q.
+func (p *PositionIndex) LineCol(q int) (line, col int) {
+	q = clampOffset(q, len(p.text))
+	line = p.Line(q)
+	return line, q - p.lineStarts[line]
+}
+
+// LineText returns the contents of line without its trailing newline.
+func (p *PositionIndex) LineText(line int) string {
+	if line < 0 || line >= len(p.lineStarts) {
+		return ""
+	}
+	q0, q1 := p.lineStarts[line], len(p.text)
+	if line+1 < len(p.lineStarts) {
+		q1 = p.lineStarts[line+1] - 1
+	}
+	return string(p.text[q0:q1])
+}
+
+// Offset returns the rune offset of the given line and column.
+func (p *PositionIndex) Offset(line, col int) (int, error) {
+	if line < 0 || line >= len(p.lineStarts) {
+		return -1, fmt.Errorf("line %d out of range", line)
+	}
+	end := len(p.text)
+	if line+1 < len(p.lineStarts) {
+		end = p.lineStarts[line+1] - 1
+	}
+	q := p.lineStarts[line] + col
+	if col < 0 || q > end {
+		return -1, fmt.Errorf("column %d out of range for line %d", col, line)
+	}
+	return q, nil
+}
+
+// ByteOffset converts the rune offset q to a byte offset into the UTF-8
+// encoding of the indexed text.
+func (p *PositionIndex) ByteOffset(q int) int {
+	q = clampOffset(q, len(p.text))
+	line := p.Line(q)
+	b := p.lineBytes[line]
+	for _, r := range p.text[p.lineStarts[line]:q] {
+		b += utf8.RuneLen(r)
+	}
+	return b
+}
+
+// RuneOffset converts the byte offset b into the UTF-8 encoding of the indexed
+// text to a rune offset. Offsets within a multi-byte rune map to the start of
+// that rune.
+func (p *PositionIndex) RuneOffset(b int) int {
+	line := sort.SearchInts(p.lineBytes, b+1) - 1
+	if line < 0 {
+		return 0
+	}
+	q, n := p.lineStarts[line], p.lineBytes[line]
+	for q < len(p.text) {
+		n += utf8.RuneLen(p.text[q])
+		if n > b {
+			break
+		}
+		q++
+	}
+	return q
+}
+
+// Insert updates the index for text being inserted at rune offset q.
+func (p *PositionIndex) Insert(q int, text string) {
+	q = clampOffset(q, len(p.text))
+	r := []rune(text)
+	t := make([]rune, 0, len(p.text)+len(r))
+	t = append(t, p.text[:q]...)
+	t = append(t, r...)
+	p.text = append(t, p.text[q:]...)
+	p.reindexFrom(p.Line(q))
+}
+
+// Delete updates the index for the runes between q0 and q1 being deleted.
+func (p *PositionIndex) Delete(q0, q1 int) {
+	q0, q1 = clampOffset(q0, len(p.text)), clampOffset(q1, len(p.text))
+	if q0 >= q1 {
+		return
+	}
+	p.text = append(p.text[:q0:q0], p.text[q1:]...)
+	p.reindexFrom(p.Line(q0))
+}
+
+// Apply updates the index using an insert or delete event from the body of a
+// window. Events for the tag and anything other than I/D are ignored. If the
+// event does not carry enough information to update the index, ErrStaleIndex
+// is returned.
+func (p *PositionIndex) Apply(e *acme.Event) error {
+	switch e.C2 {
+	case 'I':
+		if e.Nr != e.Q1-e.Q0 || utf8.RuneCount(e.Text) != e.Nr {
+			return ErrStaleIndex
+		}
+		if e.Q0 > len(p.text) {
+			return ErrStaleIndex
+		}
+		p.Insert(e.Q0, string(e.Text))
+
+	case 'D':
+		if e.Q1 > len(p.text) {
+			return ErrStaleIndex
+		}
+		p.Delete(e.Q0, e.Q1)
+	}
+
+	return nil
+}
+
+// reindexFrom recomputes the line tables from the start of line onwards.
+func (p *PositionIndex) reindexFrom(line int) {
+	if line < 0 || len(p.lineStarts) == 0 {
+		line = 0
+		p.lineStarts, p.lineBytes = []int{0}, []int{0}
+	}
+	p.lineStarts = p.lineStarts[:line+1]
+	p.lineBytes = p.lineBytes[:line+1]
+
+	b := p.lineBytes[line]
+	for q := p.lineStarts[line]; q < len(p.text); q++ {
+		b += utf8.RuneLen(p.text[q])
+		if p.text[q] == '\n' {
+			p.lineStarts = append(p.lineStarts, q+1)
+			p.lineBytes = append(p.lineBytes, b)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package acorp
+
+import (
+	"testing"
+
+	"9fans.net/go/acme"
+)
+
+// Lines: "héllo\n" (runes 0-6, bytes 0-7), "wörld ✓\n" (runes 6-14, bytes 7-19)
+// and "end" (runes 14-17, bytes 19-22).
+const positionText = "héllo\nwörld ✓\nend"
+
+func TestPositionIndexLineCol(t *testing.T) {
+	p := NewPositionIndex(positionText)
+
+	tests := []struct {
+		q         int
+		line, col int
+		b         int
+	}{
+		{0, 0, 0, 0},
+		{1, 0, 1, 1},
+		{2, 0, 2, 3},
+		{5, 0, 5, 6},
+		{6, 1, 0, 7},
+		{8, 1, 2, 10},
+		{12, 1, 6, 14},
+		{13, 1, 7, 17},
+		{14, 2, 0, 18},
+		{17, 2, 3, 21},
+		{99, 2, 3, 21},
+		{-1, 0, 0, 0},
+	}
+
+	for _, tc := range tests {
+		if line, col := p.LineCol(tc.q); line != tc.line || col != tc.col {
+			t.Errorf("LineCol(%d) = %d:%d; want %d:%d", tc.q, line, col, tc.line, tc.col)
+		}
+		if b := p.ByteOffset(tc.q); b != tc.b {
+			t.Errorf("ByteOffset(%d) = %d; want %d", tc.q, b, tc.b)
+		}
+	}
+
+	if p.Len() != 17 || p.Lines() != 3 || p.String() != positionText {
+		t.Errorf("Len, Lines = %d, %d; want 17, 3", p.Len(), p.Lines())
+	}
+}
+
+func TestPositionIndexRuneOffset(t *testing.T) {
+	p := NewPositionIndex(positionText)
+
+	tests := []struct{ b, q int }{
+		{0, 0},
+		{1, 1},
+		{2, 1}, // inside 'é'
+		{3, 2},
+		{7, 6},
+		{14, 12},
+		{15, 12}, // inside '✓'
+		{16, 12},
+		{17, 13},
+		{18, 14},
+		{21, 17},
+		{99, 17},
+	}
+
+	for _, tc := range tests {
+		if q := p.RuneOffset(tc.b); q != tc.q {
+			t.Errorf("RuneOffset(%d) = %d; want %d", tc.b, q, tc.q)
+		}
+	}
+}
+
+func TestPositionIndexOffset(t *testing.T) {
+	p := NewPositionIndex(positionText)
+
+	tests := []struct {
+		line, col int
+		q         int
+		ok        bool
+	}{
+		{0, 0, 0, true},
+		{0, 5, 5, true}, // the newline
+		{0, 6, -1, false},
+		{1, 7, 13, true},
+		{2, 3, 17, true},
+		{2, 4, -1, false},
+		{3, 0, -1, false},
+		{-1, 0, -1, false},
+		{1, -1, -1, false},
+	}
+
+	for _, tc := range tests {
+		q, err := p.Offset(tc.line, tc.col)
+		if q != tc.q || (err == nil) != tc.ok {
+			t.Errorf("Offset(%d, %d) = %d, %v; want %d", tc.line, tc.col, q, err, tc.q)
+		}
+	}
+
+	for line, want := range []string{"héllo", "wörld ✓", "end", ""} {
+		if got := p.LineText(line); got != want {
+			t.Errorf("LineText(%d) = %q; want %q", line, got, want)
+		}
+	}
+}
+
+func TestPositionIndexApply(t *testing.T) {
+	tests := []struct {
+		name string
+		e    acme.Event
+		want string
+		err  error
+	}{
+		{
+			"insert",
+			acme.Event{C1: 'K', C2: 'I', Q0: 6, Q1: 8, Nr: 2, Text: []byte("ñ\n")},
+			"héllo\nñ\nwörld ✓\nend", nil,
+		},
+		{
+			"delete",
+			acme.Event{C1: 'K', C2: 'D', Q0: 5, Q1: 14},
+			"hélloend", nil,
+		},
+		{
+			"delete everything",
+			acme.Event{C1: 'F', C2: 'D', Q0: 0, Q1: 17},
+			"", nil,
+		},
+		{
+			"missing text",
+			acme.Event{C1: 'F', C2: 'I', Q0: 0, Q1: 300, Nr: 0},
+			positionText, ErrStaleIndex,
+		},
+		{
+			"past the end",
+			acme.Event{C1: 'K', C2: 'D', Q0: 10, Q1: 20},
+			positionText, ErrStaleIndex,
+		},
+		{
+			"tag",
+			acme.Event{C1: 'K', C2: 'i', Q0: 0, Q1: 1, Nr: 1, Text: []byte("x")},
+			positionText, nil,
+		},
+	}
+
+	for _, tc := range tests {
+		p := NewPositionIndex(positionText)
+		e := tc.e
+		if err := p.Apply(&e); err != tc.err {
+			t.Errorf("%s: Apply returned %v; want %v", tc.name, err, tc.err)
+		}
+		if p.String() != tc.want {
+			t.Errorf("%s: text = %q; want %q", tc.name, p.String(), tc.want)
+		}
+
+		// The line tables must match those of a freshly built index
+		fresh := NewPositionIndex(tc.want)
+		for q := 0; q <= fresh.Len(); q++ {
+			l0, c0 := p.LineCol(q)
+			l1, c1 := fresh.LineCol(q)
+			if l0 != l1 || c0 != c1 || p.ByteOffset(q) != fresh.ByteOffset(q) {
+				t.Errorf("%s: position of %d = %d:%d; want %d:%d", tc.name, q, l0, c0, l1, c1)
+				break
+			}
+		}
+	}
+}
+
+func TestEventLineNumber(t *testing.T) {
+	w := NewFakeWin(1, "f", positionText)
+
+	for q, want := range map[int]int{0: 0, 5: 0, 6: 1, 13: 1, 14: 2, 17: 2} {
+		n, err := EventLineNumber(w, &acme.Event{Q0: q, Q1: q})
+		if err != nil || n != want {
+			t.Errorf("EventLineNumber(%d) = %d, %v; want %d", q, n, err, want)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package acorp
+
+// The structured protocol spoken by the snooper. Clients send one JSON object
+// per line and receive one JSON object per line in return, with any number of
+// requests being made over a single connection:
+//
+//	-> {"v":1,"id":1,"route":"active","content":"."}
+//	<- {"v":1,"id":1,"status":200,"body":"4"}
+//	-> {"v":1,"id":2,"route":"nope","content":""}
+//	<- {"v":1,"id":2,"status":404,"error":"'nope' is not a known handler"}
+//
+// A request that can't be decoded, or has no route, gets a 400 response (with
+// its id if that could be read) and the connection stays open for the next one.
+//
+// Payloads are arbitrary strings so may span multiple lines. Requests that set
+// "stream" get the output of routes that produce it gradually (such as plugins)
+// as it is written, in responses with "more" set, before the final response:
+//
+//	-> {"v":1,"id":3,"route":"grep","content":"TODO","stream":true}
+//	<- {"v":1,"id":3,"status":200,"body":"a.go:3: TODO\n","more":true}
+//	<- {"v":1,"id":3,"status":200,"body":"b.go:9: TODO\n"}
+//
+// A connection that does not start with '{' is treated as the original single
+// line protocol ('<route> / <content>', one request per connection, no status)
+// which is kept for existing scripts, but only on the unix socket when a secret
+// is required.
+
+// SnooperProtocolVersion is the version of the structured protocol implemented
+// by this package.
+const SnooperProtocolVersion = 1
+
+// Status codes for snooper responses.
+const (
+	StatusOK           = 200
+	StatusBadRequest   = 400
+	StatusUnauthorized = 401
+	StatusNotFound     = 404
+	StatusError        = 500
+	StatusBadVersion   = 505
+)
+
+// A SnooperRequest is a single request to the snooper. A zero Version is
+// treated as the current version. Secret is only checked for TCP connections
+// to a snooper that requires one, and only until a request on the connection
+// has been accepted. Stream asks for output to be sent as it is produced.
+type SnooperRequest struct {
+	Version int    `json:"v,omitempty"`
+	ID      int    `json:"id,omitempty"`
+	Secret  string `json:"secret,omitempty"`
+	Route   string `json:"route"`
+	Content string `json:"content"`
+	Stream  bool   `json:"stream,omitempty"`
+}
+
+// A SnooperResponse is the reply to the SnooperRequest with the same ID. Body
+// is set on success (Status == StatusOK) and Error otherwise. More is set on
+// the partial responses sent for streaming requests: the body of the complete
+// response is the concatenation of them all.
+type SnooperResponse struct {
+	Version int    `json:"v"`
+	ID      int    `json:"id,omitempty"`
+	Status  int    `json:"status"`
+	Body    string `json:"body,omitempty"`
+	Error   string `json:"error,omitempty"`
+	More    bool   `json:"more,omitempty"`
+}
@@ -0,0 +1,375 @@
+package acorp
+
+// A Registry follows the acme log so that programs can keep track of the set
+// of open windows without repeatedly scanning the index file. Each window's
+// name, tag and dirty state is recorded along with when it last had focus, and
+// any number of subscribers can receive the log events that they are
+// interested in. Acme only logs a handful of operations (new, zerox, get, put,
+// focus and del) so dirty state and tags are refreshed from the index file
+// whenever a window is focused: they may be stale for a window that is being
+// edited right now.
+
+import (
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Operations that appear in the acme log.
+const (
+	OpNew   = "new"
+	OpZerox = "zerox"
+	OpGet   = "get"
+	OpPut   = "put"
+	OpFocus = "focus"
+	OpDel   = "del"
+)
+
+// WindowInfo is what a Registry knows about an open window.
+type WindowInfo struct {
+	ID      int
+	Name    string
+	Tag     string
+	Dirty   bool
+	Focused time.Time
+}
+
+// A WindowEvent is an acme log event along with the state of the window after
+// it was applied. For del events Info is the last known state.
+type WindowEvent struct {
+	Op   string
+	Info WindowInfo
+}
+
+// A WindowFilter selects the WindowEvents a subscriber will receive.
+type WindowFilter func(e WindowEvent) bool
+
+// Ops matches events for any of the given operations.
+func Ops(ops ...string) WindowFilter {
+	return func(e WindowEvent) bool {
+		for _, op := range ops {
+			if e.Op == op {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// WindowID matches events for the window with the given id.
+func WindowID(id int) WindowFilter {
+	return func(e WindowEvent) bool { return e.Info.ID == id }
+}
+
+// NameMatches matches events for windows whose name matches re.
+func NameMatches(re *regexp.Regexp) WindowFilter {
+	return func(e WindowEvent) bool { return re.MatchString(e.Info.Name) }
+}
+
+// Registry tracks the windows open in acme.
+type Registry struct {
+	mu      sync.Mutex
+	log     LogReader
+	windows map[int]*WindowInfo
+	subs    map[*Subscription]struct{}
+	done    chan struct{}
+	err     error
+}
+
+// NewRegistry starts tailing the acme log and loads the current set of windows.
+func NewRegistry() (*Registry, error) {
+	l, err := backend.Log()
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := backend.Windows()
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	r := &Registry{
+		log:     l,
+		windows: make(map[int]*WindowInfo),
+		subs:    make(map[*Subscription]struct{}),
+		done:    make(chan struct{}),
+	}
+	for _, i := range info {
+		wi := i
+		r.windows[i.ID] = &wi
+	}
+
+	go r.run()
+	return r, nil
+}
+
+// Window returns the current state of the window with the given id.
+func (r *Registry) Window(id int) (WindowInfo, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if wi, ok := r.windows[id]; ok {
+		return *wi, true
+	}
+	return WindowInfo{}, false
+}
+
+// Lookup returns the window with the given name. If there is more than one
+// (acme allows this) the lowest id is returned.
+func (r *Registry) Lookup(name string) (WindowInfo, bool) {
+	for _, wi := range r.Windows() {
+		if wi.Name == name {
+			return wi, true
+		}
+	}
+	return WindowInfo{}, false
+}
+
+// Windows returns all known windows ordered by id.
+func (r *Registry) Windows() []WindowInfo {
+	r.mu.Lock()
+	info := make([]WindowInfo, 0, len(r.windows))
+	for _, wi := range r.windows {
+		info = append(info, *wi)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(info, func(i, j int) bool { return info[i].ID < info[j].ID })
+	return info
+}
+
+// Focused returns the window that most recently had focus.
+func (r *Registry) Focused() (WindowInfo, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var focused *WindowInfo
+	for _, wi := range r.windows {
+		if !wi.Focused.IsZero() && (focused == nil || wi.Focused.After(focused.Focused)) {
+			focused = wi
+		}
+	}
+	if focused == nil {
+		return WindowInfo{}, false
+	}
+	return *focused, true
+}
+
+// Refresh re-reads the tag and dirty state of the window with the given id.
+func (r *Registry) Refresh(id int) (WindowInfo, bool) {
+	r.mu.Lock()
+	wi, ok := r.windows[id]
+	var updated WindowInfo
+	if ok {
+		updated = *wi
+	}
+	r.mu.Unlock()
+
+	if !ok {
+		return WindowInfo{}, false
+	}
+	readWindowState(&updated)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if wi, ok = r.windows[id]; ok {
+		wi.Tag, wi.Dirty = updated.Tag, updated.Dirty
+		return *wi, true
+	}
+	return WindowInfo{}, false
+}
+
+// Subscribe returns a Subscription that receives every event matching all of
+// the given filters.
+func (r *Registry) Subscribe(filters ...WindowFilter) *Subscription {
+	c := make(chan WindowEvent)
+	s := &Subscription{C: c, c: c, quit: make(chan struct{}), r: r, filters: filters}
+	s.cond = sync.NewCond(&s.mu)
+
+	r.mu.Lock()
+	if r.subs == nil {
+		s.closed = true
+		close(s.quit)
+	} else {
+		r.subs[s] = struct{}{}
+	}
+	r.mu.Unlock()
+
+	go s.pump()
+	return s
+}
+
+// Done is closed once the registry has stopped following the log, either
+// because Close was called or because acme exited.
+func (r *Registry) Done() <-chan struct{} {
+	return r.done
+}
+
+// Err returns the error that stopped the registry (if any).
+func (r *Registry) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Close stops following the log and closes all subscriptions.
+func (r *Registry) Close() error {
+	return r.log.Close()
+}
+
+func (r *Registry) run() {
+	for {
+		e, err := r.log.Read()
+		if err != nil || e.Op == "" {
+			r.stop(err)
+			return
+		}
+		r.apply(e.ID, e.Op, e.Name)
+	}
+}
+
+func (r *Registry) apply(id int, op, name string) {
+	r.mu.Lock()
+	wi, ok := r.windows[id]
+	if !ok {
+		wi = &WindowInfo{ID: id}
+		r.windows[id] = wi
+	}
+	if name != "" {
+		wi.Name = name
+	}
+	updated := *wi
+	r.mu.Unlock()
+
+	switch op {
+	case OpNew, OpZerox, OpFocus:
+		readWindowState(&updated)
+	case OpGet, OpPut:
+		updated.Dirty = false
+	}
+	if op == OpFocus {
+		updated.Focused = time.Now()
+	}
+
+	r.mu.Lock()
+	if op == OpDel {
+		delete(r.windows, id)
+	} else if wi, ok = r.windows[id]; ok {
+		*wi = updated
+	}
+	subs := make([]*Subscription, 0, len(r.subs))
+	for s := range r.subs {
+		subs = append(subs, s)
+	}
+	r.mu.Unlock()
+
+	e := WindowEvent{Op: op, Info: updated}
+	for _, s := range subs {
+		s.push(e)
+	}
+}
+
+func (r *Registry) stop(err error) {
+	r.mu.Lock()
+	r.err = err
+	subs := r.subs
+	r.subs = nil
+	r.mu.Unlock()
+
+	for s := range subs {
+		s.close()
+	}
+	close(r.done)
+}
+
+// readWindowState fills in the tag and dirty state of wi from the index.
+func readWindowState(wi *WindowInfo) {
+	info, err := backend.Windows()
+	if err != nil {
+		return
+	}
+
+	for _, i := range info {
+		if i.ID == wi.ID {
+			wi.Tag, wi.Dirty = i.Tag, i.Dirty
+			return
+		}
+	}
+}
+
+// A Subscription delivers WindowEvents from a Registry on C. Events are queued
+// rather than dropped if the subscriber falls behind. C is closed when the
+// subscription or the registry is closed.
+type Subscription struct {
+	C <-chan WindowEvent
+
+	c       chan WindowEvent
+	quit    chan struct{}
+	r       *Registry
+	filters []WindowFilter
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []WindowEvent
+	closed  bool
+}
+
+// Close unsubscribes from the registry.
+func (s *Subscription) Close() {
+	s.r.mu.Lock()
+	if s.r.subs != nil {
+		delete(s.r.subs, s)
+	}
+	s.r.mu.Unlock()
+	s.close()
+}
+
+func (s *Subscription) push(e WindowEvent) {
+	for _, f := range s.filters {
+		if !f(e) {
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.queue = append(s.queue, e)
+		s.cond.Signal()
+	}
+}
+
+func (s *Subscription) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		s.queue = nil
+		close(s.quit)
+		s.cond.Signal()
+	}
+}
+
+func (s *Subscription) pump() {
+	defer close(s.c)
+
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if s.closed {
+			s.mu.Unlock()
+			return
+		}
+		e := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		select {
+		case s.c <- e:
+		case <-s.quit:
+			return
+		}
+	}
+}
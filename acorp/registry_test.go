@@ -0,0 +1,184 @@
+package acorp
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+// next returns the next event on s.
+func next(t *testing.T, s *Subscription) WindowEvent {
+	t.Helper()
+	select {
+	case e, ok := <-s.C:
+		if !ok {
+			t.Fatal("subscription closed")
+		}
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an event")
+	}
+	return WindowEvent{}
+}
+
+// expect checks that the next events on s are for the given operations and
+// window ids.
+func expect(t *testing.T, s *Subscription, want ...interface{}) {
+	t.Helper()
+	for i := 0; i < len(want); i += 2 {
+		op, id := want[i].(string), want[i+1].(int)
+		if e := next(t, s); e.Op != op || e.Info.ID != id {
+			t.Errorf("got %s for %d; want %s for %d", e.Op, e.Info.ID, op, id)
+		}
+	}
+	select {
+	case e := <-s.C:
+		t.Errorf("unexpected %s for %d", e.Op, e.Info.ID)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+// closed checks that c is closed, discarding any event that was already on
+// its way.
+func closed(t *testing.T, c <-chan WindowEvent) {
+	t.Helper()
+	for {
+		select {
+		case _, ok := <-c:
+			if !ok {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("subscription not closed")
+		}
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	fa := NewFakeAcme()
+	a := fa.NewWin("/src/a.go", "package a\n")
+	fa.NewWin("/src/", "a.go\n")
+	a.Ctl("dirty")
+	UseBackend(fa)
+	defer UseBackend(nil)
+
+	r, err := NewRegistry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// Built from the index to start with
+	wins := r.Windows()
+	if len(wins) != 2 || wins[0].Name != "/src/a.go" || !wins[0].Dirty || wins[1].Name != "/src/" || wins[1].Dirty {
+		t.Fatalf("started with %+v", wins)
+	}
+	if wi, ok := r.Lookup("/src/"); !ok || wi.ID != 2 {
+		t.Errorf("Lookup(/src/) = %+v, %v", wi, ok)
+	}
+	if _, ok := r.Focused(); ok {
+		t.Errorf("a window has focus before any were focused")
+	}
+
+	all := r.Subscribe()
+	goPuts := r.Subscribe(Ops(OpPut, OpDel), NameMatches(regexp.MustCompile(`\.go$`)))
+	first := r.Subscribe(WindowID(1))
+
+	b := fa.NewWin("/src/b.go", "")
+	fa.Focus(1)
+	a.Ctl("put")
+	fa.Focus(3)
+	expect(t, all, OpNew, 3, OpFocus, 1, OpPut, 1, OpFocus, 3)
+	expect(t, goPuts, OpPut, 1)
+	expect(t, first, OpFocus, 1, OpPut, 1)
+
+	if wi, ok := r.Window(3); !ok || wi.Name != "/src/b.go" || wi.Tag != b.Tag() {
+		t.Errorf("Window(3) = %+v, %v", wi, ok)
+	}
+	if wi, ok := r.Window(1); !ok || wi.Dirty {
+		t.Errorf("Window(1) after put = %+v, %v", wi, ok)
+	}
+	if wi, ok := r.Focused(); !ok || wi.ID != 3 {
+		t.Errorf("Focused() = %+v, %v; want 3", wi, ok)
+	}
+
+	// Edits aren't logged so state is only as fresh as the last refresh
+	b.Ctl("dirty")
+	if wi, _ := r.Window(3); wi.Dirty {
+		t.Errorf("window 3 dirty before being refreshed")
+	}
+	if wi, ok := r.Refresh(3); !ok || !wi.Dirty {
+		t.Errorf("Refresh(3) = %+v, %v", wi, ok)
+	}
+	if _, ok := r.Refresh(9); ok {
+		t.Errorf("refreshed a missing window")
+	}
+
+	// Acme allows more than one window with the same name
+	fa.NewWin("/src/b.go", "")
+	expect(t, all, OpNew, 4)
+	if wi, ok := r.Lookup("/src/b.go"); !ok || wi.ID != 3 {
+		t.Errorf("Lookup(/src/b.go) = %+v, %v; want 3", wi, ok)
+	}
+
+	// A closed subscription gets nothing more and doesn't hold anything up
+	first.Close()
+	if _, ok := <-first.C; ok {
+		t.Errorf("event received after Close")
+	}
+	a.Del(true)
+	expect(t, all, OpDel, 1)
+	if e := next(t, goPuts); e.Op != OpDel || e.Info.Name != "/src/a.go" {
+		t.Errorf("got %s for %+v; want the last state of the deleted window", e.Op, e.Info)
+	}
+	if _, ok := r.Window(1); ok {
+		t.Errorf("window 1 still known after del")
+	}
+	if _, ok := r.Lookup("/src/a.go"); ok {
+		t.Errorf("found /src/a.go after del")
+	}
+
+	// Subscribers that fall behind get everything in order
+	slow := r.Subscribe(Ops(OpFocus))
+	for i := 0; i < 50; i++ {
+		fa.Focus(2 + i%3)
+	}
+	for i := 0; i < 50; i++ {
+		if e := next(t, slow); e.Info.ID != 2+i%3 {
+			t.Fatalf("focus %d for %d; want %d", i, e.Info.ID, 2+i%3)
+		}
+	}
+
+	// Closing the registry closes every subscription
+	r.Close()
+	for _, s := range []*Subscription{all, goPuts, slow, r.Subscribe()} {
+		closed(t, s.C)
+	}
+	select {
+	case <-r.Done():
+	case <-time.After(5 * time.Second):
+		t.Error("registry not done after Close")
+	}
+}
+
+func TestRegistryAcmeExits(t *testing.T) {
+	fa := NewFakeAcme()
+	UseBackend(fa)
+	defer UseBackend(nil)
+
+	r, err := NewRegistry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := r.Subscribe()
+	fa.NewWin("/src/a.go", "")
+	expect(t, s, OpNew, 1)
+
+	fa.Close()
+	closed(t, s.C)
+	select {
+	case <-r.Done():
+	case <-time.After(5 * time.Second):
+		t.Error("registry not done after acme exited")
+	}
+}
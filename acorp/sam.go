@@ -0,0 +1,323 @@
+package acorp
+
+// Building sam addresses and commands by hand quickly leads to unreadable
+// strings that break as soon as a regexp contains a '/' or a newline. The types
+// here build them up from parts instead, escaping each piece for the position
+// it appears in:
+//
+//	acorp.All.Do(acorp.X(`\t+$`, acorp.D))          // ,x/\t+$/d
+//	acorp.Char(q).FullLine()                        // #q-+
+//	acorp.SearchBack(`[\-\+] `).FullLine()          // -/[\-\+] /-+
+//
+// Edit runs a command in a window in the same way as executing 'Edit ...' with
+// button 2, but returns its output directly rather than it ending up in
+// +Errors. (See http://doc.cat-v.org/bell_labs/sam_lang_tutorial/ for the
+// language.)
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// An Address is a sam address.
+type Address string
+
+// Commonly used addresses.
+const (
+	Dot   Address = "."
+	All   Address = ","
+	Start Address = "0"
+	End   Address = "$"
+)
+
+// Line returns the address of line n (1-based).
+func Line(n int) Address {
+	return Address(strconv.Itoa(n))
+}
+
+// Lines returns the address of lines from to to inclusive.
+func Lines(from, to int) Address {
+	return Line(from).To(Line(to))
+}
+
+// Char returns the (empty) address at rune offset q.
+func Char(q int) Address {
+	return Address(fmt.Sprintf("#%d", q))
+}
+
+// Chars returns the address of the runes between q0 and q1.
+func Chars(q0, q1 int) Address {
+	return Char(q0).To(Char(q1))
+}
+
+// Search returns the address of the next match of re after dot.
+func Search(re string) Address {
+	return Address("/" + escapeRegexp(re) + "/")
+}
+
+// SearchBack returns the address of the previous match of re before dot.
+func SearchBack(re string) Address {
+	return "-" + Search(re)
+}
+
+// To returns the address a,b: from the start of a to the end of b.
+func (a Address) To(b Address) Address {
+	return a + "," + b
+}
+
+// Then returns the address a;b: as To but b is evaluated with dot set to a.
+func (a Address) Then(b Address) Address {
+	return a + ";" + b
+}
+
+// Plus returns the address a+b.
+func (a Address) Plus(b Address) Address {
+	return a + "+" + b
+}
+
+// Minus returns the address a-b.
+func (a Address) Minus(b Address) Address {
+	return a + "-" + b
+}
+
+// FullLine extends a to cover the full lines that it touches.
+func (a Address) FullLine() Address {
+	return a + "-+"
+}
+
+// Do returns a command that runs cmds with dot set to a.
+func (a Address) Do(cmds ...Command) Command {
+	if len(cmds) == 1 {
+		return Command(a) + cmds[0]
+	}
+	return Command(a) + Block(cmds...)
+}
+
+// A Command is a sam command.
+type Command string
+
+// Commands that take no arguments.
+const (
+	D     Command = "d"
+	P     Command = "p"
+	Equal Command = "="
+)
+
+// X runs cmd for each match of re in dot.
+func X(re string, cmd Command) Command {
+	return Command("x/"+escapeRegexp(re)+"/") + cmd
+}
+
+// G runs cmd if dot contains a match of re.
+func G(re string, cmd Command) Command {
+	return Command("g/"+escapeRegexp(re)+"/") + cmd
+}
+
+// V runs cmd if dot does not contain a match of re.
+func V(re string, cmd Command) Command {
+	return Command("v/"+escapeRegexp(re)+"/") + cmd
+}
+
+// S substitutes repl for the first match of re in dot, or for every match if
+// global is true. repl may refer to the match with '&' and to submatches with
+// '\1' through '\9': use QuoteReplacement for literal text.
+func S(re, repl string, global bool) Command {
+	cmd := Command("s/" + escapeRegexp(re) + "/" + escapeRegexp(repl) + "/")
+	if global {
+		cmd += "g"
+	}
+	return cmd
+}
+
+// C replaces dot with text.
+func C(text string) Command {
+	return Command("c/" + escapeText(text) + "/")
+}
+
+// A appends text after dot.
+func A(text string) Command {
+	return Command("a/" + escapeText(text) + "/")
+}
+
+// I inserts text before dot.
+func I(text string) Command {
+	return Command("i/" + escapeText(text) + "/")
+}
+
+// Pipe replaces dot with the output of running the shell command cmd with dot
+// as its standard input.
+func Pipe(cmd string) Command {
+	return Command("|" + cmd)
+}
+
+// PipeIn replaces dot with the output of the shell command cmd.
+func PipeIn(cmd string) Command {
+	return Command("<" + cmd)
+}
+
+// PipeOut sends dot to the standard input of the shell command cmd.
+func PipeOut(cmd string) Command {
+	return Command(">" + cmd)
+}
+
+// Block groups cmds so that they are all run with the same dot.
+func Block(cmds ...Command) Command {
+	s := make([]string, len(cmds))
+	for i, c := range cmds {
+		s[i] = string(c)
+	}
+	return Command("{\n" + strings.Join(s, "\n") + "\n}")
+}
+
+// Exec runs the command in w: see Edit.
+func (c Command) Exec(w Window) (string, error) {
+	return Edit(w, string(c))
+}
+
+// QuoteMeta escapes all regular expression metacharacters in s so that the
+// result matches s literally.
+func QuoteMeta(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`\.+*?()|[]{}^$`, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// QuoteReplacement escapes s for use as literal replacement text in S.
+func QuoteReplacement(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `&`, `\&`).Replace(s)
+}
+
+// escapeRegexp escapes unescaped '/' delimiters and newlines in re, leaving
+// existing escapes alone.
+func escapeRegexp(re string) string {
+	var b strings.Builder
+	escaped := false
+	for _, r := range re {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '/':
+			b.WriteRune('\\')
+		case r == '\n':
+			b.WriteString(`\n`)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// escapeText escapes literal text for use in a, c and i.
+func escapeText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `/`, `\/`, "\n", `\n`).Replace(s)
+}
+
+// An EditError is an error reported while running an Edit command.
+type EditError struct {
+	Cmd string
+	Msg string
+}
+
+func (e *EditError) Error() string {
+	return fmt.Sprintf("Edit %s: %s", e.Cmd, e.Msg)
+}
+
+// Edit runs cmd in w as if 'Edit cmd' had been executed in its tag. Rather
+// than going through acme (which would send any output to +Errors) the command
+// is run by the interpreter in fakeedit.go against the body and dot read from
+// w, and the changes are then written back through addr and data as a single
+// undo step, leaving addr where it was. Output from commands such as p, = and
+// > is returned while errors are returned as an *EditError.
+func Edit(w Window, cmd string) (string, error) {
+	tag, err := w.ReadAll("tag")
+	if err != nil {
+		return "", err
+	}
+	name := strings.Fields(string(tag) + " ")[0]
+
+	body, err := WindowBody(w)
+	if err != nil {
+		return "", err
+	}
+	a0, a1, err := w.ReadAddr()
+	if err != nil {
+		return "", err
+	}
+	if err = w.Ctl("addr=dot"); err != nil {
+		return "", err
+	}
+	d0, d1, err := w.ReadAddr()
+	if err != nil {
+		return "", err
+	}
+
+	edits, out, err := runSam(cmd, name, []rune(body), span{d0, d1})
+	if err != nil {
+		w.Addr("#%d,#%d", a0, a1)
+		return out, &EditError{Cmd: cmd, Msg: err.Error()}
+	}
+
+	if err = writeEdits(w, edits); err != nil {
+		return out, err
+	}
+	return out, w.Addr("#%d,#%d", shiftEdited(a0, edits), shiftEdited(a1, edits))
+}
+
+// writeEdits writes edits, which are ordered and don't overlap, to w from the
+// bottom up so that the offsets of those still to be written stay valid.
+func writeEdits(w Window, edits []samEdit) error {
+	if len(edits) == 0 {
+		return nil
+	}
+
+	if err := w.Ctl("mark"); err != nil {
+		return err
+	}
+	if err := w.Ctl("nomark"); err != nil {
+		return err
+	}
+	defer w.Ctl("mark")
+
+	for i := len(edits) - 1; i >= 0; i-- {
+		e := edits[i]
+		if err := w.Addr("#%d,#%d", e.q0, e.q1); err != nil {
+			return err
+		}
+		if _, err := w.Write("data", []byte(string(e.text))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shiftEdited returns where the offset q ends up once edits have been made,
+// moving it to the start of any edit that replaced it.
+func shiftEdited(q int, edits []samEdit) int {
+	shift := 0
+	for _, e := range edits {
+		switch {
+		case e.q1 <= q && e.q0 < q:
+			shift += len(e.text) - (e.q1 - e.q0)
+		case e.q0 < q:
+			return e.q0 + shift
+		}
+	}
+	return q + shift
+}
+
+// errorsWindowName returns the name of the +Errors window that acme uses for
+// output from commands run in the window with the given name.
+func errorsWindowName(name string) string {
+	if ix := strings.LastIndex(name, "/"); ix >= 0 {
+		return name[:ix+1] + "+Errors"
+	}
+	return "+Errors"
+}
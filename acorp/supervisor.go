@@ -0,0 +1,116 @@
+package acorp
+
+// A Supervisor runs EventFilters for any number of windows from a single
+// process. Each loop gets its own context derived from the Supervisor's so
+// that it can be stopped individually (Stop), or all at once (Shutdown) with
+// every event file being released back to acme on the way out.
+
+import (
+	"context"
+	"sync"
+)
+
+type supervisedLoop struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// A Supervisor manages the event loops of a set of windows.
+type Supervisor struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	mu     sync.Mutex
+	loops  map[int]*supervisedLoop
+	wg     sync.WaitGroup
+	err    error
+
+	// OnExit (if set) is called with the window id and the error returned by
+	// Filter each time a loop exits.
+	OnExit func(id int, err error)
+}
+
+// NewSupervisor initialises a new Supervisor whose loops will all be stopped
+// when ctx is cancelled.
+func NewSupervisor(ctx context.Context) *Supervisor {
+	ctx, cancel := context.WithCancel(ctx)
+	return &Supervisor{
+		ctx:    ctx,
+		cancel: cancel,
+		loops:  make(map[int]*supervisedLoop),
+	}
+}
+
+// Go starts running ef against w in a new goroutine, stopping any existing
+// loop for the same window first.
+func (s *Supervisor) Go(w Window, ef *EventFilter) {
+	s.Stop(w.ID())
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	l := &supervisedLoop{cancel: cancel, done: make(chan struct{})}
+
+	s.mu.Lock()
+	s.loops[w.ID()] = l
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer close(l.done)
+
+		err := ef.Filter(ctx, w)
+		cancel()
+
+		s.mu.Lock()
+		if s.loops[w.ID()] == l {
+			delete(s.loops, w.ID())
+		}
+		if err != nil && err != context.Canceled && s.err == nil {
+			s.err = err
+		}
+		s.mu.Unlock()
+
+		if s.OnExit != nil {
+			s.OnExit(w.ID(), err)
+		}
+	}()
+}
+
+// Stop stops the loop for the given window (if there is one) and waits for it
+// to exit.
+func (s *Supervisor) Stop(id int) {
+	s.mu.Lock()
+	l, ok := s.loops[id]
+	s.mu.Unlock()
+
+	if ok {
+		l.cancel()
+		<-l.done
+	}
+}
+
+// Running returns the ids of all windows with a running loop.
+func (s *Supervisor) Running() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make([]int, 0, len(s.loops))
+	for id := range s.loops {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Wait blocks until all loops have exited, returning the first error (other
+// than cancellation) that any of them encountered.
+func (s *Supervisor) Wait() error {
+	s.wg.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Shutdown stops all loops and waits for them to exit.
+func (s *Supervisor) Shutdown() error {
+	s.cancel()
+	return s.Wait()
+}
@@ -0,0 +1,193 @@
+package acorp
+
+// Tools that live in their own acme window tend to expose a handful of
+// commands in the tag for the user to middle click (UpDir, Hidden, Reset...).
+// TagCommands keeps the set of commands a tool provides in one place: it
+// writes them into the tag, dispatches execute and look events on them to the
+// relevant function and regenerates the tag when the set of commands changes.
+// Anything that isn't one of our commands is passed on so acme can handle it.
+// A short status (counts, modes...) can also be shown after the commands.
+
+import (
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"9fans.net/go/acme"
+)
+
+// A TagCommandFunc runs a tag command. arg is any text following the command
+// name in the event along with the chorded argument if there was one.
+type TagCommandFunc = func(w Window, e *acme.Event, arg string) error
+
+// A TagCommand is a named command that is written into the tag of a window.
+// Exec is called when the command is executed (button 2) in the tag and Look
+// when it is looked up (button 3). If either is nil the event is passed on
+// instead, which allows external programs and acme builtins to be listed in
+// the tag.
+type TagCommand struct {
+	Name string
+	Help string
+	Exec TagCommandFunc
+	Look TagCommandFunc
+}
+
+// TagCommands is an ordered set of TagCommands for a window.
+type TagCommands struct {
+	cmds    []TagCommand
+	status  string
+	w       Window
+	written string
+}
+
+// NewTagCommands initialises a new set of TagCommands
+func NewTagCommands(cmds ...TagCommand) *TagCommands {
+	tc := &TagCommands{}
+	for _, c := range cmds {
+		tc.set(c)
+	}
+	return tc
+}
+
+// Add registers a new command, replacing any existing command with the same
+// name. If the commands have been written to a window its tag is regenerated.
+func (tc *TagCommands) Add(cmd TagCommand) error {
+	tc.set(cmd)
+	return tc.regenerate()
+}
+
+// Remove unregisters the named command, regenerating the tag if needed.
+func (tc *TagCommands) Remove(name string) error {
+	for i, c := range tc.cmds {
+		if c.Name == name {
+			tc.cmds = append(tc.cmds[:i], tc.cmds[i+1:]...)
+			break
+		}
+	}
+	return tc.regenerate()
+}
+
+// Lookup returns the command registered with the given name.
+func (tc *TagCommands) Lookup(name string) (TagCommand, bool) {
+	for _, c := range tc.cmds {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return TagCommand{}, false
+}
+
+// SetStatus sets the text shown in the tag after the commands, regenerating
+// the tag if needed.
+func (tc *TagCommands) SetStatus(s string) error {
+	tc.status = strings.TrimSpace(s)
+	return tc.regenerate()
+}
+
+// String returns the commands (and status) as they appear in the tag.
+func (tc *TagCommands) String() string {
+	names := make([]string, len(tc.cmds), len(tc.cmds)+1)
+	for i, c := range tc.cmds {
+		names[i] = c.Name
+	}
+	if tc.status != "" {
+		names = append(names, tc.status)
+	}
+	return strings.Join(names, " ")
+}
+
+// Help returns a table of the registered commands and their help text.
+func (tc *TagCommands) Help() string {
+	var b strings.Builder
+	tw := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	for _, c := range tc.cmds {
+		fmt.Fprintf(tw, "%s\t%s\n", c.Name, c.Help)
+	}
+	tw.Flush()
+	return b.String()
+}
+
+// WriteTag writes the commands to the tag of w, directly after the '|',
+// replacing anything that was previously written there by tc. w is remembered
+// so that the tag can be regenerated when commands are added or removed.
+func (tc *TagCommands) WriteTag(w Window) error {
+	tag, err := w.ReadAll("tag")
+	if err != nil {
+		return err
+	}
+
+	user := ""
+	if ix := strings.IndexRune(string(tag), '|'); ix >= 0 {
+		user = strings.TrimLeft(string(tag[ix+1:]), " ")
+	}
+	if tc.w == w && tc.written != "" {
+		user = strings.TrimLeft(strings.TrimPrefix(user, tc.written), " ")
+	}
+
+	s := tc.String()
+	if err = w.Ctl("cleartag"); err != nil {
+		return err
+	}
+	if _, err = w.Write("tag", []byte(strings.TrimRight(" "+s+" "+user, " "))); err != nil {
+		return err
+	}
+
+	tc.w, tc.written = w, s
+	return nil
+}
+
+// Middleware dispatches execute and look events in the tag for registered
+// commands.
+func (tc *TagCommands) Middleware(next Handler) Handler {
+	return func(w Window, e *acme.Event, done func() error) error {
+		var f TagCommandFunc
+		name, arg := splitCommand(e)
+
+		if c, ok := tc.Lookup(name); ok {
+			switch e.C2 {
+			case 'x':
+				f = c.Exec
+			case 'l':
+				f = c.Look
+			}
+		}
+
+		if e.C1 != 'M' || f == nil {
+			return next(w, e, done)
+		}
+		return f(w, e, arg)
+	}
+}
+
+func (tc *TagCommands) set(cmd TagCommand) {
+	for i, c := range tc.cmds {
+		if c.Name == cmd.Name {
+			tc.cmds[i] = cmd
+			return
+		}
+	}
+	tc.cmds = append(tc.cmds, cmd)
+}
+
+func (tc *TagCommands) regenerate() error {
+	if tc.w == nil {
+		return nil
+	}
+	return tc.WriteTag(tc.w)
+}
+
+// splitCommand splits the text of e into a command name and its argument,
+// appending the chorded argument if present.
+func splitCommand(e *acme.Event) (string, string) {
+	s := strings.TrimSpace(string(e.Text))
+	name, arg := s, ""
+	if i := strings.IndexAny(s, " \t\n"); i >= 0 {
+		name, arg = s[:i], strings.TrimSpace(s[i+1:])
+	}
+
+	if chorded, _, ok := ChordedArg(e); ok {
+		arg = strings.TrimSpace(arg + " " + chorded)
+	}
+
+	return name, arg
+}
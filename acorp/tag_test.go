@@ -0,0 +1,103 @@
+package acorp
+
+import (
+	"strings"
+	"testing"
+
+	"9fans.net/go/acme"
+)
+
+func TestTagCommands(t *testing.T) {
+	w := NewFakeWin(1, "/src/", "")
+	w.Write("tag", []byte(" Get"))
+	var ran, passed []string
+
+	cmd := func(name string) TagCommand {
+		return TagCommand{
+			Name: name,
+			Exec: func(w Window, e *acme.Event, arg string) error {
+				ran = append(ran, strings.TrimSpace(name+" "+arg))
+				return nil
+			},
+		}
+	}
+
+	tc := NewTagCommands(cmd("UpDir"), cmd("Hidden"))
+	ef := &EventFilter{}
+	ef.Use(tc.Middleware)
+	ef.Unhandled = func(w Window, e *acme.Event, done func() error) error {
+		// Rewriting the tag shows up as tag input as well
+		if e.C1 == 'M' {
+			passed = append(passed, string(KindOf(e))+":"+string(e.Text))
+		}
+		return nil
+	}
+
+	// click runs the filter while each command in cmds is executed in the tag
+	click := func(cmds ...string) {
+		ran, passed = nil, nil
+		runFilter(t, ef, w, func() {
+			for _, c := range cmds {
+				if err := w.MouseTag('x', c); err != nil {
+					t.Errorf("%s: %s", c, err)
+				}
+			}
+		})
+	}
+	checkTag := func(when, want string) {
+		t.Helper()
+		if got := w.Tag(); got != "/src/ Del Snarf |"+want {
+			t.Errorf("tag %s = %q; want %q", when, got, "/src/ Del Snarf |"+want)
+		}
+	}
+
+	if err := tc.WriteTag(w); err != nil {
+		t.Fatal(err)
+	}
+	checkTag("when written", " UpDir Hidden Get")
+	click("UpDir", "Hidden", "Get")
+	if got := strings.Join(ran, " "); got != "UpDir Hidden" {
+		t.Errorf("ran %q", got)
+	}
+	if got := strings.Join(passed, " "); got != "Mx:Get" {
+		t.Errorf("passed on %q", got)
+	}
+
+	if err := tc.Add(cmd("Reset")); err != nil {
+		t.Fatal(err)
+	}
+	checkTag("after Add", " UpDir Hidden Reset Get")
+	click("Reset")
+	if got := strings.Join(ran, " "); got != "Reset" {
+		t.Errorf("ran %q after Add", got)
+	}
+
+	// Once removed the command is no longer in the tag and executing it (from
+	// somewhere else) goes to acme
+	if err := tc.Remove("Hidden"); err != nil {
+		t.Fatal(err)
+	}
+	checkTag("after Remove", " UpDir Reset Get")
+	w.Write("tag", []byte(" Hidden"))
+	click("Hidden")
+	if len(ran) != 0 || strings.Join(passed, " ") != "Mx:Hidden" {
+		t.Errorf("after Remove ran %q and passed on %q", ran, passed)
+	}
+
+	// Re-adding puts it back at the end, leaving what the user typed alone
+	if err := tc.Add(cmd("Hidden")); err != nil {
+		t.Fatal(err)
+	}
+	checkTag("after re-adding", " UpDir Reset Hidden Get Hidden")
+	if err := tc.SetStatus("3 files"); err != nil {
+		t.Fatal(err)
+	}
+	checkTag("with status", " UpDir Reset Hidden 3 files Get Hidden")
+	click("Hidden", "UpDir")
+	if got := strings.Join(ran, " "); got != "Hidden UpDir" {
+		t.Errorf("ran %q after re-adding", got)
+	}
+	if len(passed) != 0 {
+		t.Errorf("passed on %q after re-adding", passed)
+	}
+}
@@ -1,52 +1,70 @@
 package acorp
 
 import (
-	"bufio"
 	"fmt"
-	"net"
 	"os"
 	"strconv"
-
-	"9fans.net/go/acme"
+	"strings"
 )
 
-const (
-	activeWindowQuery = "active / .\n"
-	snooperAddr       = "127.0.0.1:2009"
-)
+// CurrentWindowID determines the id of the current acme window. In order of
+// preference we use:
+//   - the 'winid' environment variable set by acme for programs it runs
+//   - the focused window as reported by the snooper
+//   - the most recently opened file window listed in the acme index
+//
+// The last of these is only a heuristic (acme does not expose focus itself)
+// but it allows tools to degrade gracefully when the snooper is not running.
+func CurrentWindowID() (int, error) {
+	if winStr := strings.TrimSpace(os.Getenv("winid")); len(winStr) > 0 {
+		winID, err := strconv.Atoi(winStr)
+		if err != nil {
+			return -1, fmt.Errorf("non numeric winid: %s", winStr)
+		}
+		return winID, nil
+	}
 
-func winIDFromSnooper() (string, error) {
-	conn, _ := net.Dial("tcp", snooperAddr)
-	fmt.Fprintf(conn, activeWindowQuery)
-	message, _ := bufio.NewReader(conn).ReadString('\n')
-	if message == "-1" {
-		return "", fmt.Errorf("unable to determine current window ID")
+	winID, err := NewSnooperClient().ActiveWindow()
+	if err == nil {
+		return winID, nil
 	}
-	return message, nil
+
+	if id, ok := newestFileWindow(); ok {
+		return id, nil
+	}
+
+	return -1, err
 }
 
-// GetCurrentWindow finds the current active window in acme, using the snooper if this is not called from
-// inside of an acme window directly.
-func GetCurrentWindow() (*acme.Win, error) {
-	var err error
+// newestFileWindow returns the id of the most recently created window that
+// looks like it holds a file rather than being a scratch or directory window.
+func newestFileWindow() (int, bool) {
+	info, err := backend.Windows()
+	if err != nil {
+		return -1, false
+	}
 
-	winStr := os.Getenv("winid")
-	if len(winStr) == 0 {
-		winStr, err = winIDFromSnooper()
-		if err != nil {
-			return nil, fmt.Errorf("unable to determine current acme window")
+	winID := -1
+	for _, i := range info {
+		name := i.Name
+		if strings.HasPrefix(name, "+") || strings.Contains(name, "/+") || strings.HasSuffix(name, "/") {
+			continue
+		}
+		if i.ID > winID {
+			winID = i.ID
 		}
 	}
 
-	winID, err := strconv.Atoi(winStr)
-	if err != nil {
-		return nil, fmt.Errorf("non numeric winid: %s", winStr)
-	}
+	return winID, winID > 0
+}
 
-	w, err := acme.Open(winID, nil)
+// GetCurrentWindow finds the current active window in acme, using the snooper if this is not called from
+// inside of an acme window directly.
+func GetCurrentWindow() (Window, error) {
+	winID, err := CurrentWindowID()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("unable to determine current acme window: %w", err)
 	}
 
-	return w, nil
+	return OpenWindow(winID)
 }
@@ -0,0 +1,118 @@
+/*
+aswitch - alt-tab for acme
+
+Lists the windows that have most recently had focus (as tracked by the snooper)
+in pick and shows the one that is selected. The current window is left out so
+hitting Return straight away jumps back to the previous window.
+  - To limit the number of windows listed, pass the '-n' flag.
+  - To override the default prompt ('switch> ') pass the '-p' flag.
+*/
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sminez/acme-corp/acorp"
+)
+
+var (
+	maxWindows = flag.Int("n", 0, "the maximum number of windows to list (0 for all)")
+	prompt     = flag.String("p", "switch> ", "prompt to present to the user when picking a window")
+)
+
+type entry struct {
+	id      int
+	focused time.Time
+	name    string
+}
+
+// parseHistory parses the response from the snooper's history route.
+func parseHistory(s string) []entry {
+	var entries []entry
+	for _, line := range strings.Split(strings.TrimSpace(s), "\n") {
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		id, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		t, _ := time.Parse(time.RFC3339, fields[1])
+		entries = append(entries, entry{id: id, focused: t, name: fields[2]})
+	}
+	return entries
+}
+
+func (e entry) String() string {
+	name := e.name
+	if name == "" {
+		name = fmt.Sprintf("(window %d)", e.id)
+	}
+	if e.focused.IsZero() {
+		return name
+	}
+	return fmt.Sprintf("%s  (%s ago)", name, time.Since(e.focused).Round(time.Second))
+}
+
+// pickEntry runs pick over entries and returns the one that was selected.
+func pickEntry(entries []entry) (entry, bool) {
+	lines := make([]string, len(entries))
+	for i, e := range entries {
+		lines[i] = e.String()
+	}
+
+	cmd := exec.Command("pick", "-s", "-n", "-f", "-p", *prompt)
+	cmd.Stdin = strings.NewReader(strings.Join(lines, "\n") + "\n")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(out.String()))
+	if err != nil || n < 1 || n > len(entries) {
+		return entry{}, false
+	}
+	return entries[n-1], true
+}
+
+func main() {
+	flag.Parse()
+
+	c := acorp.NewSnooperClient()
+	n := *maxWindows
+	if n > 0 {
+		n++ // the current window is dropped below
+	}
+
+	s, err := c.Send("history", strconv.Itoa(n))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	entries := parseHistory(s)
+	if len(entries) < 2 {
+		fmt.Println("no other windows have had focus")
+		os.Exit(1)
+	}
+
+	e, ok := pickEntry(entries[1:])
+	if !ok {
+		os.Exit(0)
+	}
+
+	if _, err = c.Send("switch", strconv.Itoa(e.id)); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
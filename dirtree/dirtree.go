@@ -2,6 +2,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -35,11 +36,12 @@ type node struct {
 }
 
 type fileTree struct {
-	w          *acme.Win
+	w          acorp.Window
 	root       string
 	showHidden bool
 	rootNodes  []*node
 	nodeMap    map[string]*node
+	cmds       *acorp.TagCommands
 }
 
 func main() {
@@ -70,14 +72,13 @@ func determineRoot() string {
 }
 
 func newFileTree(root string) *fileTree {
-	win, err := acme.New()
+	win, err := acorp.NewWindow()
 	if err != nil {
 		fmt.Printf("Unable to initialise new acme window: %s\n", err)
 		os.Exit(1)
 	}
 
 	win.Name("+dirtree")
-	win.Write("tag", []byte("UpDir Hidden Reset"))
 	rootNodes, _ := getNodes(root, 0)
 
 	f := fileTree{
@@ -89,6 +90,35 @@ func newFileTree(root string) *fileTree {
 	}
 
 	f.registerNodes(rootNodes)
+	f.cmds = acorp.NewTagCommands(
+		acorp.TagCommand{
+			Name: "UpDir",
+			Help: "move the root of the tree up one directory",
+			Exec: func(w acorp.Window, e *acme.Event, arg string) error {
+				f.resetRoot(path.Dir(f.root))
+				return nil
+			},
+		},
+		acorp.TagCommand{
+			Name: "Hidden",
+			Help: "toggle showing hidden files",
+			Exec: func(w acorp.Window, e *acme.Event, arg string) error {
+				f.showHidden = !f.showHidden
+				f.redraw(nil)
+				return nil
+			},
+		},
+		acorp.TagCommand{
+			Name: "Reset",
+			Help: "re-read the tree from disk, collapsing all directories",
+			Exec: func(w acorp.Window, e *acme.Event, arg string) error {
+				f.resetRoot(f.root)
+				return nil
+			},
+		},
+	)
+	f.cmds.WriteTag(win)
+
 	return &f
 }
 
@@ -246,25 +276,7 @@ func (f *fileTree) runEventLoop() {
 	var n *node
 
 	ef := &acorp.EventFilter{
-		Mouse2Tag: func(w *acme.Win, e *acme.Event, done func() error) error {
-			switch strings.TrimSpace(string(e.Text)) {
-			case "Del":
-				w.Ctl("delete")
-				done()
-			case "Reset":
-				f.resetRoot(f.root)
-			case "Hidden":
-				f.showHidden = !f.showHidden
-				f.redraw(nil)
-			case "UpDir":
-				f.resetRoot(path.Dir(f.root))
-			default:
-				return w.WriteEvent(e)
-			}
-			return nil
-		},
-
-		Mouse2Body: func(w *acme.Win, e *acme.Event, done func() error) error {
+		Mouse2Body: func(w acorp.Window, e *acme.Event, done func() error) error {
 			if n, knownNode = f.nodeFromEvent(e); !knownNode {
 				f.plumbEventAtCurrentRoot(e)
 				return nil
@@ -275,7 +287,7 @@ func (f *fileTree) runEventLoop() {
 			return nil
 		},
 
-		Mouse3Body: func(w *acme.Win, e *acme.Event, done func() error) error {
+		Mouse3Body: func(w acorp.Window, e *acme.Event, done func() error) error {
 			if n, knownNode = f.nodeFromEvent(e); !knownNode {
 				w.WriteEvent(e)
 				return nil
@@ -289,7 +301,8 @@ func (f *fileTree) runEventLoop() {
 		},
 	}
 
-	ef.Filter(f.w)
+	ef.Use(acorp.HandleDel, f.cmds.Middleware)
+	ef.Filter(context.Background(), f.w)
 }
 
 // use 'sam' addressing via the addr and xdata files for this window to extract the line that
@@ -298,7 +311,7 @@ func (f *fileTree) getPath(e *acme.Event) (string, bool) {
 	// Fetch the entire line from acme using addr. The acme address syntax here is
 	// going to the character at the begining of the event selection text (#e.Orig0),
 	// jumping back to the start of the line (-) and selecting to the end (+).
-	f.w.Addr(fmt.Sprintf("#%d-+", e.OrigQ0))
+	f.w.Addr("%s", acorp.Char(e.OrigQ0).FullLine())
 	b := make([]byte, buffSize)
 	n, _ := f.w.Read("xdata", b)
 
@@ -326,7 +339,7 @@ func (f *fileTree) getPath(e *acme.Event) (string, bool) {
 		// Reverse search (-/regexp/) for the first line that is a directory
 		// (starts with -/+) and is at the correct indentation level. Then
 		// select the entire line.
-		f.w.Addr(fmt.Sprintf(`-/[\-\+] %s[^ ]+/-+`, strings.Repeat(indentStr, i)))
+		f.w.Addr("%s", acorp.SearchBack(`[\-\+] `+strings.Repeat(indentStr, i)+`[^ ]+`).FullLine())
 		b := make([]byte, buffSize)
 		n, _ := f.w.Read("xdata", b)
 		comp := strings.TrimSpace(string(b[:n-1])[sepSize:])
@@ -7,4 +7,4 @@ require (
 
 require golang.org/x/sys v0.0.0-20190215142949-d0b11bdaac8a // indirect
 
-go 1.17
+go 1.20
@@ -7,6 +7,7 @@ focused window id.
   * To mimic dmenu behaviour of reading input from stdin, pass the '-s' flag.
   * To return the index of the selected line in the input instead of the line itself, pass the '-n' flag.
   * To override the default prompt ('> ') pass the '-p' flag followed by the string to use as the prompt.
+  * To select the first line when Return is hit without typing anything, pass the '-f' flag.
 
 +pick window actions
   * character input will be interpreted as a regex for filtering lines
@@ -17,6 +18,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"os"
@@ -36,10 +38,11 @@ var (
 	returnLineNum = flag.Bool("n", false, "return the line number of the selected line, not the line itself")
 	numberLines   = flag.Bool("N", false, "prefix each line with its line number")
 	prompt        = flag.String("p", "> ", "prompt to present to the user when taking input")
+	selectFirst   = flag.Bool("f", false, "select the first line on Return with no input")
 )
 
 type linePicker struct {
-	w              *acme.Win
+	w              acorp.Window
 	rawLines       []string
 	lineMap        map[int]string // original line numbers
 	selectedLines  map[int]int    // window line numbers -> input line number
@@ -48,10 +51,10 @@ type linePicker struct {
 }
 
 func newLinePicker(rawLines []string) *linePicker {
-	var w *acme.Win
+	var w acorp.Window
 	var err error
 
-	if w, err = acme.New(); err != nil {
+	if w, err = acorp.NewWindow(); err != nil {
 		fmt.Printf("Unable to initialise new acme window: %s\n", err)
 		os.Exit(1)
 	}
@@ -83,9 +86,10 @@ func (lp *linePicker) selectedLine() (int, string, error) {
 	}
 
 	// hitting enter on the input line selects top match if there is at least one, otherwise
-	// it returns the current input text
+	// it returns the current input text (which is empty if nothing has been typed, unless the
+	// '-f' flag is set)
 	if windowLineNumber == 0 {
-		if len(lp.selectedLines) == 0 {
+		if len(lp.selectedLines) == 0 || (lp.currentInput == "" && !*selectFirst) {
 			return -1, lp.currentInput, nil
 		}
 		windowLineNumber = 1
@@ -97,7 +101,7 @@ func (lp *linePicker) selectedLine() (int, string, error) {
 
 func (lp *linePicker) filter() (int, string, error) {
 	ef := &acorp.EventFilter{
-		KeyboardInputBody: func(w *acme.Win, e *acme.Event, done func() error) error {
+		KeyboardInputBody: func(w acorp.Window, e *acme.Event, done func() error) error {
 			r := e.Text[0]
 
 			if r <= 26 {
@@ -115,7 +119,7 @@ func (lp *linePicker) filter() (int, string, error) {
 			return lp.reRender()
 		},
 
-		KeyboardDeleteBody: func(w *acme.Win, e *acme.Event, done func() error) error {
+		KeyboardDeleteBody: func(w acorp.Window, e *acme.Event, done func() error) error {
 			if l := len(lp.currentInput); l > 0 {
 				removed := e.Q1 - e.Q0
 				lp.currentInput = lp.currentInput[:l-removed]
@@ -124,7 +128,7 @@ func (lp *linePicker) filter() (int, string, error) {
 			return lp.reRender()
 		},
 
-		Mouse3Body: func(w *acme.Win, e *acme.Event, done func() error) error {
+		Mouse3Body: func(w acorp.Window, e *acme.Event, done func() error) error {
 			lp.selectionEvent = e
 			return done()
 		},
@@ -134,7 +138,7 @@ func (lp *linePicker) filter() (int, string, error) {
 		return -1, "", err
 	}
 
-	if err := ef.Filter(lp.w); err != nil {
+	if err := ef.Filter(context.Background(), lp.w); err != nil {
 		return -1, "", err
 	}
 
@@ -142,21 +146,18 @@ func (lp *linePicker) filter() (int, string, error) {
 }
 
 func (lp *linePicker) reRender() error {
-	lines := lp.rawLines
 	lp.w.Clear()
 
-	if len(lp.currentInput) > 0 {
-		fragments := strings.Split(lp.currentInput, " ")
-		lp.selectedLines = make(map[int]int)
-		lines = []string{}
-		k := 0
-
-		for ix, line := range lp.lineMap {
-			if containsAll(line, fragments) {
-				lp.selectedLines[k] = ix
-				lines = append(lines, line)
-				k++
-			}
+	// Always rebuild the selection (in input order) so that picking a line with
+	// no filter applied, or after clearing the filter, maps back correctly.
+	fragments := strings.Split(lp.currentInput, " ")
+	lp.selectedLines = make(map[int]int)
+	lines := []string{}
+
+	for ix := 1; ix <= len(lp.rawLines); ix++ {
+		if line := lp.lineMap[ix]; containsAll(line, fragments) {
+			lp.selectedLines[len(lines)] = ix
+			lines = append(lines, line)
 		}
 	}
 
@@ -177,7 +178,7 @@ func containsAll(s string, ts []string) bool {
 
 func readFromAcme() ([]string, error) {
 	var (
-		w   *acme.Win
+		w   acorp.Window
 		err error
 	)
 
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"testing"
+
+	"9fans.net/go/acme"
+	"github.com/sminez/acme-corp/acorp"
+)
+
+var fruit = []string{"apple", "banana", "cherry", "blackberry"}
+
+// key is the event for typing r at the end of the input line.
+func key(r rune) *acme.Event {
+	return &acme.Event{C1: 'K', C2: 'I', Text: []byte(string(r)), Nr: 1}
+}
+
+// backspace is the event for deleting the last character of the input.
+func backspace() *acme.Event {
+	return &acme.Event{C1: 'K', C2: 'D', Q0: 0, Q1: 1}
+}
+
+// runPick runs a picker over lines in a fake acme, typing input and then
+// feeding it events in turn.
+func runPick(t *testing.T, lines []string, input string, events ...*acme.Event) (int, string) {
+	t.Helper()
+
+	fa := acorp.NewFakeAcme()
+	acorp.UseBackend(fa)
+	defer acorp.UseBackend(nil)
+
+	lp := newLinePicker(lines)
+	w := fa.Win(lp.w.ID())
+	for _, r := range input {
+		w.Send(key(r))
+	}
+	for _, e := range events {
+		w.Send(e)
+	}
+
+	n, s, err := lp.filter()
+	if err != nil {
+		t.Fatalf("filter returned error: %s", err)
+	}
+	return n, s
+}
+
+func TestPickFilter(t *testing.T) {
+	tests := []struct {
+		input  string
+		events []*acme.Event
+		n      int
+		line   string
+	}{
+		{"an\n", nil, 2, "banana"},
+		{"err\n", nil, 3, "cherry"},
+		{"b rry\n", nil, 4, "blackberry"},
+		{"berry\n", nil, 4, "blackberry"},
+		{"zzz\n", nil, -1, "zzz"},
+		{"chx", []*acme.Event{backspace(), key('\n')}, 3, "cherry"},
+	}
+
+	for _, tc := range tests {
+		n, line := runPick(t, fruit, tc.input, tc.events...)
+		if n != tc.n || line != tc.line {
+			t.Errorf("typing %q selected %d %q; want %d %q", tc.input, n, line, tc.n, tc.line)
+		}
+	}
+}
+
+func TestPickEmptyInput(t *testing.T) {
+	defer func() { *selectFirst = false }()
+
+	tests := []struct {
+		first bool
+		n     int
+		line  string
+	}{
+		{false, -1, ""},
+		{true, 1, "apple"},
+	}
+
+	for _, tc := range tests {
+		*selectFirst = tc.first
+		n, line := runPick(t, fruit, "\n")
+		if n != tc.n || line != tc.line {
+			t.Errorf("Return with -f=%v selected %d %q; want %d %q", tc.first, n, line, tc.n, tc.line)
+		}
+	}
+}
+
+func TestPickMouse(t *testing.T) {
+	tests := []struct {
+		input string
+		q0    int
+		n     int
+		line  string
+	}{
+		{"", len("> \napple\nban"), 2, "banana"},
+		{"", len("> \napple\nbanana\nch"), 3, "cherry"},
+		{"b", len("> b\nbanana\nbl"), 4, "blackberry"},
+	}
+
+	for _, tc := range tests {
+		e := &acme.Event{C1: 'M', C2: 'L', Q0: tc.q0, Q1: tc.q0}
+		n, line := runPick(t, fruit, tc.input, e)
+		if n != tc.n || line != tc.line {
+			t.Errorf("clicking at %d after %q selected %d %q; want %d %q", tc.q0, tc.input, n, line, tc.n, tc.line)
+		}
+	}
+}
+
+func TestNumberedLines(t *testing.T) {
+	got := numberedLines([]string{"a", "b"})
+	if got[0] != "  1 | a" || got[1] != "  2 | b" {
+		t.Errorf("numberedLines = %q", got)
+	}
+}
@@ -25,6 +25,7 @@ import (
 
 	"9fans.net/go/acme"
 	"github.com/fsnotify/fsnotify"
+	"github.com/sminez/acme-corp/acorp"
 )
 
 var (
@@ -82,8 +83,7 @@ func main() {
 		}
 	}
 
-	w.Addr(",")
-	body, err := w.ReadAll("data")
+	body, err := acorp.WindowBody(w)
 	if err != nil {
 		log.Print(err)
 		return
@@ -97,7 +97,7 @@ func main() {
 		return
 	}
 
-	if _, err := tmpFile.Write(body); err != nil {
+	if _, err := tmpFile.WriteString(body); err != nil {
 		tmpFile.Close()
 		log.Fatal(err)
 	}
@@ -126,18 +126,18 @@ func main() {
 				// log.Printf("fsnotify: %#v\n", event)
 
 				if event.Op&fsnotify.Write == fsnotify.Write {
-					// Read the tempfile contents back in and replace the
-					// window content with them.
-					// TODO: Stash cursor position? Can't guarentee that we'll
-					// still have a similar structure when we come back...
+					// Read the tempfile contents back in and apply any
+					// changes to the window, leaving everything that was
+					// not edited (and the cursor) where it was.
 					edited, err := ioutil.ReadFile(tmpFile.Name())
 					if err != nil {
 						log.Print(err)
 						return
 					}
 
-					w.Clear()
-					w.Write("data", edited)
+					if err := acorp.ApplyText(w, string(edited)); err != nil {
+						log.Print(err)
+					}
 					os.Remove(tmpFile.Name())
 					return
 				}
@@ -12,7 +12,7 @@
 # a $winid env var to read for targetting the correct window so ping the snooper
 # to find out what the active window is. (If the snooper returns -1 for the id
 # of the window then we have not been able to determine focus yet so exit)
-WINID="$(echo "active / ." | nc localhost 2009)"
+WINID="$(asnoop active)"
 (( WINID > 0 )) || exit 1
 
 
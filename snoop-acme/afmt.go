@@ -1,130 +1,465 @@
 package snoop
 
 // afmt watches acme for know file extensions on files being written inside
-// acme. Each time a known file is written, it runs the appropriate Tool and
-// reloads the file in acme.
-//
-// TODO: Rewrite this to modify the _window_ body rather than the underlying
-//		 files. Would this also require a check that we had been idempotent?
+// acme. Each time a known file is written, it runs the appropriate formatters
+// over the window body and diffs the result back into the window (keeping
+// undo history intact) before putting it again, in the same way as acmego.
+// Once there is nothing left to format the remaining Tools are run over the
+// file to report on any problems (see diag.go and diagwin.go).
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"time"
 
-	"9fans.net/go/acme"
+	"github.com/sminez/acme-corp/acorp"
+)
+
+const (
+	tmpPrefix          = "acme-afmt"
+	defaultToolTimeout = 30 * time.Second
+)
+
+// Templates that are expanded in Tool arguments.
+const (
+	fileTemplate = "{file}" // the file (a temporary copy for inPlace formatters)
+	dirTemplate  = "{dir}"  // the directory containing the file
+	rootTemplate = "{root}" // the root of the project containing the file (see root.go)
+	pkgTemplate  = "{pkg}"  // the import path of the Go package containing the file
+
+	editionTemplate = "{edition}" // the Rust edition of the crate containing the file
+)
+
+// What a Tool is run over: the file itself (the default), the directory
+// containing it or the root of its project. Tools are run from the directory
+// containing the file unless they target the root, in which case they are run
+// from there, and the {target} template expands to whichever one they target.
+const (
+	targetFile = "file"
+	targetDir  = "dir"
+	targetRoot = "root"
+
+	targetTemplate = "{target}"
 )
 
 // A Tool is a program that can rewrite source files or report on errors that
-// were encountered in the code.
+// were encountered in the code. Formatters never touch the file itself: they
+// are either given the window body on stdin and print the result (stdin) or
+// are run over a temporary copy of it that they rewrite (inPlace). Tools are
+// killed if they run for longer than their timeout (defaultToolTimeout if not
+// set). Other tools can be run over the directory or project containing the
+// file rather than the file itself (target) and their output is parsed into
+// Diagnostics using the named parser (see diag.go), chosen based on cmd if not
+// set.
 type Tool struct {
-	cmd            string
-	args           []string
-	outputFixer    func(string) string
-	appendFilePath bool
-	appendDirPath  bool
-	ignoreOutput   bool
+	cmd          string
+	args         []string
+	target       string
+	fixers       []outputFixer
+	ignoreOutput bool
+	stdin        bool
+	inPlace      bool
+	timeout      time.Duration
+	parser       string
 }
 
-// TODO: copy the window body to a temp file, format it there and then reload it
-//       in the window body. Probably best to set up the temp file in
-//       FileType.Reformat and then pass that in here? >> Look at how acmego
-//       does this
-func (t *Tool) reformat(e *acme.LogEvent) string {
-	args := t.args
+// An outputFixer rewrites the output of a Tool, typically to make it button3
+// friendly.
+type outputFixer struct {
+	re   *regexp.Regexp
+	repl string
+}
 
-	if _, err := ioutil.ReadFile(e.Name); err != nil {
-		return err.Error()
+func (t *Tool) fixOutput(s string) string {
+	for _, f := range t.fixers {
+		s = f.re.ReplaceAllString(s, f.repl)
 	}
+	return s
+}
+
+func (t *Tool) isFormatter() bool {
+	return t.stdin || t.inPlace
+}
+
+// withTimeout returns a context that expires after t's timeout.
+func (t *Tool) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if t.timeout <= 0 {
+		return context.WithTimeout(ctx, defaultToolTimeout)
+	}
+	return context.WithTimeout(ctx, t.timeout)
+}
 
-	if t.appendFilePath {
-		args = append(t.args, e.Name)
-	} else if t.appendDirPath {
-		args = append(t.args, path.Dir(e.Name))
+// timedOut reports whether t was killed for running past its timeout.
+func (t *Tool) timedOut(ctx context.Context) error {
+	if ctx.Err() != context.DeadlineExceeded {
+		return nil
 	}
+	d := t.timeout
+	if d <= 0 {
+		d = defaultToolTimeout
+	}
+	return fmt.Errorf("%s: timed out after %s", t.cmd, d)
+}
 
-	cmd := exec.Command(t.cmd, args...)
-	cmd.Dir = path.Dir(e.Name)
+// command builds the command to run t for the file name, expanding the
+// templates in its arguments. {file} is replaced by file. The command is
+// killed when ctx is done.
+func (t *Tool) command(ctx context.Context, name, file string) *exec.Cmd {
+	dir := path.Dir(name)
+	root, ok := projectRoot(dir)
+	if !ok {
+		root = dir
+	}
+
+	target, workDir := file, dir
+	switch t.target {
+	case targetDir:
+		target = dir
+	case targetRoot:
+		target, workDir = root, root
+	}
+
+	r := strings.NewReplacer(
+		fileTemplate, file, dirTemplate, dir, rootTemplate, root, targetTemplate, target,
+	)
+	args := make([]string, len(t.args))
+	for i, arg := range t.args {
+		if strings.Contains(arg, pkgTemplate) {
+			arg = strings.Replace(arg, pkgTemplate, goPackage(dir), -1)
+		}
+		if strings.Contains(arg, editionTemplate) {
+			arg = strings.Replace(arg, editionTemplate, rustEdition(dir), -1)
+		}
+		args[i] = r.Replace(arg)
+	}
+
+	cmd := exec.CommandContext(ctx, t.cmd, args...)
+	cmd.Dir = workDir
+	// Don't wait forever on any children that the tool left holding its output
+	cmd.WaitDelay = time.Second
+	return cmd
+}
+
+// goPackage returns the import path of the Go package in dir, falling back to
+// dir itself if it isn't part of a module.
+func goPackage(dir string) string {
+	root, ok := findUp(dir, "go.mod")
+	if !ok {
+		return dir
+	}
+	b, err := ioutil.ReadFile(filepath.Join(root, "go.mod"))
+	if err != nil {
+		return dir
+	}
+
+	for _, line := range strings.Split(string(b), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[0] == "module" {
+			rel, _ := filepath.Rel(root, dir)
+			return path.Join(strings.Trim(fields[1], `"`), filepath.ToSlash(rel))
+		}
+	}
+	return dir
+}
+
+// defaultRustEdition is used for files that aren't part of a crate, which is
+// what the rust formatter has always been run with.
+const defaultRustEdition = "2018"
+
+// rustEdition returns the Rust edition to format the files in dir with: the
+// one set in the nearest rustfmt config if there is one, otherwise the one for
+// the crate containing dir (which cargo takes to be 2015 if not given).
+func rustEdition(dir string) string {
+	if root, ok := findUp(dir, "rustfmt.toml", ".rustfmt.toml"); ok {
+		for _, name := range []string{"rustfmt.toml", ".rustfmt.toml"} {
+			if edition, ok := tomlValue(filepath.Join(root, name), "", "edition"); ok {
+				return edition
+			}
+		}
+	}
+
+	root, ok := findUp(dir, "Cargo.toml")
+	if !ok {
+		return defaultRustEdition
+	}
+	edition, ok := tomlValue(filepath.Join(root, "Cargo.toml"), "package", "edition")
+	_, inherited := tomlValue(filepath.Join(root, "Cargo.toml"), "package", "edition.workspace")
+	if !inherited && !strings.HasPrefix(edition, "{") {
+		if !ok {
+			return "2015"
+		}
+		return edition
+	}
+
+	// The crate takes its edition from the workspace that it is a member of
+	if root, ok = findUp(filepath.Dir(root), "Cargo.toml"); ok {
+		if edition, ok = tomlValue(filepath.Join(root, "Cargo.toml"), "workspace.package", "edition"); ok {
+			return edition
+		}
+	}
+	return "2015"
+}
+
+// tomlValue returns the value of key in the given table of the TOML file name,
+// with "" being the top level. Only the simple 'key = value' lines that we need
+// are understood: quotes and trailing comments are stripped from the value.
+func tomlValue(name, table, key string) (string, bool) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return "", false
+	}
+
+	current := ""
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			current = strings.TrimSpace(strings.Trim(line, "[]"))
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 0 || current != table || strings.TrimSpace(line[:i]) != key {
+			continue
+		}
+
+		v := strings.TrimSpace(line[i+1:])
+		if len(v) > 0 && (v[0] == '"' || v[0] == '\'') {
+			if j := strings.IndexByte(v[1:], v[0]); j >= 0 {
+				return v[1 : j+1], true
+			}
+		}
+		if j := strings.Index(v, "#"); j >= 0 {
+			v = strings.TrimSpace(v[:j])
+		}
+		return v, true
+	}
+	return "", false
+}
+
+// check runs a Tool that reports on the file that was written, returning the
+// problems it found along with any output that couldn't be parsed.
+func (t *Tool) check(ctx context.Context, name string) ([]Diagnostic, string) {
+	ctx, cancel := t.withTimeout(ctx)
+	defer cancel()
+
+	cmd := t.command(ctx, name, name)
 	b, _ := cmd.CombinedOutput()
+	if err := t.timedOut(ctx); err != nil {
+		return nil, err.Error() + "\n"
+	}
 	if t.ignoreOutput || len(b) == 0 {
-		return ""
+		return nil, ""
 	}
 
-	if t.outputFixer != nil {
-		return t.outputFixer(string(b))
+	output := t.fixOutput(string(b))
+	parser, ok := diagnosticParsers[t.parserName()]
+	if !ok {
+		return nil, output
 	}
+	return parser(t.cmd, cmd.Dir, output)
+}
 
-	return string(b)
+func (t *Tool) parserName() string {
+	if t.parser != "" {
+		return t.parser
+	}
+	if p, ok := defaultParsers[path.Base(t.cmd)]; ok {
+		return p
+	}
+	return "gcc"
+}
+
+// format runs a formatter over src, the contents of the file name.
+func (t *Tool) format(ctx context.Context, name, src string) (string, error) {
+	ctx, cancel := t.withTimeout(ctx)
+	defer cancel()
+
+	if t.inPlace {
+		return t.formatFile(ctx, name, src)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := t.command(ctx, name, name)
+	cmd.Stdin = strings.NewReader(src)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", t.formatError(ctx, name, err, stderr.String())
+	}
+	return stdout.String(), nil
+}
+
+// formatFile runs an in place formatter over a temporary copy of src. The copy
+// keeps the extension of name for formatters that care.
+func (t *Tool) formatFile(ctx context.Context, name, src string) (string, error) {
+	f, err := ioutil.TempFile("", tmpPrefix+"*"+path.Ext(name))
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(src)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if b, err := t.command(ctx, name, f.Name()).CombinedOutput(); err != nil {
+		return "", t.formatError(ctx, name, err, strings.Replace(string(b), f.Name(), name, -1))
+	}
+
+	b, err := ioutil.ReadFile(f.Name())
+	return string(b), err
+}
+
+// formatError reports a failed formatter, pointing any errors at the file
+// rather than wherever the formatter read it from.
+func (t *Tool) formatError(ctx context.Context, name string, err error, output string) error {
+	if terr := t.timedOut(ctx); terr != nil {
+		return terr
+	}
+
+	output = strings.Replace(output, "<standard input>", name, -1)
+	if output = t.fixOutput(output); strings.TrimSpace(output) == "" {
+		output = err.Error()
+	}
+	return fmt.Errorf("%s: %s", t.cmd, strings.TrimSpace(output))
 }
 
 // A FileType defines a set of Tools and an associated file type to run them on.
-// If the files support a unix shebang then we try to parse that as well if the
-// extension is missing.
+// Files are matched by extension, a glob pattern (against as many trailing
+// elements of the path as the pattern has) or the interpreter in their shebang
+// line: see detect.go for how these fit in with everything else we look at.
 type FileType struct {
+	name         string
 	extensions   []string
 	shebangProgs []string
+	patterns     []string
 	Tools        []Tool
 }
 
-// Matches checks to see if this is a file we need to reformat
-func (f *FileType) Matches(e *acme.LogEvent) bool {
-	fileExtension := path.Ext(e.Name)
-	if len(fileExtension) > 0 {
-		fileExtension = fileExtension[1:]
-		for _, ext := range f.extensions {
-			if fileExtension == ext {
-				return true
-			}
+// matchesExtension reports whether the file name has one of f's extensions.
+func (f *FileType) matchesExtension(name string) bool {
+	ext := strings.TrimPrefix(path.Ext(name), ".")
+	if ext == "" {
+		return false
+	}
+	for _, e := range f.extensions {
+		if ext == e {
+			return true
 		}
 	}
+	return false
+}
 
-	s, err := getFirstLine(e.ID)
-	if err != nil {
-		return false
+// matchesPattern reports whether the file name matches one of f's patterns.
+func (f *FileType) matchesPattern(name string) bool {
+	elems := strings.Split(name, "/")
+	for _, p := range f.patterns {
+		n := strings.Count(p, "/") + 1
+		if n > len(elems) {
+			continue
+		}
+		if ok, _ := path.Match(p, strings.Join(elems[len(elems)-n:], "/")); ok {
+			return true
+		}
 	}
+	return false
+}
 
-	for _, prog := range f.shebangProgs {
-		if strings.HasSuffix(s, prog) {
+// matchesInterpreter reports whether prog, taken from a shebang line, is one
+// of f's interpreters, ignoring any version number ('python3.11').
+func (f *FileType) matchesInterpreter(prog string) bool {
+	for _, p := range f.shebangProgs {
+		if prog == p || versionRe.ReplaceAllString(prog, "") == p {
 			return true
 		}
 	}
-
 	return false
 }
 
-// Reformat applies all known formatters to the underlying file
-func (f *FileType) Reformat(e *acme.LogEvent) string {
-	var output string
-	var w *acme.Win
+// format runs each of the formatters for f over src in turn.
+func (f *FileType) format(ctx context.Context, name, src string) (string, error) {
 	var err error
 
-	if w, err = acme.Open(e.ID, nil); err != nil {
-		fmt.Println(err)
-		return err.Error()
-	}
-	defer w.CloseFiles()
-
 	for _, t := range f.Tools {
-		output += t.reformat(e)
+		if t.isFormatter() {
+			if src, err = t.format(ctx, name, src); err != nil {
+				return "", err
+			}
+		}
 	}
 
-	w.Ctl("get")
-	w.Ctl("clean")
-	return output
+	return src, nil
 }
 
-func getFirstLine(winid int) (string, error) {
-	w, err := acme.Open(winid, nil)
+// Reformat formats the body of w, which holds the file name, writing any
+// changes back to the window and putting it again, and reports whether it did
+// so. A put brings us back here, this time with nothing to format, so callers
+// only need to Check the file when it wasn't changed. What gets formatted is
+// the file as it was written, rather than whatever the window holds by the
+// time we get to it. Nothing is changed once ctx has been cancelled.
+func (f *FileType) Reformat(ctx context.Context, w acorp.Window, name string) (bool, string) {
+	b, err := ioutil.ReadFile(name)
 	if err != nil {
-		fmt.Println(err)
-		return "", err
+		return false, err.Error() + "\n"
+	}
+	put := string(b)
+
+	formatted, err := f.format(ctx, name, put)
+	if err != nil {
+		return false, err.Error() + "\n"
+	}
+	if formatted == put {
+		return false, ""
+	}
+
+	// A formatter that keeps changing its own output would have us putting the
+	// window forever, so only accept results that are stable.
+	if again, err := f.format(ctx, name, formatted); err != nil || again != formatted {
+		return false, fmt.Sprintf("skipped update to %s: formatting is not idempotent\n", name)
+	}
+
+	// Only pull in the changes if the window still holds what was written:
+	// otherwise we would clobber edits made since the Put, even ones made
+	// before the formatters started.
+	if ctx.Err() != nil {
+		return false, ""
+	}
+	if body, err := acorp.WindowBody(w); err != nil || body != put {
+		return false, fmt.Sprintf("skipped update to %s: window modified since Put\n", name)
+	}
+	if err = acorp.ApplyText(w, formatted); err != nil {
+		return false, err.Error()
+	}
+
+	if err = w.Ctl("put"); err != nil {
+		return false, err.Error()
+	}
+	return true, ""
+}
+
+// Check runs the tools for f that aren't formatters over the file name,
+// returning the problems they found along with any output that couldn't be
+// parsed.
+func (f *FileType) Check(ctx context.Context, name string) ([]Diagnostic, string) {
+	var diags []Diagnostic
+	var output string
+
+	for _, t := range f.Tools {
+		if !t.isFormatter() && ctx.Err() == nil {
+			d, s := t.check(ctx, name)
+			diags, output = append(diags, d...), output+s
+		}
 	}
-	defer w.CloseFiles()
 
-	w.Addr("#1-+")
-	b := make([]byte, 256)
-	n, _ := w.Read("xdata", b)
-	return string(b[:n-1]), nil
+	return mergeDiagnostics(diags), output
 }
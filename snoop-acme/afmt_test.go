@@ -0,0 +1,121 @@
+package snoop
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sminez/acme-corp/acorp"
+)
+
+// writeFiles creates each of files (relative to dir) with the given contents.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, contents := range files {
+		name = filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRustEdition(t *testing.T) {
+	tests := []struct {
+		files   map[string]string
+		edition string
+	}{
+		{map[string]string{}, defaultRustEdition},
+		{map[string]string{"Cargo.toml": "[package]\nname = \"x\"\n"}, "2015"},
+		{map[string]string{"Cargo.toml": "[package]\nedition = \"2021\" # comment\n"}, "2021"},
+		{map[string]string{"Cargo.toml": "[dependencies]\nedition = \"2021\"\n"}, "2015"},
+		{
+			map[string]string{
+				"Cargo.toml":           "[package]\nedition = \"2021\"\n",
+				"src/bin/rustfmt.toml": "max_width = 80\nedition = '2024'\n",
+			},
+			"2024",
+		},
+		{
+			map[string]string{
+				"Cargo.toml":    "[package]\nedition = \"2021\"\n",
+				".rustfmt.toml": "max_width = 80\n",
+			},
+			"2021",
+		},
+		{
+			map[string]string{
+				"../Cargo.toml": "[workspace]\nmembers = [\"crate\"]\n\n[workspace.package]\nedition = \"2021\"\n",
+				"Cargo.toml":    "[package]\nedition.workspace = true\n",
+			},
+			"2021",
+		},
+		{
+			map[string]string{
+				"../Cargo.toml": "[workspace.package]\nedition = \"2024\"\n",
+				"Cargo.toml":    "[package]\nedition = { workspace = true }\n",
+			},
+			"2024",
+		},
+	}
+
+	for i, tc := range tests {
+		root := t.TempDir()
+		crate := filepath.Join(root, "crate")
+		writeFiles(t, crate, tc.files)
+		if err := os.MkdirAll(filepath.Join(crate, "src/bin"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if edition := rustEdition(filepath.Join(crate, "src/bin")); edition != tc.edition {
+			t.Errorf("%d: rustEdition = %q; want %q", i, edition, tc.edition)
+		}
+	}
+}
+
+func TestReformat(t *testing.T) {
+	fa := acorp.NewFakeAcme()
+	acorp.UseBackend(fa)
+	defer acorp.UseBackend(nil)
+
+	upper := FileType{
+		name:  "upper",
+		Tools: []Tool{{cmd: "tr", args: []string{"a-z", "A-Z"}, stdin: true}},
+	}
+	name := filepath.Join(t.TempDir(), "f.txt")
+	writeFiles(t, filepath.Dir(name), map[string]string{"f.txt": "hello\n"})
+
+	tests := []struct {
+		body    string
+		changed bool
+		output  string
+	}{
+		// Edits made after the put are kept, even if made before we got here
+		{"hello, world\n", false, "window modified since Put"},
+		{"hello\n", true, ""},
+	}
+
+	for _, tc := range tests {
+		w := fa.NewWin(name, tc.body)
+		changed, output := upper.Reformat(context.Background(), w, name)
+		if changed != tc.changed || !strings.Contains(output, tc.output) {
+			t.Errorf("Reformat(%q) = %v, %q; want %v, %q", tc.body, changed, output, tc.changed, tc.output)
+		}
+
+		want := tc.body
+		if tc.changed {
+			want = strings.ToUpper(tc.body)
+		}
+		if w.Body() != want {
+			t.Errorf("Reformat(%q) left body %q; want %q", tc.body, w.Body(), want)
+		}
+	}
+
+	if changed, output := upper.Reformat(context.Background(), fa.NewWin("/nope", "x"), "/nope"); changed || output == "" {
+		t.Errorf("Reformat of a missing file = %v, %q", changed, output)
+	}
+}
@@ -0,0 +1,324 @@
+package snoop
+
+// The FileTypes and Tools used by afmt can be configured without recompiling
+// in $HOME/.config/acme-corp/snoop.json, for example:
+//
+//	{
+//	  "filetypes": [
+//	    {
+//	      "name": "python",
+//	      "extensions": ["py"],
+//	      "shebangs": ["python3"],
+//	      "patterns": ["SConstruct"],
+//	      "tools": [
+//	        {"cmd": "black", "args": ["-q", "-"], "stdin": true},
+//	        {"cmd": "flake8", "args": ["{file}"]},
+//	        {"cmd": "mypy", "args": ["{file}"], "fixers": [{"match": "error: ", "replace": ""}]}
+//	      ]
+//	    }
+//	  ],
+//	  "trusted_projects": ["~/src/mine"]
+//	}
+//
+// A file type is merged over the built in type with the same name (see
+// ftype.go), keeping any fields that it doesn't set ("tools": [] clears the
+// tools), and any others are added after them. Tools are run in order:
+// formatters take the window body on stdin ("stdin") or rewrite a temporary
+// copy of the file ("in_place") and everything else is run over the file once
+// there is nothing left to format. The other tools can "target" the "file"
+// (the default), its "dir" or the "root" of its project (see root.go), being
+// run from the project root in the last case. Arguments may use the {file},
+// {dir}, {root}, {target}, {pkg} and {edition} templates described in afmt.go
+// and output fixers are regexp rewrites applied to the output of the tool.
+// Tools are killed if they run for longer than their "timeout" (a duration
+// such as "10s", 30s by default) and their output is parsed into diagnostics
+// by the named "parser" (see diag.go, or "none" to report the output as is)
+// which is picked based on the cmd if it isn't given. The config is loaded at
+// start up and again on 'reload'.
+//
+// Projects can have their own config in the same format in a .snoop.json file,
+// found by walking up from the directory of the file being written until we
+// reach the root of the git repository. This is merged over the global config
+// each time a file is written so there is no need to reload after editing it.
+// As project configs choose the commands that get run on save, they are only
+// used for projects under one of the directories listed in "trusted_projects"
+// in the global config (a leading ~/ is the home directory) and others are
+// ignored: cloning someone else's repository shouldn't mean running whatever
+// it asks for the first time a file in it is written.
+
+import (
+	jsonenc "encoding/json" // json is the FileType in ftype.go
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	projectConfigName = ".snoop.json"
+	builtinConfig     = "built in"
+)
+
+type config struct {
+	FileTypes       []fileTypeConfig `json:"filetypes"`
+	TrustedProjects []string         `json:"trusted_projects"`
+}
+
+type fileTypeConfig struct {
+	Name       string       `json:"name"`
+	Extensions []string     `json:"extensions"`
+	Shebangs   []string     `json:"shebangs"`
+	Patterns   []string     `json:"patterns"`
+	Tools      []toolConfig `json:"tools"`
+}
+
+type toolConfig struct {
+	Cmd          string        `json:"cmd"`
+	Args         []string      `json:"args"`
+	Target       string        `json:"target"`
+	Stdin        bool          `json:"stdin"`
+	InPlace      bool          `json:"in_place"`
+	IgnoreOutput bool          `json:"ignore_output"`
+	Timeout      string        `json:"timeout"`
+	Parser       string        `json:"parser"`
+	Fixers       []fixerConfig `json:"fixers"`
+}
+
+type fixerConfig struct {
+	Match   string `json:"match"`
+	Replace string `json:"replace"`
+}
+
+// configPath returns the location of the snooper config file.
+func configPath() string {
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".config", "acme-corp", "snoop.json")
+}
+
+// loadFileTypes returns the built in file types updated by the config file at
+// the given path, which need not exist, along with the directories holding the
+// projects whose configs are trusted.
+func loadFileTypes(path string) ([]FileType, []string, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return append([]FileType{}, formatableTypes...), nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	cfg, err := parseConfig(path, b)
+	if err != nil {
+		return nil, nil, err
+	}
+	trusted, err := trustedRoots(cfg.TrustedProjects)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", path, err)
+	}
+	fileTypes, err := applyConfig(formatableTypes, path, cfg)
+	return fileTypes, trusted, err
+}
+
+// trustedRoots returns the absolute paths of the trusted project directories
+// given in the config, with symlinks resolved where they exist.
+func trustedRoots(dirs []string) ([]string, error) {
+	var roots []string
+	home, _ := os.UserHomeDir()
+
+	for _, dir := range dirs {
+		if strings.HasPrefix(dir, "~/") {
+			dir = filepath.Join(home, dir[2:])
+		}
+		if !filepath.IsAbs(dir) {
+			return nil, fmt.Errorf("trusted project '%s' is not an absolute path", dir)
+		}
+		if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+			dir = resolved
+		}
+		roots = append(roots, filepath.Clean(dir))
+	}
+	return roots, nil
+}
+
+// isTrusted reports whether the project config at path is inside one of the
+// trusted roots. Symlinks are resolved first so that a link inside a trusted
+// project can't be used to pull in a config from somewhere else.
+func isTrusted(path string, roots []string) bool {
+	dir := filepath.Dir(path)
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	}
+	for _, root := range roots {
+		rel, err := filepath.Rel(root, dir)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+			return true
+		}
+	}
+	return false
+}
+
+// projectConfig returns the path of the project config that applies to the
+// file name, if there is one, whether or not it is trusted.
+func projectConfig(name string) (string, bool) {
+	for dir := filepath.Dir(name); ; dir = filepath.Dir(dir) {
+		p := filepath.Join(dir, projectConfigName)
+		if _, err := os.Stat(p); err == nil {
+			return p, true
+		}
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return "", false
+		}
+		if parent := filepath.Dir(dir); parent == dir {
+			return "", false
+		}
+	}
+}
+
+// loadProjectFileTypes returns fileTypes updated by the project config at the
+// given path. Only the global config can say which projects are trusted.
+func loadProjectFileTypes(fileTypes []FileType, path string) ([]FileType, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := parseConfig(path, b)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.TrustedProjects != nil {
+		return nil, fmt.Errorf("%s: trusted_projects can only be set in %s", path, configPath())
+	}
+	return applyConfig(fileTypes, path, cfg)
+}
+
+// parseConfig decodes the config b, read from path.
+func parseConfig(path string, b []byte) (config, error) {
+	var cfg config
+	if err := jsonenc.Unmarshal(b, &cfg); err != nil {
+		return config{}, fmt.Errorf("%s: %s", path, err)
+	}
+	return cfg, nil
+}
+
+// applyConfig returns a copy of fileTypes updated by cfg, read from path.
+func applyConfig(fileTypes []FileType, path string, cfg config) ([]FileType, error) {
+	fileTypes = append([]FileType{}, fileTypes...)
+
+	for _, ftc := range cfg.FileTypes {
+		ft, err := ftc.fileType()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		fileTypes = mergeFileType(fileTypes, ft)
+	}
+
+	return fileTypes, nil
+}
+
+// mergeFileType merges ft over the file type with the same name or adds it.
+func mergeFileType(fileTypes []FileType, ft FileType) []FileType {
+	for i := range fileTypes {
+		if fileTypes[i].name != ft.name {
+			continue
+		}
+		if ft.extensions == nil {
+			ft.extensions = fileTypes[i].extensions
+		}
+		if ft.shebangProgs == nil {
+			ft.shebangProgs = fileTypes[i].shebangProgs
+		}
+		if ft.patterns == nil {
+			ft.patterns = fileTypes[i].patterns
+		}
+		if ft.Tools == nil {
+			ft.Tools = fileTypes[i].Tools
+		}
+		fileTypes[i] = ft
+		return fileTypes
+	}
+	return append(fileTypes, ft)
+}
+
+func (c *fileTypeConfig) fileType() (FileType, error) {
+	if c.Name == "" {
+		return FileType{}, fmt.Errorf("file types must have a name")
+	}
+
+	ft := FileType{
+		name:         c.Name,
+		extensions:   c.Extensions,
+		shebangProgs: c.Shebangs,
+		patterns:     c.Patterns,
+	}
+	for _, p := range c.Patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return FileType{}, fmt.Errorf("%s: invalid pattern '%s'", c.Name, p)
+		}
+	}
+
+	if c.Tools != nil {
+		ft.Tools = []Tool{}
+	}
+	for _, tc := range c.Tools {
+		t, err := tc.tool()
+		if err != nil {
+			return FileType{}, fmt.Errorf("%s: %s", c.Name, err)
+		}
+		ft.Tools = append(ft.Tools, t)
+	}
+
+	return ft, nil
+}
+
+func (c *toolConfig) tool() (Tool, error) {
+	if c.Cmd == "" {
+		return Tool{}, fmt.Errorf("tools must have a cmd")
+	}
+	if c.Stdin && c.InPlace {
+		return Tool{}, fmt.Errorf("%s: only one of stdin and in_place can be set", c.Cmd)
+	}
+
+	t := Tool{
+		cmd:          c.Cmd,
+		args:         c.Args,
+		target:       c.Target,
+		ignoreOutput: c.IgnoreOutput,
+		stdin:        c.Stdin,
+		inPlace:      c.InPlace,
+		parser:       c.Parser,
+	}
+
+	switch c.Target {
+	case "", targetFile:
+	case targetDir, targetRoot:
+		if c.Stdin || c.InPlace {
+			return Tool{}, fmt.Errorf("%s: formatters can only target the file", c.Cmd)
+		}
+	default:
+		return Tool{}, fmt.Errorf("%s: unknown target '%s'", c.Cmd, c.Target)
+	}
+	if _, ok := diagnosticParsers[c.Parser]; !ok && c.Parser != "" && c.Parser != noParser {
+		return Tool{}, fmt.Errorf("%s: unknown parser '%s'", c.Cmd, c.Parser)
+	}
+	if c.Timeout != "" {
+		d, err := time.ParseDuration(c.Timeout)
+		if err != nil || d <= 0 {
+			return Tool{}, fmt.Errorf("%s: invalid timeout '%s'", c.Cmd, c.Timeout)
+		}
+		t.timeout = d
+	}
+
+	for _, fc := range c.Fixers {
+		re, err := regexp.Compile(fc.Match)
+		if err != nil {
+			return Tool{}, fmt.Errorf("%s: invalid fixer: %s", c.Cmd, err)
+		}
+		t.fixers = append(t.fixers, outputFixer{re: re, repl: fc.Replace})
+	}
+
+	return t, nil
+}
@@ -0,0 +1,138 @@
+package snoop
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sminez/acme-corp/acorp"
+)
+
+func TestLoadFileTypes(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	tests := []struct {
+		config  string
+		trusted []string
+		err     string
+	}{
+		{`{}`, nil, ""},
+		{`{"trusted_projects": ["~/src", "/work/"]}`, []string{filepath.Join(home, "src"), "/work"}, ""},
+		{`{"trusted_projects": ["src"]}`, nil, "not an absolute path"},
+		{`{"filetypes": [{"tools": []}]}`, nil, "must have a name"},
+		{`{"filetypes": `, nil, "unexpected end"},
+	}
+
+	for _, tc := range tests {
+		path := filepath.Join(home, "snoop.json")
+		writeFiles(t, home, map[string]string{"snoop.json": tc.config})
+		fileTypes, trusted, err := loadFileTypes(path)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: got error %v; want %q", tc.config, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || len(fileTypes) != len(formatableTypes) || strings.Join(trusted, " ") != strings.Join(tc.trusted, " ") {
+			t.Errorf("%s: got %d file types, trusted %q, %v; want trusted %q", tc.config, len(fileTypes), trusted, err, tc.trusted)
+		}
+	}
+}
+
+func TestIsTrusted(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"mine/repo/.snoop.json":   "{}",
+		"theirs/repo/.snoop.json": "{}",
+	})
+	if err := os.Symlink(filepath.Join(dir, "theirs/repo"), filepath.Join(dir, "mine/link")); err != nil {
+		t.Fatal(err)
+	}
+	roots, err := trustedRoots([]string{filepath.Join(dir, "mine")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path    string
+		trusted bool
+	}{
+		{"mine/repo/.snoop.json", true},
+		{"mine/.snoop.json", true},
+		{"theirs/repo/.snoop.json", false},
+		{"mine/link/.snoop.json", false},
+		{"mine-too/.snoop.json", false},
+		{".snoop.json", false},
+	}
+
+	for _, tc := range tests {
+		if trusted := isTrusted(filepath.Join(dir, tc.path), roots); trusted != tc.trusted {
+			t.Errorf("isTrusted(%s) = %v; want %v", tc.path, trusted, tc.trusted)
+		}
+	}
+}
+
+func TestProjectFileTypes(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	writeFiles(t, home, map[string]string{
+		".config/acme-corp/snoop.json": `{"trusted_projects": ["~/mine"]}`,
+		"mine/.git/HEAD":               "",
+		"mine/.snoop.json":             `{"filetypes": [{"name": "go", "tools": []}]}`,
+		"theirs/.git/HEAD":             "",
+		"theirs/.snoop.json":           `{"filetypes": [{"name": "go", "tools": [{"cmd": "rm"}]}]}`,
+		"sneaky/.git/HEAD":             "",
+		"sneaky/.snoop.json":           `{"trusted_projects": ["/"]}`,
+	})
+
+	w := acorp.NewFakeWin(1, "+snoop", "")
+	a := &AcmeSnooper{win: w, types: newTypeCache()}
+	if _, err := a.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		source string
+		tools  int
+		errors string
+	}{
+		{"mine/main.go", "mine/.snoop.json", 0, ""},
+		{"theirs/main.go", configPath(), len(golang.Tools), "ignoring " + filepath.Join(home, "theirs/.snoop.json")},
+		{"theirs/main.go", configPath(), len(golang.Tools), ""}, // only reported once
+		{"sneaky/main.go", configPath(), len(golang.Tools), "ignoring"},
+		{"main.go", configPath(), len(golang.Tools), ""},
+	}
+
+	for _, tc := range tests {
+		before := len(w.Errors())
+		fileTypes, source := a.projectFileTypes(filepath.Join(home, tc.name))
+		if want := tc.source; want != configPath() {
+			tc.source = filepath.Join(home, want)
+		}
+		if source != tc.source {
+			t.Errorf("%s: config from %s; want %s", tc.name, source, tc.source)
+		}
+		for _, ft := range fileTypes {
+			if ft.name == "go" && len(ft.Tools) != tc.tools {
+				t.Errorf("%s: go has %d tools; want %d", tc.name, len(ft.Tools), tc.tools)
+			}
+		}
+		if errors := w.Errors()[before:]; !strings.HasPrefix(errors, tc.errors) || (tc.errors == "") != (errors == "") {
+			t.Errorf("%s: reported %q; want %q", tc.name, errors, tc.errors)
+		}
+	}
+
+	// Trusting everything still doesn't let a project say what is trusted
+	writeFiles(t, home, map[string]string{".config/acme-corp/snoop.json": `{"trusted_projects": ["/"]}`})
+	a.reload()
+	before := len(w.Errors())
+	if _, source := a.projectFileTypes(filepath.Join(home, "sneaky/main.go")); source != configPath() {
+		t.Errorf("sneaky config used")
+	}
+	if errors := w.Errors()[before:]; !strings.Contains(errors, "can only be set in") {
+		t.Errorf("reported %q", errors)
+	}
+}
@@ -1,7 +1,5 @@
 package snoop
 
 const (
-	tcpPort         = 2009
-	defaultSnoopTag = "Clear fmton fmtoff dirtree"
-	prompt          = ">> "
+	prompt = ">> "
 )
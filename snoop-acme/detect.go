@@ -0,0 +1,353 @@
+package snoop
+
+// Working out which FileType a file is goes beyond looking at its extension:
+// scripts rarely have one and plenty of files (Makefile, Dockerfile) are only
+// known by name. In order, we look for a vim or emacs modeline naming the type,
+// then the name of the file (FileType patterns and a few well known names),
+// its extension, the interpreter named in its shebang line and finally a
+// handful of cheap heuristics over the start of the file (only for files with
+// no extension). The type name found doesn't need to have a FileType: the
+// filetype route reports it either way.
+//
+// Detection runs on every new, get and put so we only read the start and end
+// of long files. The type found for a window is cached for the routes that ask
+// about it in between, until the window is renamed, loads or writes the file or
+// the file types that apply to it change.
+
+import (
+	jsonenc "encoding/json" // json is the FileType in ftype.go
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sminez/acme-corp/acorp"
+)
+
+// How a file type was detected.
+const (
+	byModeline  = "modeline"
+	byName      = "name"
+	byExtension = "extension"
+	byShebang   = "shebang"
+	byContent   = "content"
+)
+
+const (
+	modelineLines   = 5    // vim checks this many lines at each end of the file
+	heuristicsBytes = 4096 // how much of the file the heuristics look at
+	tailBytes       = 1024 // how much of the end of a long file we look at
+)
+
+// Well known file names and the types that they are.
+var specialNames = map[string]string{
+	"Makefile":      "make",
+	"makefile":      "make",
+	"GNUmakefile":   "make",
+	"mkfile":        "mk",
+	"Dockerfile":    "dockerfile",
+	"Containerfile": "dockerfile",
+	"go.mod":        "gomod",
+	"go.work":       "gomod",
+	"PKGBUILD":      "shell",
+	".bashrc":       "shell",
+	".bash_profile": "shell",
+	".profile":      "shell",
+	".zshrc":        "shell",
+}
+
+// Names used by vim and emacs that differ from ours.
+var modeAliases = map[string]string{
+	"sh":           "shell",
+	"bash":         "shell",
+	"zsh":          "shell",
+	"shell-script": "shell",
+	"python3":      "python",
+	"js":           "javascript",
+	"js2":          "javascript",
+	"golang":       "go",
+	"makefile":     "make",
+}
+
+var (
+	vimModelineRe   = regexp.MustCompile(`(?:^|\s)(?:vi|vim|ex):.*?\b(?:ft|filetype|syn|syntax)=([\w.+-]+)`)
+	emacsModelineRe = regexp.MustCompile(`-\*-\s*(.*?)\s*-\*-`)
+	emacsModeRe     = regexp.MustCompile(`(?i)\bmode:\s*([\w.+-]+)`)
+	versionRe       = regexp.MustCompile(`[\d.]+$`)
+)
+
+// Heuristics for files that give us nothing else to go on, tried in order.
+var contentHeuristics = []struct {
+	name string
+	re   *regexp.Regexp
+}{
+	{"go", regexp.MustCompile(`(?m)^package \w+\s*$`)},
+	{"c", regexp.MustCompile(`(?m)^#include\s*[<"]`)},
+	{"rust", regexp.MustCompile(`(?m)^(use \w+::|fn main\(\)|(pub(\(crate\))? )?(fn|mod|impl) \w)`)},
+	{"python", regexp.MustCompile(`(?m)^(from [\w.]+ import |import [\w.]+\s*$|def \w+\(.*\):|class \w+.*:\s*$)`)},
+	{"shell", regexp.MustCompile(`(?m)^(set -[euxo]+\b|if \[|for \w+ in |\w+\(\) \{|export \w+=)`)},
+}
+
+// detectFileType returns the name of the type of the file name, given its
+// contents (or the sample of them from fileContents), along with how it was
+// detected.
+func detectFileType(fileTypes []FileType, name, contents string) (string, string, bool) {
+	if t, ok := modelineType(contents); ok {
+		return t, byModeline, true
+	}
+
+	for _, ft := range fileTypes {
+		if ft.matchesPattern(name) {
+			return ft.name, byName, true
+		}
+	}
+	if t, ok := specialNames[path.Base(name)]; ok {
+		return t, byName, true
+	}
+
+	for _, ft := range fileTypes {
+		if ft.matchesExtension(name) {
+			return ft.name, byExtension, true
+		}
+	}
+
+	if prog, ok := shebangProg(contents); ok {
+		for _, ft := range fileTypes {
+			if ft.matchesInterpreter(prog) {
+				return ft.name, byShebang, true
+			}
+		}
+	}
+
+	// A file with an extension that we don't know is something else entirely
+	// (a README with some code in it, say) so leave it alone.
+	if path.Ext(name) != "" {
+		return "", "", false
+	}
+	if t, ok := contentType(contents); ok {
+		return t, byContent, true
+	}
+	return "", "", false
+}
+
+// modelineType looks for a vim or emacs modeline in the first or last few
+// lines of contents.
+func modelineType(contents string) (string, bool) {
+	lines := strings.Split(contents, "\n")
+	if len(lines) > 2*modelineLines {
+		lines = append(lines[:modelineLines:modelineLines], lines[len(lines)-modelineLines:]...)
+	}
+
+	for _, line := range lines {
+		if m := vimModelineRe.FindStringSubmatch(line); m != nil {
+			return modeName(m[1]), true
+		}
+		if m := emacsModelineRe.FindStringSubmatch(line); m != nil {
+			// Either '-*- mode: python; ... -*-' or just '-*- python -*-'
+			if mm := emacsModeRe.FindStringSubmatch(m[1]); mm != nil {
+				return modeName(mm[1]), true
+			}
+			if m[1] != "" && !strings.ContainsAny(m[1], ":;") {
+				return modeName(m[1]), true
+			}
+		}
+	}
+	return "", false
+}
+
+func modeName(s string) string {
+	s = strings.TrimSuffix(strings.ToLower(s), "-mode")
+	if t, ok := modeAliases[s]; ok {
+		return t
+	}
+	return s
+}
+
+// shebangProg returns the name of the interpreter in the shebang line of
+// contents (if it has one), looking through env and any flags it is given.
+func shebangProg(contents string) (string, bool) {
+	if !strings.HasPrefix(contents, "#!") {
+		return "", false
+	}
+	line := strings.SplitN(contents[2:], "\n", 2)[0]
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", false
+	}
+
+	prog, args := path.Base(fields[0]), fields[1:]
+	if prog != "env" {
+		return prog, true
+	}
+	for _, arg := range args {
+		// '#!/usr/bin/env -S python3 -u' or '#!/usr/bin/env LANG=C bash'
+		if !strings.HasPrefix(arg, "-") && !strings.Contains(arg, "=") {
+			return path.Base(arg), true
+		}
+	}
+	return "", false
+}
+
+// contentType guesses the type of contents using contentHeuristics. Only files
+// short enough to be read in full can be recognised as JSON.
+func contentType(contents string) (string, bool) {
+	if s := strings.TrimSpace(contents); s != "" && strings.ContainsAny(s[:1], "{[") && jsonenc.Valid([]byte(s)) {
+		return "json", true
+	}
+
+	if len(contents) > heuristicsBytes {
+		contents = contents[:heuristicsBytes]
+	}
+	for _, h := range contentHeuristics {
+		if h.re.MatchString(contents) {
+			return h.name, true
+		}
+	}
+	return "", false
+}
+
+// fileContents returns the contents of the file name from window id if it is
+// open (id >= 0), falling back to the file on disk. Long files are sampled:
+// we return the first heuristicsBytes and the last tailBytes (in runes for a
+// window) separated by a newline. Files that can't be read are treated as
+// empty.
+func fileContents(id int, name string) string {
+	if id >= 0 {
+		if w, err := acorp.OpenWindow(id); err == nil {
+			defer w.CloseFiles()
+			if s, err := windowSample(w); err == nil {
+				return s
+			}
+		}
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil || fi.Size() <= heuristicsBytes+tailBytes {
+		b, _ := ioutil.ReadAll(f)
+		return string(b)
+	}
+
+	head, tail := make([]byte, heuristicsBytes), make([]byte, tailBytes)
+	if _, err = f.ReadAt(head, 0); err != nil {
+		return ""
+	}
+	if _, err = f.ReadAt(tail, fi.Size()-tailBytes); err != nil {
+		return string(head)
+	}
+	return string(head) + "\n" + string(tail)
+}
+
+// windowSample reads the body of w in the same way as fileContents, using the
+// length of the body from the ctl file to avoid reading all of a long one.
+func windowSample(w acorp.Window) (string, error) {
+	ctl, err := w.ReadAll("ctl")
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(ctl))
+	if len(fields) < 3 {
+		return "", fmt.Errorf("malformed ctl file: %q", ctl)
+	}
+	n, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return "", err
+	}
+	if n <= heuristicsBytes+tailBytes {
+		return acorp.WindowBody(w)
+	}
+
+	head, err := acorp.ReadRange(w, 0, heuristicsBytes)
+	if err != nil {
+		return "", err
+	}
+	tail, err := acorp.ReadRange(w, n-tailBytes, n)
+	if err != nil {
+		return "", err
+	}
+	return head.Text + "\n" + tail.Text, nil
+}
+
+type cachedType struct {
+	name     string
+	types    string // detectionKey of the file types used
+	fileType string
+	how      string
+	ok       bool
+}
+
+// A typeCache holds the type detected for each open window, keyed by window id.
+type typeCache struct {
+	mu    sync.Mutex
+	types map[int]cachedType
+}
+
+func newTypeCache() *typeCache {
+	return &typeCache{types: make(map[int]cachedType)}
+}
+
+// detect returns the type of the file name in window id (-1 if it is not
+// open) in the same way as detectFileType. The result for a window is reused
+// for as long as it keeps the same name and file types (and isn't forgotten).
+func (c *typeCache) detect(fileTypes []FileType, id int, name string) (string, string, bool) {
+	if id < 0 {
+		return detectFileType(fileTypes, name, fileContents(id, name))
+	}
+
+	key := detectionKey(fileTypes)
+	c.mu.Lock()
+	ct, ok := c.types[id]
+	c.mu.Unlock()
+	if ok && ct.name == name && ct.types == key {
+		return ct.fileType, ct.how, ct.ok
+	}
+
+	ct = cachedType{name: name, types: key}
+	ct.fileType, ct.how, ct.ok = detectFileType(fileTypes, name, fileContents(id, name))
+
+	c.mu.Lock()
+	c.types[id] = ct
+	c.mu.Unlock()
+	return ct.fileType, ct.how, ct.ok
+}
+
+// detectionKey summarises the parts of fileTypes used by detectFileType so that
+// a change to them (such as an edit to a project config) can be spotted.
+func detectionKey(fileTypes []FileType) string {
+	var b strings.Builder
+	for _, ft := range fileTypes {
+		fmt.Fprintf(&b, "%s:%q:%q:%q;", ft.name, ft.extensions, ft.shebangProgs, ft.patterns)
+	}
+	return b.String()
+}
+
+// forget drops the cached type of window id.
+func (c *typeCache) forget(id int) {
+	c.mu.Lock()
+	delete(c.types, id)
+	c.mu.Unlock()
+}
+
+// clear drops everything that has been cached.
+func (c *typeCache) clear() {
+	c.mu.Lock()
+	c.types = make(map[int]cachedType)
+	c.mu.Unlock()
+}
+
+// follow drops the cached types of windows as they are deleted until sub is
+// closed.
+func (c *typeCache) follow(sub *acorp.Subscription) {
+	for e := range sub.C {
+		c.forget(e.Info.ID)
+	}
+}
@@ -0,0 +1,179 @@
+package snoop
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sminez/acme-corp/acorp"
+)
+
+func TestDetectFileType(t *testing.T) {
+	withPattern := append([]FileType{{name: "make", patterns: []string{"*.mk"}}}, formatableTypes...)
+
+	tests := []struct {
+		name     string
+		contents string
+		fileType string
+		how      string
+	}{
+		{"/src/main.go", "package main\n", "go", byExtension},
+		{"/src/script.py", "", "python", byExtension},
+		{"/src/Makefile", "all:\n", "make", byName},
+		{"/src/rules.mk", "", "make", byName},
+		{"/src/run", "#!/usr/bin/env python3 -u\nprint(1)\n", "python", byShebang},
+		{"/src/run", "#!/bin/bash\necho hi\n", "shell", byShebang},
+		{"/src/thing.txt", "# vim: set ft=python:\n", "python", byModeline},
+		{"/src/main.go", "// -*- mode: rust -*-\n", "rust", byModeline},
+		{"/src/data", "{\"a\": [1, 2]}\n", "json", byContent},
+		{"/src/prog", "#include <stdio.h>\nint main() {}\n", "c", byContent},
+		{"/src/prog", "package thing\n", "go", byContent},
+		{"/src/README.md", "package main\n", "", ""},
+		{"/src/notes", "just some words\n", "", ""},
+	}
+
+	for _, tc := range tests {
+		fileType, how, ok := detectFileType(withPattern, tc.name, tc.contents)
+		if fileType != tc.fileType || how != tc.how || ok != (tc.fileType != "") {
+			t.Errorf("detectFileType(%s, %q) = %q, %q, %v; want %q, %q",
+				tc.name, tc.contents, fileType, how, ok, tc.fileType, tc.how)
+		}
+	}
+}
+
+func TestShebangProg(t *testing.T) {
+	tests := []struct {
+		contents string
+		prog     string
+		ok       bool
+	}{
+		{"#!/bin/sh\n", "sh", true},
+		{"#!/usr/bin/python3 -u\nimport os\n", "python3", true},
+		{"#! /usr/bin/env node\n", "node", true},
+		{"#!/usr/bin/env -S python3 -u\n", "python3", true},
+		{"#!/usr/bin/env LANG=C bash\n", "bash", true},
+		{"#!/usr/bin/env\n", "", false},
+		{"#!\n", "", false},
+		{"# not a shebang\n", "", false},
+		{"", "", false},
+	}
+
+	for _, tc := range tests {
+		if prog, ok := shebangProg(tc.contents); prog != tc.prog || ok != tc.ok {
+			t.Errorf("shebangProg(%q) = %q, %v; want %q, %v", tc.contents, prog, ok, tc.prog, tc.ok)
+		}
+	}
+}
+
+func TestModelineType(t *testing.T) {
+	middle := strings.Repeat("x\n", 2*modelineLines)
+
+	tests := []struct {
+		contents string
+		mode     string
+		ok       bool
+	}{
+		{"# vim: set ft=python:\n", "python", true},
+		{"// vim: filetype=sh\n", "shell", true},
+		{"/* vi: syntax=golang */\n", "go", true},
+		{"#!/bin/sh\n# -*- mode: Python; indent-tabs-mode: nil -*-\n", "python", true},
+		{"; -*- makefile -*-\n", "make", true},
+		{"; -*- js2-mode -*-\n", "javascript", true},
+		{"; -*- coding: utf-8 -*-\n", "", false},
+		{"x\n" + middle + "# vim: ft=rust\n", "rust", true},
+		{"x\n" + middle + "# vim: ft=rust\n" + middle, "", false},
+		{"no modeline here\n", "", false},
+	}
+
+	for _, tc := range tests {
+		if mode, ok := modelineType(tc.contents); mode != tc.mode || ok != tc.ok {
+			t.Errorf("modelineType(%q) = %q, %v; want %q, %v", tc.contents, mode, ok, tc.mode, tc.ok)
+		}
+	}
+}
+
+func TestContentType(t *testing.T) {
+	tests := []struct {
+		contents string
+		fileType string
+	}{
+		{"[1, 2, 3]", "json"},
+		{"  {\"a\": true}\n", "json"},
+		{"{not json", ""},
+		{"package main\n\nfunc main() {}\n", "go"},
+		{"#include \"thing.h\"\n", "c"},
+		{"use std::io;\n", "rust"},
+		{"pub(crate) fn thing() {}\n", "rust"},
+		{"from os import path\n", "python"},
+		{"def main():\n    pass\n", "python"},
+		{"set -eu\necho hi\n", "shell"},
+		{"export PATH=/bin\n", "shell"},
+		{strings.Repeat("\n", heuristicsBytes) + "package main\n", ""},
+		{"hello world\n", ""},
+	}
+
+	for _, tc := range tests {
+		fileType, ok := contentType(tc.contents)
+		if fileType != tc.fileType || ok != (tc.fileType != "") {
+			t.Errorf("contentType(%q) = %q, %v; want %q", tc.contents, fileType, ok, tc.fileType)
+		}
+	}
+}
+
+func TestFileContentsSamplesLongWindows(t *testing.T) {
+	fa := acorp.NewFakeAcme()
+	acorp.UseBackend(fa)
+	defer acorp.UseBackend(nil)
+
+	body := "#!/bin/sh\n" + strings.Repeat("é line\n", 2000) + "# vim: ft=python\n"
+	w := fa.NewWin("/src/run", body)
+	w.Addr("3")
+
+	s := fileContents(w.ID(), "/src/run")
+	if n := len([]rune(s)); n != heuristicsBytes+tailBytes+1 {
+		t.Errorf("sample is %d runes; want %d", n, heuristicsBytes+tailBytes+1)
+	}
+	if !strings.HasPrefix(s, "#!/bin/sh\n") || !strings.HasSuffix(s, "# vim: ft=python\n") {
+		t.Errorf("sample is missing the start or end of the body")
+	}
+	if q0, q1, _ := w.ReadAddr(); q0 != 17 || q1 != 24 {
+		t.Errorf("sampling moved addr to %d,%d", q0, q1)
+	}
+
+	if s := fileContents(fa.NewWin("/src/short", "short\n").ID(), "/src/short"); s != "short\n" {
+		t.Errorf("short body read as %q", s)
+	}
+}
+
+func TestTypeCache(t *testing.T) {
+	fa := acorp.NewFakeAcme()
+	acorp.UseBackend(fa)
+	defer acorp.UseBackend(nil)
+
+	w := fa.NewWin("/src/run", "")
+	c := newTypeCache()
+
+	check := func(fileTypes []FileType, name, want string) {
+		t.Helper()
+		if fileType, _, _ := c.detect(fileTypes, w.ID(), name); fileType != want {
+			t.Errorf("detect(%s) = %q; want %q", name, fileType, want)
+		}
+	}
+
+	check(formatableTypes, "/src/run", "")
+
+	// Cached until forgotten (the snooper forgets on put and get)
+	w.Write("body", []byte("#!/usr/bin/env python3 -u\n"))
+	check(formatableTypes, "/src/run", "")
+	c.forget(w.ID())
+	check(formatableTypes, "/src/run", "python")
+
+	// Renaming the window or changing the file types detects it again
+	check(formatableTypes, "/src/run.sh", "shell")
+	project := []FileType{{name: "script", patterns: []string{"run*"}}}
+	check(project, "/src/run.sh", "script")
+	check(formatableTypes, "/src/run.sh", "shell")
+
+	c.clear()
+	w.Del(true)
+	check(formatableTypes, "/src/run", "")
+}
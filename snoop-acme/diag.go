@@ -0,0 +1,322 @@
+package snoop
+
+// Linters all have their own ideas about how to report problems so rather than
+// passing their output straight through we parse it into Diagnostics. These
+// can then be deduplicated (go vet and golint, or flake8 and pycodestyle, will
+// often spot the same thing) and rendered in a consistent, plumbable
+// 'file:line' form sorted by location. Any output that a parser doesn't
+// recognise is passed through untouched so that nothing is lost.
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A Severity is how serious a Diagnostic is. Lower is more serious.
+type Severity int
+
+// Diagnostic severities.
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+	SeverityInfo
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityError:
+		return "error"
+	case SeverityWarning:
+		return "warning"
+	default:
+		return "info"
+	}
+}
+
+// A Diagnostic is a single problem reported by a Tool. Line and Col count from
+// 1 with 0 meaning unknown.
+type Diagnostic struct {
+	File     string
+	Line     int
+	Col      int
+	Severity Severity
+	Tool     string
+	Message  string
+}
+
+// String renders d as 'file:line: severity: message (tool, col N)' so that it
+// can be plumbed from acme.
+func (d Diagnostic) String() string {
+	source := d.Tool
+	if d.Col > 0 {
+		source = fmt.Sprintf("%s, col %d", d.Tool, d.Col)
+	}
+	return fmt.Sprintf("%s:%d: %s: %s (%s)", d.File, d.Line, d.Severity, d.Message, source)
+}
+
+// A diagnosticParser parses the output of tool when run in dir, returning the
+// Diagnostics it found and any output that it didn't recognise.
+type diagnosticParser func(tool, dir, output string) ([]Diagnostic, string)
+
+var diagnosticParsers = map[string]diagnosticParser{
+	"gcc":        lineParser(gccLine(SeverityError)),
+	"golint":     lineParser(gccLine(SeverityWarning)),
+	"govet":      lineParser(goVetLine),
+	"flake8":     lineParser(flake8Line),
+	"shellcheck": lineParser(gccLine(SeverityWarning)),
+	"jshint":     lineParser(jshintLine),
+	"splint":     parseSplint,
+	"cargo":      parseCargo,
+}
+
+// The parsers used for known tools if one isn't given: anything else is
+// assumed to produce gcc style output.
+var defaultParsers = map[string]string{
+	"go":         "govet",
+	"golint":     "golint",
+	"flake8":     "flake8",
+	"shellcheck": "shellcheck",
+	"jshint":     "jshint",
+	"splint":     "splint",
+	"cargo":      "cargo",
+}
+
+// noParser is the name used in config to pass a Tool's output through as is.
+const noParser = "none"
+
+var (
+	gccRe    = regexp.MustCompile(`^(.+?):(\d+):(?:(\d+):)?\s*(?:(fatal error|error|warning|note|info|style)(?:\[\w+\])?\s*:)?\s*(.*)$`)
+	flake8Re = regexp.MustCompile(`^([A-Z]+)\d+\b`)
+	jshintRe = regexp.MustCompile(`^(.+?): line (\d+), col (\d+), (.*?)(?: \(([EWI])\d+\))?$`)
+	// Summaries ('3 errors') and the package headers printed by go tools
+	ignoredRe = regexp.MustCompile(`^(\d+ (errors?|warnings?)|# \S+)$`)
+	// Progress and summary lines from cargo
+	cargoIgnoredRe = regexp.MustCompile(`^\s*(Checking|Compiling|Blocking|Finished|Updating|Downloaded?)\s|^(warning|error): .*(generated \d+|could not compile|aborting due)`)
+)
+
+// A lineFunc parses a single line of output.
+type lineFunc func(tool, line string) (Diagnostic, bool)
+
+// lineParser builds a diagnosticParser for tools that report one problem per
+// line.
+func lineParser(f lineFunc) diagnosticParser {
+	return func(tool, dir, output string) ([]Diagnostic, string) {
+		var diags []Diagnostic
+		var rest []string
+
+		for _, line := range strings.Split(output, "\n") {
+			line = strings.TrimRight(line, " \t\r")
+			if line == "" || ignoredRe.MatchString(line) {
+				continue
+			}
+			if d, ok := f(tool, line); ok {
+				d.File = resolvePath(dir, d.File)
+				diags = append(diags, d)
+			} else {
+				rest = append(rest, line)
+			}
+		}
+
+		return diags, joinLines(rest)
+	}
+}
+
+func joinLines(lines []string) string {
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// resolvePath makes file absolute so that it can be plumbed from anywhere.
+func resolvePath(dir, file string) string {
+	if filepath.IsAbs(file) || dir == "" {
+		return file
+	}
+	return filepath.Join(dir, file)
+}
+
+// gccLine parses 'file:line[:col]: [severity:] message' lines, which most tools
+// can produce, using def when no severity is given. Lines with no message are
+// context (gcc's 'In file included from a.c:1:') rather than problems.
+func gccLine(def Severity) lineFunc {
+	return func(tool, line string) (Diagnostic, bool) {
+		m := gccRe.FindStringSubmatch(line)
+		if m == nil || m[5] == "" {
+			return Diagnostic{}, false
+		}
+
+		d := Diagnostic{File: m[1], Severity: def, Tool: tool, Message: m[5]}
+		d.Line, _ = strconv.Atoi(m[2])
+		d.Col, _ = strconv.Atoi(m[3])
+		switch m[4] {
+		case "fatal error", "error":
+			d.Severity = SeverityError
+		case "warning":
+			d.Severity = SeverityWarning
+		case "note", "info", "style":
+			d.Severity = SeverityInfo
+		}
+
+		return d, true
+	}
+}
+
+// goVetLine parses go vet output. Problems found by the analysers are warnings
+// but vet also reports code that fails to type check (prefixed by 'vet: ').
+func goVetLine(tool, line string) (Diagnostic, bool) {
+	def := SeverityWarning
+	if strings.HasPrefix(line, "vet: ") {
+		line, def = strings.TrimPrefix(line, "vet: "), SeverityError
+	}
+
+	return gccLine(def)("go vet", line)
+}
+
+// flake8Line parses flake8 output, taking the severity from the error code:
+// pyflakes (F) and pycodestyle errors (E) are errors and the rest warnings.
+func flake8Line(tool, line string) (Diagnostic, bool) {
+	d, ok := gccLine(SeverityWarning)(tool, line)
+	if !ok {
+		return d, false
+	}
+
+	if m := flake8Re.FindStringSubmatch(d.Message); m != nil {
+		switch m[1] {
+		case "F", "E":
+			d.Severity = SeverityError
+		case "W", "C":
+			d.Severity = SeverityWarning
+		default:
+			d.Severity = SeverityInfo
+		}
+	}
+	return d, true
+}
+
+// jshintLine parses the default jshint reporter: 'file: line N, col N, message'
+// with an optional '(W033)' style code when run with --verbose.
+func jshintLine(tool, line string) (Diagnostic, bool) {
+	m := jshintRe.FindStringSubmatch(line)
+	if m == nil {
+		return Diagnostic{}, false
+	}
+
+	d := Diagnostic{File: m[1], Severity: SeverityWarning, Tool: tool, Message: m[4]}
+	d.Line, _ = strconv.Atoi(m[2])
+	d.Col, _ = strconv.Atoi(m[3])
+	switch m[5] {
+	case "E":
+		d.Severity = SeverityError
+	case "I":
+		d.Severity = SeverityInfo
+	}
+	return d, true
+}
+
+// parseSplint parses splint output where each problem is a gcc style line
+// followed by indented lines explaining it, between a version banner and a
+// 'Finished checking' summary.
+func parseSplint(tool, dir, output string) ([]Diagnostic, string) {
+	var diags []Diagnostic
+	var rest []string
+	parse := gccLine(SeverityWarning)
+
+	for _, line := range strings.Split(output, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "", strings.HasPrefix(trimmed, "Splint "), strings.HasPrefix(trimmed, "Finished checking"):
+			continue
+
+		case line != trimmed && len(diags) > 0 && (line[0] == ' ' || line[0] == '\t'):
+			diags[len(diags)-1].Message += " " + trimmed
+			continue
+		}
+
+		if d, ok := parse(tool, trimmed); ok {
+			d.File = resolvePath(dir, d.File)
+			diags = append(diags, d)
+		} else {
+			rest = append(rest, line)
+		}
+	}
+
+	return diags, joinLines(rest)
+}
+
+// parseCargo parses the output of cargo run with '--message-format short',
+// which is gcc style once the progress and summary lines are dropped.
+func parseCargo(tool, dir, output string) ([]Diagnostic, string) {
+	var lines []string
+	for _, line := range strings.Split(output, "\n") {
+		if !cargoIgnoredRe.MatchString(line) {
+			lines = append(lines, line)
+		}
+	}
+	return lineParser(gccLine(SeverityWarning))(tool, dir, strings.Join(lines, "\n"))
+}
+
+// mergeDiagnostics removes duplicate Diagnostics (the same message for the same
+// line) keeping the most severe and noting every tool that reported it, then
+// sorts them by location.
+func mergeDiagnostics(diags []Diagnostic) []Diagnostic {
+	type key struct {
+		file    string
+		line    int
+		message string
+	}
+
+	var merged []Diagnostic
+	seen := make(map[key]int)
+
+	for _, d := range diags {
+		k := key{d.File, d.Line, strings.ToLower(strings.TrimSpace(d.Message))}
+		i, ok := seen[k]
+		if !ok {
+			seen[k] = len(merged)
+			merged = append(merged, d)
+			continue
+		}
+
+		m := &merged[i]
+		if d.Severity < m.Severity {
+			m.Severity = d.Severity
+		}
+		if m.Col == 0 {
+			m.Col = d.Col
+		}
+		if !strings.Contains(", "+m.Tool+", ", ", "+d.Tool+", ") {
+			m.Tool += ", " + d.Tool
+		}
+	}
+
+	sort.SliceStable(merged, func(i, j int) bool {
+		a, b := merged[i], merged[j]
+		switch {
+		case a.File != b.File:
+			return a.File < b.File
+		case a.Line != b.Line:
+			return a.Line < b.Line
+		case a.Col != b.Col:
+			return a.Col < b.Col
+		default:
+			return a.Severity < b.Severity
+		}
+	})
+
+	return merged
+}
+
+// formatDiagnostics renders diags one per line.
+func formatDiagnostics(diags []Diagnostic) string {
+	var b strings.Builder
+	for _, d := range diags {
+		b.WriteString(d.String())
+		b.WriteString("\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,189 @@
+package snoop
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiagnosticParsers(t *testing.T) {
+	tests := []struct {
+		cmd    string // picks the parser as for a Tool with no parser set
+		output string
+		diags  []string
+		rest   string
+	}{
+		{
+			"gcc",
+			`main.c: In function 'main':
+main.c:5:9: warning: unused variable 'x' [-Wunused-variable]
+    5 |     int x;
+      |         ^
+main.c:7:5: error: 'y' undeclared (first use in this function)
+/usr/include/stdio.h:12: note: declared here
+In file included from main.c:1:
+lib.h:3:1: fatal error: missing.h: No such file or directory
+`,
+			[]string{
+				"/src/main.c:5: warning: unused variable 'x' [-Wunused-variable] (gcc, col 9)",
+				"/src/main.c:7: error: 'y' undeclared (first use in this function) (gcc, col 5)",
+				"/usr/include/stdio.h:12: info: declared here (gcc)",
+				"/src/lib.h:3: error: missing.h: No such file or directory (gcc, col 1)",
+			},
+			"main.c: In function 'main':\n    5 |     int x;\n      |         ^\nIn file included from main.c:1:\n",
+		},
+		{
+			"go",
+			`# example.com/thing
+./main.go:9:2: fmt.Printf format %d has arg s of wrong type string
+vet: ./other.go:3:8: undefined: foo
+`,
+			[]string{
+				"/src/main.go:9: warning: fmt.Printf format %d has arg s of wrong type string (go vet, col 2)",
+				"/src/other.go:3: error: undefined: foo (go vet, col 8)",
+			},
+			"",
+		},
+		{
+			"golint",
+			"main.go:5:1: exported function Foo should have comment or be unexported\n",
+			[]string{"/src/main.go:5: warning: exported function Foo should have comment or be unexported (golint, col 1)"},
+			"",
+		},
+		{
+			"flake8",
+			`./app.py:1:1: F401 'os' imported but unused
+./app.py:10:80: E501 line too long (88 > 79 characters)
+./app.py:12:1: W391 blank line at end of file
+./app.py:3:1: C901 'f' is too complex (12)
+./app.py:4:5: N802 function name 'Foo' should be lowercase
+`,
+			[]string{
+				"/src/app.py:1: error: F401 'os' imported but unused (flake8, col 1)",
+				"/src/app.py:10: error: E501 line too long (88 > 79 characters) (flake8, col 80)",
+				"/src/app.py:12: warning: W391 blank line at end of file (flake8, col 1)",
+				"/src/app.py:3: warning: C901 'f' is too complex (12) (flake8, col 1)",
+				"/src/app.py:4: info: N802 function name 'Foo' should be lowercase (flake8, col 5)",
+			},
+			"",
+		},
+		{
+			"shellcheck",
+			`run.sh:3:6: warning: Double quote to prevent globbing and word splitting. [SC2086]
+run.sh:1:1: note: Not following: ./env was not specified as input (see shellcheck -x). [SC1091]
+run.sh:8:1: error: Couldn't parse this if expression. [SC1073]
+`,
+			[]string{
+				"/src/run.sh:3: warning: Double quote to prevent globbing and word splitting. [SC2086] (shellcheck, col 6)",
+				"/src/run.sh:1: info: Not following: ./env was not specified as input (see shellcheck -x). [SC1091] (shellcheck, col 1)",
+				"/src/run.sh:8: error: Couldn't parse this if expression. [SC1073] (shellcheck, col 1)",
+			},
+			"",
+		},
+		{
+			"jshint",
+			`app.js: line 1, col 13, Missing semicolon.
+app.js: line 4, col 5, 'x' is not defined. (W117)
+app.js: line 9, col 1, Unmatched '{'. (E019)
+app.js: line 2, col 1, Use the function form of "use strict". (I001)
+
+4 errors
+`,
+			[]string{
+				"/src/app.js:1: warning: Missing semicolon. (jshint, col 13)",
+				"/src/app.js:4: warning: 'x' is not defined. (jshint, col 5)",
+				"/src/app.js:9: error: Unmatched '{'. (jshint, col 1)",
+				"/src/app.js:2: info: Use the function form of \"use strict\". (jshint, col 1)",
+			},
+			"",
+		},
+		{
+			"splint",
+			`Splint 3.1.2 --- 20 Feb 2018
+
+main.c: (in function main)
+main.c:5:7: Variable x declared but not used
+  A variable is declared but never used. Use /*@unused@*/ in front of
+  declaration to suppress message. (Use -varuse to inhibit warning)
+main.c:9:3: Return value (type int) ignored: printf("hi")
+	Result returned by function call is not used.
+
+Finished checking --- 2 code warnings
+`,
+			[]string{
+				"/src/main.c:5: warning: Variable x declared but not used A variable is declared but never used. Use /*@unused@*/ in front of declaration to suppress message. (Use -varuse to inhibit warning) (splint, col 7)",
+				"/src/main.c:9: warning: Return value (type int) ignored: printf(\"hi\") Result returned by function call is not used. (splint, col 3)",
+			},
+			"main.c: (in function main)\n",
+		},
+		{
+			"cargo",
+			`    Updating crates.io index
+    Checking foo v0.1.0 (/src)
+src/main.rs:2:9: warning: unused variable: ` + "`x`" + `
+src/main.rs:5:5: error[E0425]: cannot find value ` + "`y`" + ` in this scope
+warning: ` + "`foo`" + ` (bin "foo") generated 1 warning
+error: could not compile ` + "`foo`" + ` (bin "foo") due to 1 previous error; 1 warning emitted
+`,
+			[]string{
+				"/src/src/main.rs:2: warning: unused variable: `x` (cargo, col 9)",
+				"/src/src/main.rs:5: error: cannot find value `y` in this scope (cargo, col 5)",
+			},
+			"",
+		},
+		{
+			"mystery-lint",
+			"thing.txt:4: looks odd\nsomething else entirely\n",
+			[]string{"/src/thing.txt:4: error: looks odd (mystery-lint)"},
+			"something else entirely\n",
+		},
+	}
+
+	for _, tc := range tests {
+		tool := Tool{cmd: tc.cmd}
+		diags, rest := diagnosticParsers[tool.parserName()](tc.cmd, "/src", tc.output)
+
+		var got []string
+		for _, d := range diags {
+			got = append(got, d.String())
+		}
+		if strings.Join(got, "\n") != strings.Join(tc.diags, "\n") {
+			t.Errorf("%s parsed:\n%s\nwant:\n%s", tc.cmd, strings.Join(got, "\n"), strings.Join(tc.diags, "\n"))
+		}
+		if rest != tc.rest {
+			t.Errorf("%s left %q; want %q", tc.cmd, rest, tc.rest)
+		}
+	}
+}
+
+func TestMergeDiagnostics(t *testing.T) {
+	diags := []Diagnostic{
+		{File: "/src/b.go", Line: 3, Severity: SeverityWarning, Tool: "golint", Message: "exported function Foo should have comment"},
+		{File: "/src/a.go", Line: 10, Col: 2, Severity: SeverityWarning, Tool: "go vet", Message: "unreachable code"},
+		{File: "/src/a.go", Line: 10, Col: 2, Severity: SeverityInfo, Tool: "go vet", Message: "another problem"},
+		{File: "/src/b.go", Line: 3, Col: 1, Severity: SeverityError, Tool: "staticcheck", Message: "Exported function Foo should have comment "},
+		{File: "/src/a.go", Line: 10, Col: 1, Severity: SeverityWarning, Tool: "go vet", Message: "shadowed err"},
+		{File: "/src/a.go", Line: 2, Severity: SeverityInfo, Tool: "golint", Message: "unreachable code"},
+		{File: "/src/b.go", Line: 3, Severity: SeverityWarning, Tool: "golint", Message: "exported function Foo should have comment"},
+		{File: "/src/a.go", Line: 10, Col: 2, Severity: SeverityError, Tool: "go vet", Message: "unreachable code"},
+	}
+
+	want := []string{
+		"/src/a.go:2: info: unreachable code (golint)",
+		"/src/a.go:10: warning: shadowed err (go vet, col 1)",
+		"/src/a.go:10: error: unreachable code (go vet, col 2)",
+		"/src/a.go:10: info: another problem (go vet, col 2)",
+		"/src/b.go:3: error: exported function Foo should have comment (golint, staticcheck, col 1)",
+	}
+
+	var got []string
+	for _, d := range mergeDiagnostics(diags) {
+		got = append(got, d.String())
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("merged:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	if merged := mergeDiagnostics(nil); len(merged) != 0 {
+		t.Errorf("merged nothing into %v", merged)
+	}
+}
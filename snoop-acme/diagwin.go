@@ -0,0 +1,189 @@
+package snoop
+
+// Rather than appending the problems found on every save to +Errors, where it
+// soon becomes impossible to tell which of them are still current, they are
+// shown in a <dir>/+Diagnostics window for the directory of the file (in the
+// same way that acme names +Errors windows). The window is rewritten after each
+// run to show the current problems for every file in the directory, the tag
+// shows how many there are of each severity and executing Rerun runs the
+// linters again for each of them. Files drop out of the window as they become
+// clean, leaving it empty (rather than deleting it) once everything is clean.
+// Updates come in from the job workers, so the window itself is only written
+// to from its event loop.
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"9fans.net/go/acme"
+	"github.com/sminez/acme-corp/acorp"
+)
+
+const diagnosticsWindowName = "+Diagnostics"
+
+type fileDiagnostics struct {
+	diags  []Diagnostic
+	output string
+}
+
+type diagWindow struct {
+	dir   string
+	w     acorp.Window
+	ef    *acorp.EventFilter
+	cmds  *acorp.TagCommands
+	files map[string]fileDiagnostics
+}
+
+// diagWindows manages the +Diagnostics windows for each directory.
+type diagWindows struct {
+	mu         sync.Mutex
+	windows    map[string]*diagWindow
+	supervisor *acorp.Supervisor
+	rerun      func(name string)
+	errorf     func(format string, args ...interface{})
+}
+
+// newDiagWindows initialises a diagWindows whose event loops are run by s.
+// rerun is called for each file listed in a window when Rerun is executed and
+// errorf is used to report failures to update a window.
+func newDiagWindows(s *acorp.Supervisor, rerun func(name string), errorf func(string, ...interface{})) *diagWindows {
+	return &diagWindows{
+		windows:    make(map[string]*diagWindow),
+		supervisor: s,
+		rerun:      rerun,
+		errorf:     errorf,
+	}
+}
+
+// update replaces what is shown for the file name with the given diagnostics
+// and unparsed output, opening a window for its directory if needed. The
+// window is rewritten on its event loop shortly afterwards.
+func (d *diagWindows) update(name string, diags []Diagnostic, output string) error {
+	dir := filepath.Dir(name)
+	clean := len(diags) == 0 && strings.TrimSpace(output) == ""
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	dw, ok := d.windows[dir]
+	if !ok {
+		if clean {
+			return nil
+		}
+		dw = &diagWindow{dir: dir, files: make(map[string]fileDiagnostics)}
+		d.windows[dir] = dw
+	}
+
+	if clean {
+		delete(dw.files, name)
+	} else {
+		dw.files[name] = fileDiagnostics{diags: diags, output: output}
+	}
+
+	// The window may have been deleted since we last wrote to it
+	if dw.w == nil || !d.running(dw.w.ID()) {
+		if clean && len(dw.files) == 0 {
+			delete(d.windows, dir)
+			return nil
+		}
+		if err := d.open(dw); err != nil {
+			return err
+		}
+	}
+
+	body, status := dw.contents()
+	dw.ef.After(0, func() error {
+		if err := dw.render(body, status); err != nil {
+			d.errorf("%s: %s\n", dw.dir, err)
+		}
+		return nil
+	})
+	return nil
+}
+
+func (d *diagWindows) running(id int) bool {
+	for _, r := range d.supervisor.Running() {
+		if r == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *diagWindows) open(dw *diagWindow) error {
+	w, err := acorp.NewWindow()
+	if err != nil {
+		return err
+	}
+	w.Name(filepath.Join(dw.dir, diagnosticsWindowName))
+
+	dw.w = w
+	dw.cmds = acorp.NewTagCommands(acorp.TagCommand{
+		Name: "Rerun",
+		Help: "run the linters again for every file listed",
+		Exec: func(w acorp.Window, e *acme.Event, arg string) error {
+			d.rerunWindow(dw)
+			return nil
+		},
+	})
+	dw.cmds.WriteTag(w)
+
+	dw.ef = &acorp.EventFilter{}
+	dw.ef.Use(dw.cmds.Middleware)
+	d.supervisor.Go(w, dw.ef)
+	return nil
+}
+
+func (d *diagWindows) rerunWindow(dw *diagWindow) {
+	d.mu.Lock()
+	names := make([]string, 0, len(dw.files))
+	for name := range dw.files {
+		names = append(names, name)
+	}
+	d.mu.Unlock()
+
+	for _, name := range names {
+		d.rerun(name)
+	}
+}
+
+// contents returns the body of the window and the counts for its tag. It must
+// be called with diagWindows.mu held.
+func (dw *diagWindow) contents() (body, status string) {
+	names := make([]string, 0, len(dw.files))
+	for name := range dw.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	counts := make(map[Severity]int)
+	for _, name := range names {
+		fd := dw.files[name]
+		b.WriteString(formatDiagnostics(fd.diags))
+		b.WriteString(fd.output)
+		for _, diag := range fd.diags {
+			counts[diag.Severity]++
+		}
+	}
+
+	status = "clean"
+	if len(names) > 0 {
+		status = fmt.Sprintf("errors:%d warnings:%d info:%d",
+			counts[SeverityError], counts[SeverityWarning], counts[SeverityInfo])
+	}
+	return b.String(), status
+}
+
+// render rewrites the window body and the counts in the tag. It must only be
+// called from the window's event loop.
+func (dw *diagWindow) render(body, status string) error {
+	if err := acorp.ApplyText(dw.w, body); err != nil {
+		return err
+	}
+	dw.w.Ctl("clean")
+	return dw.cmds.SetStatus(status)
+}
@@ -0,0 +1,359 @@
+package snoop
+
+// This file implements a minimal 9P server so that the snooper can be used in
+// the same way as acme itself: the server is posted as a service in the
+// current name space (a unix socket at $NAMESPACE/snoop) so that scripts can
+// run things like '9p read snoop/active' or 'echo on | 9p write snoop/fmt'.
+//
+// The file tree is entirely synthetic: each file has a read function that is
+// called when the file is opened and a write function that is called for each
+// write. Directories may generate their children on demand which is how the
+// per-window directories under 'windows' are kept up to date. Only the parts
+// of the protocol needed for reading and writing existing files are supported.
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"9fans.net/go/plan9"
+	"9fans.net/go/plan9/client"
+)
+
+const (
+	serviceName = "snoop"
+	maxMsgSize  = 8192 + plan9.IOHDRSZ
+)
+
+// An fsNode is a file or directory in the snooper's file tree.
+type fsNode struct {
+	name     string
+	read     func() (string, error)
+	write    func(s string) (string, error)
+	children func() []*fsNode
+}
+
+func (n *fsNode) isDir() bool {
+	return n.children != nil
+}
+
+// qid returns the qid of n when found at the given path.
+func (n *fsNode) qid(path string) plan9.Qid {
+	h := fnv.New64a()
+	h.Write([]byte(path))
+	q := plan9.Qid{Path: h.Sum64(), Type: plan9.QTFILE}
+	if n.isDir() {
+		q.Type = plan9.QTDIR
+	}
+	return q
+}
+
+func (n *fsNode) stat(path string) *plan9.Dir {
+	d := &plan9.Dir{Qid: n.qid(path), Name: n.name, Uid: os.Getenv("USER"), Gid: os.Getenv("USER")}
+	d.Muid = d.Uid
+	switch {
+	case n.isDir():
+		d.Mode = plan9.DMDIR | 0555
+	case n.read != nil && n.write != nil:
+		d.Mode = 0666
+	case n.write != nil:
+		d.Mode = 0222
+	default:
+		d.Mode = 0444
+	}
+	return d
+}
+
+func (n *fsNode) walk(name string) (*fsNode, bool) {
+	if !n.isDir() {
+		return nil, false
+	}
+	for _, c := range n.children() {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// newDir creates a directory whose children are generated by f.
+func newDir(name string, f func() []*fsNode) *fsNode {
+	return &fsNode{name: name, children: f}
+}
+
+// newStaticDir creates a directory with a fixed set of children.
+func newStaticDir(name string, children ...*fsNode) *fsNode {
+	return newDir(name, func() []*fsNode { return children })
+}
+
+// newFile creates a file backed by the given read and write functions, either
+// of which may be nil.
+func newFile(name string, read func() (string, error), write func(s string) (string, error)) *fsNode {
+	return &fsNode{name: name, read: read, write: write}
+}
+
+// A FileServer serves a tree of fsNodes over 9P on a unix socket.
+type FileServer struct {
+	root *fsNode
+	addr string
+	ln   net.Listener
+}
+
+// NewFileServer initialises a FileServer for the given root that will be
+// posted as the snoop service in the current name space.
+func NewFileServer(root *fsNode) *FileServer {
+	root.name = "/"
+	return &FileServer{
+		root: root,
+		addr: filepath.Join(client.Namespace(), serviceName),
+	}
+}
+
+// Serve posts the service and handles incoming connections until Close is
+// called.
+func (s *FileServer) Serve() error {
+	ln, err := listen("unix", s.addr)
+	if err != nil {
+		return err
+	}
+	s.ln = ln
+
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops serving and removes the posted service.
+func (s *FileServer) Close() error {
+	if s.ln == nil {
+		return nil
+	}
+	return s.ln.Close()
+}
+
+type fsFid struct {
+	node    *fsNode
+	parents []*fsNode
+	path    string
+	open    bool
+	data    []byte
+}
+
+type fsConn struct {
+	s     *FileServer
+	fids  map[uint32]*fsFid
+	msize uint32
+}
+
+func (s *FileServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	c := &fsConn{s: s, fids: make(map[uint32]*fsFid), msize: maxMsgSize}
+
+	for {
+		tx, err := plan9.ReadFcall(conn)
+		if err != nil {
+			return
+		}
+
+		rx, err := c.handle(tx)
+		if err != nil {
+			rx = &plan9.Fcall{Type: plan9.Rerror, Ename: err.Error()}
+		}
+		rx.Tag = tx.Tag
+
+		if err = plan9.WriteFcall(conn, rx); err != nil {
+			return
+		}
+	}
+}
+
+func (c *fsConn) handle(tx *plan9.Fcall) (*plan9.Fcall, error) {
+	rx := &plan9.Fcall{Type: tx.Type + 1}
+
+	switch tx.Type {
+	case plan9.Tversion:
+		if tx.Msize < c.msize {
+			c.msize = tx.Msize
+		}
+		rx.Msize, rx.Version = c.msize, plan9.VERSION9P
+		if !strings.HasPrefix(tx.Version, "9P2000") {
+			rx.Version = "unknown"
+		}
+		c.fids = make(map[uint32]*fsFid)
+
+	case plan9.Tauth:
+		return nil, fmt.Errorf("authentication not required")
+
+	case plan9.Tattach:
+		c.fids[tx.Fid] = &fsFid{node: c.s.root, path: "/"}
+		rx.Qid = c.s.root.qid("/")
+
+	case plan9.Tflush:
+
+	case plan9.Twalk:
+		f, ok := c.fids[tx.Fid]
+		if !ok || f.open {
+			return nil, fmt.Errorf("bad fid")
+		}
+		nf := &fsFid{node: f.node, parents: append([]*fsNode{}, f.parents...), path: f.path}
+		for _, name := range tx.Wname {
+			if !nf.walk(name) {
+				if len(rx.Wqid) == 0 {
+					return nil, fmt.Errorf("file does not exist")
+				}
+				return rx, nil
+			}
+			rx.Wqid = append(rx.Wqid, nf.node.qid(nf.path))
+		}
+		c.fids[tx.Newfid] = nf
+
+	case plan9.Topen:
+		f, ok := c.fids[tx.Fid]
+		if !ok || f.open {
+			return nil, fmt.Errorf("bad fid")
+		}
+		if err := checkMode(f.node, tx.Mode); err != nil {
+			return nil, err
+		}
+		if f.node.isDir() {
+			f.data = dirData(f.node, f.path)
+		} else if f.node.read != nil && tx.Mode&3 != plan9.OWRITE {
+			s, err := f.node.read()
+			if err != nil {
+				return nil, err
+			}
+			f.data = []byte(s)
+		}
+		f.open = true
+		rx.Qid = f.node.qid(f.path)
+		rx.Iounit = c.msize - plan9.IOHDRSZ
+
+	case plan9.Tread:
+		f, ok := c.fids[tx.Fid]
+		if !ok || !f.open {
+			return nil, fmt.Errorf("bad fid")
+		}
+		rx.Data = c.readData(f, tx.Offset, tx.Count)
+
+	case plan9.Twrite:
+		f, ok := c.fids[tx.Fid]
+		if !ok || !f.open || f.node.write == nil {
+			return nil, fmt.Errorf("permission denied")
+		}
+		resp, err := f.node.write(string(tx.Data))
+		if err != nil {
+			return nil, err
+		}
+		// The response (if any) can be read back on the same fid.
+		f.data = []byte(resp)
+		rx.Count = uint32(len(tx.Data))
+
+	case plan9.Tclunk:
+		delete(c.fids, tx.Fid)
+
+	case plan9.Tstat:
+		f, ok := c.fids[tx.Fid]
+		if !ok {
+			return nil, fmt.Errorf("bad fid")
+		}
+		b, err := f.node.stat(f.path).Bytes()
+		if err != nil {
+			return nil, err
+		}
+		rx.Stat = b
+
+	default:
+		return nil, fmt.Errorf("permission denied")
+	}
+
+	return rx, nil
+}
+
+// walk moves f to the named child of its current node.
+func (f *fsFid) walk(name string) bool {
+	if name == ".." {
+		if len(f.parents) > 0 {
+			f.node = f.parents[len(f.parents)-1]
+			f.parents = f.parents[:len(f.parents)-1]
+			f.path = path.Dir(f.path)
+		}
+		return true
+	}
+
+	next, ok := f.node.walk(name)
+	if ok {
+		f.parents = append(f.parents, f.node)
+		f.node = next
+		f.path = path.Join(f.path, name)
+	}
+	return ok
+}
+
+func checkMode(n *fsNode, mode uint8) error {
+	switch mode & 3 {
+	case plan9.OREAD, plan9.OEXEC:
+		if n.read == nil && !n.isDir() {
+			return fmt.Errorf("permission denied")
+		}
+	case plan9.OWRITE:
+		if n.write == nil {
+			return fmt.Errorf("permission denied")
+		}
+	case plan9.ORDWR:
+		if n.write == nil || (n.read == nil && !n.isDir()) {
+			return fmt.Errorf("permission denied")
+		}
+	}
+	return nil
+}
+
+// dirData returns the packed directory entries for n found at dir.
+func dirData(n *fsNode, dir string) []byte {
+	var data []byte
+	for _, child := range n.children() {
+		if b, err := child.stat(path.Join(dir, child.name)).Bytes(); err == nil {
+			data = append(data, b...)
+		}
+	}
+	return data
+}
+
+// readData returns up to count bytes of f's data from offset. Directory reads
+// only ever return whole entries.
+func (c *fsConn) readData(f *fsFid, offset uint64, count uint32) []byte {
+	if offset >= uint64(len(f.data)) {
+		return nil
+	}
+	if max := c.msize - plan9.IOHDRSZ; count > max {
+		count = max
+	}
+	data := f.data[offset:]
+
+	if !f.node.isDir() {
+		if uint64(len(data)) > uint64(count) {
+			data = data[:count]
+		}
+		return data
+	}
+
+	n := 0
+	for n+2 <= len(data) {
+		size := int(data[n]) | int(data[n+1])<<8 + 2
+		if n+size > int(count) {
+			break
+		}
+		n += size
+	}
+	return data[:n]
+}
@@ -0,0 +1,372 @@
+package snoop
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"9fans.net/go/plan9"
+	"9fans.net/go/plan9/client"
+	"github.com/sminez/acme-corp/acorp"
+)
+
+// newTestSnooper returns a snooper for the windows in fa, logging to a fake
+// +snoop window and keeping its config under a temporary $HOME.
+func newTestSnooper(t *testing.T, fa *acorp.FakeAcme) *AcmeSnooper {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	acorp.UseBackend(fa)
+	t.Cleanup(func() { acorp.UseBackend(nil) })
+
+	registry, err := acorp.NewRegistry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { registry.Close() })
+
+	a := &AcmeSnooper{
+		win:          acorp.NewFakeWin(0, "+snoop", ""),
+		listener:     NewListener("unix:" + filepath.Join(home, "snooper")),
+		registry:     registry,
+		history:      &focusHistory{},
+		types:        newTypeCache(),
+		jobs:         newJobQueue(1),
+		fileTypes:    formatableTypes,
+		configSource: builtinConfig,
+	}
+	t.Cleanup(a.jobs.close)
+	if a.toggles, err = loadToggles(togglesPath()); err != nil {
+		t.Fatal(err)
+	}
+	a.listener.Register("echo", "text: the text", func(s string) (string, error) { return s, nil })
+	return a
+}
+
+// serveTestFiles serves the file tree for a on a temporary unix socket,
+// returning its address.
+func serveTestFiles(t *testing.T, a *AcmeSnooper) string {
+	t.Helper()
+	s := NewFileServer(a.fileTree())
+	s.addr = filepath.Join(t.TempDir(), serviceName)
+
+	done := make(chan error, 1)
+	go func() { done <- s.Serve() }()
+	for i := 0; ; i++ {
+		conn, err := net.Dial("unix", s.addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if i == 100 {
+			t.Fatalf("file server never came up: %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Cleanup(func() {
+		s.Close()
+		<-done
+	})
+	return s.addr
+}
+
+// mountTest attaches to the file server at addr.
+func mountTest(t *testing.T, addr string) *client.Fsys {
+	t.Helper()
+	fsys, err := client.Mount("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys
+}
+
+func readFile(fsys *client.Fsys, name string) (string, error) {
+	fid, err := fsys.Open(name, plan9.OREAD)
+	if err != nil {
+		return "", err
+	}
+	defer fid.Close()
+	b, err := ioutil.ReadAll(fid)
+	return string(b), err
+}
+
+// writeFile writes s to name and returns whatever can then be read back.
+func writeFile(fsys *client.Fsys, name, s string) (string, error) {
+	fid, err := fsys.Open(name, plan9.ORDWR)
+	if err != nil {
+		return "", err
+	}
+	defer fid.Close()
+	if _, err = fid.Write([]byte(s)); err != nil {
+		return "", err
+	}
+	b, err := ioutil.ReadAll(fid)
+	return string(b), err
+}
+
+func TestFileServerRead(t *testing.T) {
+	fa := acorp.NewFakeAcme()
+	fa.NewWin("/src/main.go", "package main\n")
+	w := fa.NewWin("/src/notes", "")
+	a := newTestSnooper(t, fa)
+	fsys := mountTest(t, serveTestFiles(t, a))
+
+	w.Write("body", []byte("dirty"))
+	fa.Focus(w.ID())
+	for deadline := time.Now().Add(time.Second); ; {
+		if _, ok := a.registry.Focused(); ok || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	tests := []struct {
+		name     string
+		contents string
+	}{
+		{"active", "2\n"},
+		{"fmt", "off\n"},
+		{"lint", "off\n"},
+		{"history", ""},
+		{"ctl", strings.Join(a.listener.Routes(), "\n") + "\n"},
+		{"windows/1/name", "/src/main.go\n"},
+		{"windows/1/dirty", "0\n"},
+		{"windows/2/dirty", "1\n"},
+		{"windows/2/tag", "/src/notes " + strings.SplitN(w.Tag(), " ", 2)[1] + "\n"},
+		{"windows/../windows/2/name", "/src/notes\n"},
+	}
+
+	for _, tc := range tests {
+		if s, err := readFile(fsys, tc.name); err != nil || s != tc.contents {
+			t.Errorf("read %s = %q, %v; want %q", tc.name, s, err, tc.contents)
+		}
+	}
+
+	if _, err := readFile(fsys, "windows/3/name"); err == nil {
+		t.Errorf("read of a window that doesn't exist succeeded")
+	}
+}
+
+func TestFileServerWrite(t *testing.T) {
+	fa := acorp.NewFakeAcme()
+	fa.NewWin("/src/main.go", "")
+	a := newTestSnooper(t, fa)
+	fsys := mountTest(t, serveTestFiles(t, a))
+
+	tests := []struct {
+		name  string
+		data  string
+		reply string
+		err   string
+	}{
+		{"ctl", "echo / hello", "hello", ""},
+		{"ctl", "nope / x", "", "not a known handler"},
+		{"ctl", "no slash", "", "Invalid message"},
+		{"fmt", "on", "on", ""},
+		{"fmt", "sideways", "", "not a valid fmt directive"},
+		{"lint", "status", "global\t\ton\n", ""}, // following fmt
+		{"active", "1", "", "permission denied"},
+		{"jobs", "x", "", "permission denied"},
+		{"windows/1/name", "/src/other.go", "", "permission denied"},
+		{"windows", "x", "", "permission denied"},
+	}
+
+	for _, tc := range tests {
+		reply, err := writeFile(fsys, tc.name, tc.data)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("write %q to %s: got error %v; want %q", tc.data, tc.name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || reply != tc.reply {
+			t.Errorf("write %q to %s = %q, %v; want %q", tc.data, tc.name, reply, err, tc.reply)
+		}
+	}
+
+	if s, err := readFile(fsys, "fmt"); err != nil || s != "on\n" {
+		t.Errorf("fmt after writing on = %q, %v", s, err)
+	}
+}
+
+func TestFileServerDirectories(t *testing.T) {
+	fa := acorp.NewFakeAcme()
+	fa.NewWin("/src/main.go", "")
+	fa.NewWin("/src/notes", "")
+	a := newTestSnooper(t, fa)
+	fsys := mountTest(t, serveTestFiles(t, a))
+
+	tests := []struct {
+		dir     string
+		entries string
+	}{
+		{"/", "active:0444 history:0444 jobs:0444 fmt:0666 lint:0666 ctl:0666 windows:d555"},
+		{"windows", "1:d555 2:d555"},
+		{"windows/2", "name:0444 tag:0444 dirty:0444"},
+	}
+
+	for _, tc := range tests {
+		fid, err := fsys.Open(tc.dir, plan9.OREAD)
+		if err != nil {
+			t.Errorf("open %s: %s", tc.dir, err)
+			continue
+		}
+		dirs, err := fid.Dirreadall()
+		fid.Close()
+
+		var entries []string
+		for _, d := range dirs {
+			mode := fmt.Sprintf("%04o", d.Mode&0777)
+			if d.Mode&plan9.DMDIR != 0 {
+				mode = "d" + mode[1:]
+			}
+			entries = append(entries, d.Name+":"+mode)
+		}
+		if got := strings.Join(entries, " "); err != nil || got != tc.entries {
+			t.Errorf("read %s = %q, %v; want %q", tc.dir, got, err, tc.entries)
+		}
+	}
+
+	if d, err := fsys.Stat("windows/1/name"); err != nil || d.Name != "name" || d.Qid.Type != plan9.QTFILE {
+		t.Errorf("stat windows/1/name = %+v, %v", d, err)
+	}
+	if d, err := fsys.Stat("windows"); err != nil || d.Qid.Type != plan9.QTDIR {
+		t.Errorf("stat windows = %+v, %v", d, err)
+	}
+}
+
+// A rawConn speaks 9P directly, for the parts of the protocol that the client
+// package hides.
+type rawConn struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func dialRaw(t *testing.T, addr string) *rawConn {
+	t.Helper()
+	conn, err := net.Dial("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	c := &rawConn{t: t, conn: conn}
+	c.rpc(&plan9.Fcall{Type: plan9.Tversion, Msize: maxMsgSize, Version: plan9.VERSION9P})
+	c.rpc(&plan9.Fcall{Type: plan9.Tattach, Fid: 0, Afid: plan9.NOFID, Uname: "test"})
+	return c
+}
+
+func (c *rawConn) rpc(tx *plan9.Fcall) *plan9.Fcall {
+	c.t.Helper()
+	tx.Tag = 1
+	if err := plan9.WriteFcall(c.conn, tx); err != nil {
+		c.t.Fatal(err)
+	}
+	rx, err := plan9.ReadFcall(c.conn)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if rx.Type != plan9.Rerror && rx.Type != tx.Type+1 {
+		c.t.Fatalf("%s got %s", tx, rx)
+	}
+	return rx
+}
+
+func TestFileServerWalk(t *testing.T) {
+	fa := acorp.NewFakeAcme()
+	fa.NewWin("/src/main.go", "")
+	a := newTestSnooper(t, fa)
+	c := dialRaw(t, serveTestFiles(t, a))
+
+	tests := []struct {
+		wname []string
+		qids  int // walked; -1 for an error
+	}{
+		{nil, 0},
+		{[]string{"active"}, 1},
+		{[]string{"windows", "1", "name"}, 3},
+		{[]string{"windows", "1", ".."}, 3},
+		{[]string{"..", "ctl"}, 2},
+		{[]string{"windows", "9", "name"}, 1}, // partial walks stop at the first missing name
+		{[]string{"windows", "1", "nope"}, 2},
+		{[]string{"active", "nope"}, 1},
+		{[]string{"nope"}, -1},
+	}
+
+	for i, tc := range tests {
+		newfid := uint32(100 + i)
+		rx := c.rpc(&plan9.Fcall{Type: plan9.Twalk, Fid: 0, Newfid: newfid, Wname: tc.wname})
+		switch {
+		case tc.qids < 0:
+			if rx.Type != plan9.Rerror {
+				t.Errorf("walk %q = %s; want an error", tc.wname, rx)
+			}
+			continue
+		case rx.Type == plan9.Rerror || len(rx.Wqid) != tc.qids:
+			t.Errorf("walk %q = %s; want %d qids", tc.wname, rx, tc.qids)
+			continue
+		}
+
+		// Only a complete walk sets up newfid
+		rx = c.rpc(&plan9.Fcall{Type: plan9.Tstat, Fid: newfid})
+		if complete := tc.qids == len(tc.wname); complete != (rx.Type == plan9.Rstat) {
+			t.Errorf("walk %q: stat of newfid = %s", tc.wname, rx)
+		}
+	}
+
+	// Open fids can't be walked, and only open fids can be read or written
+	c.rpc(&plan9.Fcall{Type: plan9.Twalk, Fid: 0, Newfid: 1, Wname: []string{"active"}})
+	if rx := c.rpc(&plan9.Fcall{Type: plan9.Tread, Fid: 1, Count: 100}); rx.Type != plan9.Rerror {
+		t.Errorf("read of unopened fid = %s", rx)
+	}
+	c.rpc(&plan9.Fcall{Type: plan9.Topen, Fid: 1, Mode: plan9.OREAD})
+	if rx := c.rpc(&plan9.Fcall{Type: plan9.Twalk, Fid: 1, Newfid: 2}); rx.Type != plan9.Rerror {
+		t.Errorf("walk of open fid = %s", rx)
+	}
+	if rx := c.rpc(&plan9.Fcall{Type: plan9.Twrite, Fid: 1, Data: []byte("2")}); rx.Type != plan9.Rerror {
+		t.Errorf("write to read only file = %s", rx)
+	}
+	if rx := c.rpc(&plan9.Fcall{Type: plan9.Tread, Fid: 1, Count: 100}); string(rx.Data) != "-1\n" {
+		t.Errorf("read active = %s", rx)
+	}
+	c.rpc(&plan9.Fcall{Type: plan9.Tclunk, Fid: 1})
+	if rx := c.rpc(&plan9.Fcall{Type: plan9.Tread, Fid: 1, Count: 100}); rx.Type != plan9.Rerror {
+		t.Errorf("read of clunked fid = %s", rx)
+	}
+}
+
+func TestFileServerDirectoryReads(t *testing.T) {
+	fa := acorp.NewFakeAcme()
+	a := newTestSnooper(t, fa)
+	c := dialRaw(t, serveTestFiles(t, a))
+
+	c.rpc(&plan9.Fcall{Type: plan9.Twalk, Fid: 0, Newfid: 1})
+	c.rpc(&plan9.Fcall{Type: plan9.Topen, Fid: 1, Mode: plan9.OREAD})
+
+	// Reads only ever return whole entries, however small the count
+	var names []string
+	for offset := uint64(0); ; {
+		rx := c.rpc(&plan9.Fcall{Type: plan9.Tread, Fid: 1, Offset: offset, Count: 80})
+		if len(rx.Data) == 0 {
+			break
+		}
+		d, err := plan9.UnmarshalDir(rx.Data)
+		if err != nil {
+			t.Fatalf("read at %d: %s", offset, err)
+		}
+		names = append(names, d.Name)
+		offset += uint64(len(rx.Data))
+	}
+	if got := strings.Join(names, " "); got != "active history jobs fmt lint ctl windows" {
+		t.Errorf("read entries %q", got)
+	}
+
+	if rx := c.rpc(&plan9.Fcall{Type: plan9.Tread, Fid: 1, Count: 10}); len(rx.Data) != 0 {
+		t.Errorf("read smaller than an entry returned %q", rx.Data)
+	}
+}
@@ -1,93 +1,82 @@
 package snoop
 
-import (
-	"regexp"
-	"strings"
-)
-
+// The built in file types: these can be replaced or added to in the config
+// file (see config.go).
 var formatableTypes = []FileType{
 	golang, python, shell, rust, c, javascript, json,
 }
 
 var golang = FileType{
+	name:       "go",
 	extensions: []string{"go"},
 	Tools: []Tool{
-		Tool{cmd: "goimports", args: []string{"-w"}, appendFilePath: true},
-		Tool{cmd: "golint", appendDirPath: true},
-		Tool{cmd: "go", args: []string{"vet"}, appendDirPath: true},
+		// The file name is only used to resolve imports: the source is read from stdin
+		Tool{cmd: "goimports", args: []string{"-srcdir", "{file}"}, stdin: true},
+		Tool{cmd: "golint", args: []string{"{target}"}, target: targetDir},
+		Tool{cmd: "go", args: []string{"vet", "{pkg}"}},
 	},
 }
 
 var python = FileType{
+	name:         "python",
 	extensions:   []string{"py", "pyw"},
 	shebangProgs: []string{"python", "python3"},
 	Tools: []Tool{
-		Tool{
-			cmd:            "isort",
-			args:           []string{"-m", "5"},
-			ignoreOutput:   true,
-			appendFilePath: true,
-		},
-		Tool{cmd: "black", args: []string{"-q", "--line-length", "100"}, appendFilePath: true},
+		Tool{cmd: "isort", args: []string{"-m", "5", "-"}, stdin: true},
+		Tool{cmd: "black", args: []string{"-q", "--line-length", "100", "-"}, stdin: true},
 		// Black is pep8 compliant but flake8 is not...
-		Tool{cmd: "flake8", args: []string{"--ignore=E203,E501,W503"}, appendFilePath: true},
+		Tool{cmd: "flake8", args: []string{"--ignore=E203,E501,W503", "{file}"}},
 	},
 }
 
 var rust = FileType{
+	name:       "rust",
 	extensions: []string{"rs"},
 	Tools: []Tool{
-		Tool{cmd: "cargo", args: []string{"fmt", "--"}, appendFilePath: true},
-		// Tool{cmd: "cargo", args: []string{"check"}},
-		// Tool{cmd: "cargo", args: []string{"clippy"}},
+		Tool{cmd: "rustfmt", args: []string{"--edition", "{edition}"}, stdin: true},
+		// Swap check for clippy if you have it installed
+		Tool{cmd: "cargo", args: []string{"check", "--message-format", "short"}, target: targetRoot},
 	},
 }
 
 var shell = FileType{
+	name:         "shell",
 	extensions:   []string{"sh", "bash", "zsh"},
 	shebangProgs: []string{"bash", "sh", "zsh"},
 	Tools: []Tool{
 		// Remove trailing whitespace and whitespace only lines
-		//Tool{cmd: "sed", args: []string{"-i", "s/[[:blank:]]*$//g"}, appendFilePath: true},
-		Tool{cmd: "shellcheck", args: []string{"-f", "gcc"}, appendFilePath: true},
+		//Tool{cmd: "sed", args: []string{"-i", "s/[[:blank:]]*$//g", "{file}"}, inPlace: true},
+		Tool{cmd: "shellcheck", args: []string{"-f", "gcc", "{file}"}},
 	},
 }
 
 var javascript = FileType{
+	name:         "javascript",
 	extensions:   []string{"js"},
 	shebangProgs: []string{"node"},
 	Tools: []Tool{
-		Tool{cmd: "js-beautify", args: []string{"-r"}, appendFilePath: true},
-		Tool{
-			cmd:            "jshint",
-			appendFilePath: true,
-			outputFixer: func(s string) string {
-				// Convert to button3 friendly output
-				s = strings.Replace(s, " line ", "", -1)
-				// Remove the column number as it just adds line noise
-				re := regexp.MustCompile(", col .*,")
-				return re.ReplaceAllString(s, " ->")
-			},
-		},
+		Tool{cmd: "js-beautify", args: []string{"-"}, stdin: true},
+		Tool{cmd: "jshint", args: []string{"{file}"}},
 	},
 }
 
 var json = FileType{
+	name:       "json",
 	extensions: []string{"json"},
-	Tools:      []Tool{Tool{cmd: "json-format", appendFilePath: true}},
+	Tools:      []Tool{Tool{cmd: "json-format", args: []string{"{file}"}, inPlace: true}},
 }
 
 var c = FileType{
+	name:       "c",
 	extensions: []string{"c", "h"},
 	Tools: []Tool{
-		Tool{cmd: "c-astyle", appendFilePath: true},
+		Tool{cmd: "c-astyle", stdin: true},
 		Tool{
 			cmd: "splint",
 			args: []string{
 				"+charintliteral", "+charint", "-exportlocal", "-compdef",
-				"-usedef", "-retvalint", "+relaxtypes",
+				"-usedef", "-retvalint", "+relaxtypes", "{file}",
 			},
-			appendFilePath: true,
 		},
 	},
 }
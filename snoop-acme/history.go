@@ -0,0 +1,157 @@
+package snoop
+
+// The snooper keeps a most recently used stack of the windows that have had
+// focus so that we can jump back to the previous window, or pick one of the
+// windows we have been working in, in the same way as alt-tab. Acme only logs
+// focus changes when the mouse enters a window so windows that we switch to
+// ourselves are moved to the top of the stack straight away.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sminez/acme-corp/acorp"
+)
+
+// A focusEntry records when a window last had focus.
+type focusEntry struct {
+	id      int
+	name    string
+	focused time.Time
+}
+
+// A focusHistory is a most recently used stack of focused windows.
+type focusHistory struct {
+	mu      sync.Mutex
+	entries []focusEntry // most recent first
+}
+
+// touch moves the window to the top of the stack.
+func (h *focusHistory) touch(id int, name string, t time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries = append([]focusEntry{{id: id, name: name, focused: t}}, h.without(id)...)
+}
+
+// remove drops a window that has been deleted.
+func (h *focusHistory) remove(id int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries = h.without(id)
+}
+
+// rename updates the name of a window without changing its position.
+func (h *focusHistory) rename(id int, name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := range h.entries {
+		if h.entries[i].id == id {
+			h.entries[i].name = name
+		}
+	}
+}
+
+func (h *focusHistory) without(id int) []focusEntry {
+	entries := make([]focusEntry, 0, len(h.entries))
+	for _, e := range h.entries {
+		if e.id != id {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// list returns up to n entries (all of them if n <= 0), most recent first.
+func (h *focusHistory) list(n int) []focusEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if n <= 0 || n > len(h.entries) {
+		n = len(h.entries)
+	}
+	return append([]focusEntry{}, h.entries[:n]...)
+}
+
+// previous returns the window that had focus before the current one.
+func (h *focusHistory) previous() (focusEntry, bool) {
+	entries := h.list(2)
+	if len(entries) < 2 {
+		return focusEntry{}, false
+	}
+	return entries[1], true
+}
+
+// follow updates the history from registry events until sub is closed.
+func (h *focusHistory) follow(sub *acorp.Subscription) {
+	for e := range sub.C {
+		switch e.Op {
+		case acorp.OpFocus:
+			h.touch(e.Info.ID, e.Info.Name, e.Info.Focused)
+		case acorp.OpDel:
+			h.remove(e.Info.ID)
+		default:
+			h.rename(e.Info.ID, e.Info.Name)
+		}
+	}
+}
+
+func (a *AcmeSnooper) previousHandler(s string) (string, error) {
+	if e, ok := a.history.previous(); ok {
+		return fmt.Sprintf("%d", e.id), nil
+	}
+	return "-1", nil
+}
+
+// historyHandler lists the most recently focused windows, one per line, as
+// '<id>\t<time focused (RFC3339)>\t<name>'.
+func (a *AcmeSnooper) historyHandler(s string) (string, error) {
+	n := 0
+	if s != "" && s != "." {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 0 {
+			return "", fmt.Errorf("'%s' is not a valid number of windows", s)
+		}
+	}
+
+	var b strings.Builder
+	for _, e := range a.history.list(n) {
+		fmt.Fprintf(&b, "%d\t%s\t%s\n", e.id, e.focused.Format(time.RFC3339), e.name)
+	}
+	return b.String(), nil
+}
+
+// switchHandler brings a window into view given its id or name, or the
+// previous window if none is given.
+func (a *AcmeSnooper) switchHandler(s string) (string, error) {
+	var wi acorp.WindowInfo
+	var ok bool
+
+	switch id, err := strconv.Atoi(s); {
+	case s == "" || s == ".":
+		var e focusEntry
+		if e, ok = a.history.previous(); ok {
+			wi, ok = a.registry.Window(e.id)
+		}
+	case err == nil:
+		wi, ok = a.registry.Window(id)
+	default:
+		wi, ok = a.registry.Lookup(s)
+	}
+	if !ok {
+		return "", fmt.Errorf("no window to switch to for '%s'", s)
+	}
+
+	w, err := acorp.OpenWindow(wi.ID)
+	if err != nil {
+		return "", err
+	}
+	defer w.CloseFiles()
+	if err = w.Ctl("show"); err != nil {
+		return "", err
+	}
+
+	a.history.touch(wi.ID, wi.Name, time.Now())
+	return fmt.Sprintf("%d", wi.ID), nil
+}
@@ -0,0 +1,214 @@
+package snoop
+
+// Tools are run for written files on a small pool of workers so that a slow
+// linter can't hold up the rest of the snooper. Jobs for the same file are run
+// one at a time and a job that is still queued or running when the file is
+// written (or checked) again is cancelled, killing any tool that it is running,
+// as its results would be out of date by the time it finished. Recently
+// finished jobs are kept around for the jobs route.
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	jobWorkers = 4
+	jobHistory = 20
+)
+
+// Job states.
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobCancelled = "cancelled"
+)
+
+// A job is a run of the tools for a single write or check of a file.
+type job struct {
+	id       int
+	name     string
+	desc     string
+	state    string
+	queued   time.Time
+	started  time.Time
+	finished time.Time
+	ctx      context.Context
+	cancel   context.CancelFunc
+	run      func(ctx context.Context)
+}
+
+func (j *job) duration(now time.Time) time.Duration {
+	switch {
+	case j.started.IsZero():
+		return 0
+	case j.finished.IsZero():
+		return now.Sub(j.started)
+	default:
+		return j.finished.Sub(j.started)
+	}
+}
+
+// A jobQueue runs jobs on a fixed pool of workers.
+type jobQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	nextID  int
+	ready   []*job
+	running map[string]*job // by file name
+	pending map[string]*job // by file name: waiting for the running job to finish
+	recent  []*job          // most recent first
+	closed  bool
+}
+
+func newJobQueue(workers int) *jobQueue {
+	q := &jobQueue{
+		running: make(map[string]*job),
+		pending: make(map[string]*job),
+	}
+	q.cond = sync.NewCond(&q.mu)
+
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// submit queues run for the file name, cancelling any job for the file that
+// is still queued or running.
+func (q *jobQueue) submit(name, desc string, run func(ctx context.Context)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+
+	q.nextID++
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{
+		id:     q.nextID,
+		name:   name,
+		desc:   desc,
+		state:  jobQueued,
+		queued: time.Now(),
+		ctx:    ctx,
+		cancel: cancel,
+		run:    run,
+	}
+
+	if p, ok := q.pending[name]; ok {
+		delete(q.pending, name)
+		q.finish(p, jobCancelled)
+	}
+	for i, r := range q.ready {
+		if r.name == name {
+			q.ready = append(q.ready[:i], q.ready[i+1:]...)
+			q.finish(r, jobCancelled)
+			break
+		}
+	}
+
+	if r, ok := q.running[name]; ok {
+		r.cancel()
+		q.pending[name] = j
+		return
+	}
+
+	q.ready = append(q.ready, j)
+	q.cond.Signal()
+}
+
+func (q *jobQueue) work() {
+	for {
+		q.mu.Lock()
+		for len(q.ready) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if q.closed {
+			q.mu.Unlock()
+			return
+		}
+		j := q.ready[0]
+		q.ready = q.ready[1:]
+		j.state, j.started = jobRunning, time.Now()
+		q.running[j.name] = j
+		q.mu.Unlock()
+
+		j.run(j.ctx)
+
+		q.mu.Lock()
+		state := jobDone
+		if j.ctx.Err() != nil {
+			state = jobCancelled
+		}
+		delete(q.running, j.name)
+		q.finish(j, state)
+
+		if p, ok := q.pending[j.name]; ok {
+			delete(q.pending, j.name)
+			q.ready = append(q.ready, p)
+			q.cond.Signal()
+		}
+		q.mu.Unlock()
+	}
+}
+
+// finish records that j is no longer queued or running. q.mu must be held.
+func (q *jobQueue) finish(j *job, state string) {
+	j.cancel()
+	j.state, j.finished = state, time.Now()
+
+	q.recent = append([]*job{j}, q.recent...)
+	if len(q.recent) > jobHistory {
+		q.recent = q.recent[:jobHistory]
+	}
+}
+
+// list describes the running and queued jobs followed by those that have
+// recently finished, one per line as '<id>\t<state>\t<duration>\t<file> (<desc>)'.
+func (q *jobQueue) list() string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var active []*job
+	for _, j := range q.running {
+		active = append(active, j)
+	}
+	for _, j := range q.pending {
+		active = append(active, j)
+	}
+	active = append(active, q.ready...)
+	sort.Slice(active, func(i, j int) bool { return active[i].id < active[j].id })
+
+	var b strings.Builder
+	now := time.Now()
+	for _, j := range append(active, q.recent...) {
+		d := j.duration(now).Round(time.Millisecond)
+		fmt.Fprintf(&b, "%d\t%s\t%s\t%s (%s)\n", j.id, j.state, d, j.name, j.desc)
+	}
+	return b.String()
+}
+
+// close cancels all outstanding jobs and stops the workers.
+func (q *jobQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	for _, j := range q.running {
+		j.cancel()
+	}
+	for _, j := range q.pending {
+		q.finish(j, jobCancelled)
+	}
+	for _, j := range q.ready {
+		q.finish(j, jobCancelled)
+	}
+	q.pending, q.ready = make(map[string]*job), nil
+	q.cond.Broadcast()
+}
@@ -0,0 +1,202 @@
+package snoop
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A fakeTool stands in for the tools run by a job: it blocks until released,
+// noting whether its job was cancelled while it waited.
+type fakeTool struct {
+	started   chan struct{}
+	release   chan struct{}
+	done      chan struct{}
+	cancelled bool
+}
+
+func newFakeTool() *fakeTool {
+	return &fakeTool{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+func (f *fakeTool) run(ctx context.Context) {
+	close(f.started)
+	select {
+	case <-f.release:
+	case <-ctx.Done():
+		f.cancelled = true
+		<-f.release // keep running as a tool would until it is killed
+	}
+	close(f.done)
+}
+
+func wait(t *testing.T, c <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-c:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+func notYet(t *testing.T, c <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-c:
+		t.Fatalf("%s too soon", what)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+// checkJobs checks the jobs listed by q against want, given as
+// '<id> <state> <file> (<desc>)' with the duration left out.
+func checkJobs(t *testing.T, q *jobQueue, want ...string) {
+	t.Helper()
+	listed := strings.Split(strings.TrimSuffix(q.list(), "\n"), "\n")
+	if len(listed) != len(want) {
+		t.Fatalf("listed jobs:\n%s\nwant %d", q.list(), len(want))
+	}
+	for i, w := range want {
+		f := strings.SplitN(w, " ", 3)
+		re := fmt.Sprintf(`^%s\t%s\t(\d+(\.\d+)?(ms|s|µs|ns)|0s)\t%s$`, f[0], f[1], regexp.QuoteMeta(f[2]))
+		if !regexp.MustCompile(re).MatchString(listed[i]) {
+			t.Errorf("job %d listed as %q; want %q", i, listed[i], w)
+		}
+	}
+}
+
+func TestJobQueueRunsJobs(t *testing.T) {
+	q := newJobQueue(2)
+	defer q.close()
+
+	a, b := newFakeTool(), newFakeTool()
+	q.submit("/src/a.go", "go", a.run)
+	q.submit("/src/b.go", "go", b.run)
+
+	// Jobs for different files run side by side
+	wait(t, a.started, "a to start")
+	wait(t, b.started, "b to start")
+	checkJobs(t, q, "1 running /src/a.go (go)", "2 running /src/b.go (go)")
+
+	close(b.release)
+	wait(t, b.done, "b to finish")
+	close(a.release)
+	wait(t, a.done, "a to finish")
+	for deadline := time.Now().Add(5 * time.Second); strings.Contains(q.list(), jobRunning); {
+		if time.Now().After(deadline) {
+			t.Fatalf("jobs still running:\n%s", q.list())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Most recently finished first
+	checkJobs(t, q, "1 done /src/a.go (go)", "2 done /src/b.go (go)")
+	if a.cancelled || b.cancelled {
+		t.Errorf("jobs cancelled: a %v, b %v", a.cancelled, b.cancelled)
+	}
+}
+
+func TestJobQueueCancelsEarlierJobs(t *testing.T) {
+	q := newJobQueue(2)
+	defer q.close()
+
+	first, second, third := newFakeTool(), newFakeTool(), newFakeTool()
+	q.submit("/src/a.go", "go", first.run)
+	wait(t, first.started, "first job to start")
+
+	// A new job for the file cancels the running one but waits for it to stop
+	// (with another worker free) so that the file only has one job at a time
+	q.submit("/src/a.go", "go lint", second.run)
+	notYet(t, second.started, "second job started")
+	checkJobs(t, q, "1 running /src/a.go (go)", "2 queued /src/a.go (go lint)")
+
+	// And a job that hasn't started yet is dropped without being run
+	q.submit("/src/a.go", "go", third.run)
+	checkJobs(t, q,
+		"1 running /src/a.go (go)",
+		"3 queued /src/a.go (go)",
+		"2 cancelled /src/a.go (go lint)",
+	)
+
+	close(first.release)
+	wait(t, first.done, "first job to finish")
+	wait(t, third.started, "third job to start")
+	if !first.cancelled {
+		t.Errorf("first job wasn't cancelled")
+	}
+	notYet(t, second.started, "cancelled job started")
+	checkJobs(t, q,
+		"3 running /src/a.go (go)",
+		"1 cancelled /src/a.go (go)",
+		"2 cancelled /src/a.go (go lint)",
+	)
+
+	close(third.release)
+	wait(t, third.done, "third job to finish")
+	if third.cancelled {
+		t.Errorf("last job was cancelled")
+	}
+}
+
+func TestJobQueueOrder(t *testing.T) {
+	q := newJobQueue(1)
+	defer q.close()
+
+	tools := map[string]*fakeTool{}
+	var order []string
+	ran := make(chan string, 10)
+	for _, name := range []string{"a", "b", "c", "b"} {
+		f := newFakeTool()
+		tools[name] = f
+		name := name
+		q.submit(name, "", func(ctx context.Context) {
+			ran <- name
+			f.run(ctx)
+		})
+	}
+
+	// b was resubmitted so it runs last, and only once
+	for _, name := range []string{"a", "c", "b"} {
+		close(tools[name].release)
+		select {
+		case n := <-ran:
+			order = append(order, n)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out after running %q", order)
+		}
+		wait(t, tools[name].done, name+" to finish")
+	}
+	if got := strings.Join(order, " "); got != "a c b" {
+		t.Errorf("ran %s; want a c b", got)
+	}
+}
+
+func TestJobQueueClose(t *testing.T) {
+	q := newJobQueue(1)
+
+	running, queued := newFakeTool(), newFakeTool()
+	q.submit("/src/a.go", "go", running.run)
+	wait(t, running.started, "job to start")
+	q.submit("/src/b.go", "go", queued.run)
+
+	q.close()
+	close(running.release)
+	wait(t, running.done, "running job to finish")
+	if !running.cancelled {
+		t.Errorf("running job wasn't cancelled")
+	}
+
+	// Nothing more is run once closed
+	q.submit("/src/c.go", "go", func(context.Context) { t.Errorf("job run after close") })
+	notYet(t, queued.started, "queued job started")
+	if strings.Contains(q.list(), "/src/c.go") {
+		t.Errorf("job queued after close:\n%s", q.list())
+	}
+}
@@ -0,0 +1,173 @@
+package snoop
+
+// Routes can be added without touching the snooper by dropping an executable
+// called snoop-<route> into $HOME/.config/acme-corp/plugins: it is registered
+// as <route> at start up and on 'reload', unless that would replace one of the
+// built in routes. Plugins can be written in anything. Each request runs the
+// plugin with the content of the message on stdin (and in $SNOOP_CONTENT) and
+// the focused window in $winid and $samfile, as acme does for commands run from
+// a tag, along with $ACME_SNOOPER_ADDR so that it can call back into the
+// snooper. Whatever it writes to stdout is streamed back to the client and if
+// it fails then its stderr is returned as the error.
+//
+// A line containing 'snoop-usage: <usage>' near the top of the plugin (in a
+// comment, say) is used as its usage in the help route.
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	pluginPrefix     = "snoop-"
+	pluginTimeout    = time.Minute
+	pluginUsageBytes = 1024 // how far into a plugin we look for its usage
+)
+
+var pluginUsageRe = regexp.MustCompile(`snoop-usage:\s*(.*?)\s*$`)
+
+// A plugin is an executable that handles a route.
+type plugin struct {
+	route string
+	path  string
+	usage string
+}
+
+// pluginDir returns the directory that plugins are loaded from.
+func pluginDir() string {
+	return filepath.Join(filepath.Dir(configPath()), "plugins")
+}
+
+// findPlugins returns the plugins in dir, which need not exist, sorted by
+// route.
+func findPlugins(dir string) ([]plugin, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var plugins []plugin
+	for _, info := range entries {
+		route := strings.TrimPrefix(info.Name(), pluginPrefix)
+		if route == info.Name() || route == "" || info.IsDir() || info.Mode()&0111 == 0 {
+			continue
+		}
+
+		p := plugin{route: route, path: filepath.Join(dir, info.Name())}
+		p.usage = pluginUsage(p.path)
+		plugins = append(plugins, p)
+	}
+
+	sort.Slice(plugins, func(i, j int) bool { return plugins[i].route < plugins[j].route })
+	return plugins, nil
+}
+
+// pluginUsage returns the usage given in the plugin at path, if there is one.
+func pluginUsage(path string) string {
+	usage := "(plugin) " + path
+
+	f, err := os.Open(path)
+	if err != nil {
+		return usage
+	}
+	defer f.Close()
+
+	b := make([]byte, pluginUsageBytes)
+	n, _ := io.ReadFull(f, b)
+	for _, line := range strings.Split(string(b[:n]), "\n") {
+		if m := pluginUsageRe.FindStringSubmatch(line); m != nil && m[1] != "" {
+			return m[1]
+		}
+	}
+	return usage
+}
+
+// loadPlugins registers a route for each plugin, replacing any that were
+// registered by a previous call, and describes what was loaded.
+func (a *AcmeSnooper) loadPlugins() (string, error) {
+	plugins, err := findPlugins(pluginDir())
+	if err != nil {
+		return "", err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	old := make([]string, 0, len(a.plugins))
+	for route := range a.plugins {
+		old = append(old, route)
+	}
+	streams := make([]StreamRoute, len(plugins))
+	for i, p := range plugins {
+		streams[i] = StreamRoute{Name: p.route, Usage: p.usage, Handler: a.pluginHandler(p)}
+	}
+	skipped := a.listener.ReplaceStreams(old, streams)
+
+	builtin := make(map[string]bool)
+	for _, route := range skipped {
+		builtin[route] = true
+	}
+	a.plugins = make(map[string]plugin)
+	for _, p := range plugins {
+		if !builtin[p.route] {
+			a.plugins[p.route] = p
+		}
+	}
+
+	msg := fmt.Sprintf("loaded %d plugins (dir: %s)", len(a.plugins), pluginDir())
+	if len(skipped) > 0 {
+		msg += fmt.Sprintf(", skipping built in routes: %s", strings.Join(skipped, " "))
+	}
+	return msg, nil
+}
+
+// pluginHandler runs p for each request, streaming its output to w.
+func (a *AcmeSnooper) pluginHandler(p plugin) StreamHandler {
+	return func(s string, w io.Writer) error {
+		ctx, cancel := context.WithTimeout(context.Background(), pluginTimeout)
+		defer cancel()
+
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, p.path)
+		cmd.Stdin = strings.NewReader(s)
+		cmd.Stdout, cmd.Stderr = w, &stderr
+		cmd.WaitDelay = time.Second
+		cmd.Env = append(os.Environ(),
+			"SNOOP_ROUTE="+p.route,
+			"SNOOP_CONTENT="+s,
+			"ACME_SNOOPER_ADDR="+a.listener.addr,
+		)
+
+		if wi, ok := a.registry.Focused(); ok {
+			cmd.Env = append(cmd.Env, "winid="+strconv.Itoa(wi.ID), "samfile="+wi.Name)
+			if info, err := os.Stat(filepath.Dir(wi.Name)); err == nil && info.IsDir() {
+				cmd.Dir = filepath.Dir(wi.Name)
+			}
+		}
+
+		err := cmd.Run()
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("%s: timed out after %s", p.route, pluginTimeout)
+		}
+		if err != nil {
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				return fmt.Errorf("%s: %s", p.route, msg)
+			}
+			return fmt.Errorf("%s: %s", p.route, err)
+		}
+		return nil
+	}
+}
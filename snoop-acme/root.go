@@ -0,0 +1,37 @@
+package snoop
+
+// Some tools only make sense when run over a whole project rather than a
+// single file: cargo needs the crate, make needs the Makefile and so on. The
+// root of the project containing a file is the nearest directory above it that
+// has one of the projectMarkers in it, which is where Tools that target the
+// root are run. Scripts can find the same directory using the root route.
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// The files that mark the root of a project.
+var projectMarkers = []string{
+	"go.mod", "Cargo.toml", "package.json", "pyproject.toml", "Makefile",
+}
+
+// findUp walks up from dir looking for a directory containing one of names,
+// returning the first one found.
+func findUp(dir string, names ...string) (string, bool) {
+	for dir = filepath.Clean(dir); ; dir = filepath.Dir(dir) {
+		for _, name := range names {
+			if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+				return dir, true
+			}
+		}
+		if parent := filepath.Dir(dir); parent == dir {
+			return "", false
+		}
+	}
+}
+
+// projectRoot returns the root of the project containing dir, if it is in one.
+func projectRoot(dir string) (string, bool) {
+	return findUp(dir, projectMarkers...)
+}
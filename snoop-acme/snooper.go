@@ -1,123 +1,647 @@
 package snoop
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 
 	"9fans.net/go/acme"
+	"github.com/sminez/acme-corp/acorp"
 )
 
 // An AcmeSnooper snoops on acme events and listens for custom action requests over
 // TCP. This allows for richer reuse of existing acme wrappers from acme.go
 type AcmeSnooper struct {
-	win         *acme.Win
+	win         acorp.Window
 	listener    *Listener
-	chLogEvents chan acme.LogEvent
-	active      int
-	formatOn    bool
+	fileServer  *FileServer
+	cmds        *acorp.TagCommands
+	supervisor  *acorp.Supervisor
+	registry    *acorp.Registry
+	history     *focusHistory
+	types       *typeCache
+	jobs        *jobQueue
+	diagnostics *diagWindows
+	toggles     *toggles
 	debug       bool
+	logMu       sync.Mutex // held for every write to win
+
+	mu           sync.RWMutex
+	fileTypes    []FileType
+	configSource string
+	trusted      []string        // roots of the projects whose configs we use
+	untrusted    map[string]bool // project configs we have said we are ignoring
+	plugins      map[string]plugin
 }
 
 // NewAcmeSnooper inits an acme snooper and grabs the /+snoop window so that we
 // can send messages back to acme in a consistent way.
 func NewAcmeSnooper(debug bool) *AcmeSnooper {
-	win, err := acme.New()
+	win, err := acorp.NewWindow()
 	if err != nil {
 		log.Fatal(err)
 	}
 	win.Name("+snoop")
 	win.Ctl("clean")
-	win.Write("tag", []byte(defaultSnoopTag))
 
-	return &AcmeSnooper{
-		win:         win,
-		listener:    NewListener(tcpPort),
-		chLogEvents: make(chan acme.LogEvent),
-		active:      -1,
-		formatOn:    false,
-		debug:       debug,
+	registry, err := acorp.NewRegistry()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	a := &AcmeSnooper{
+		win:          win,
+		listener:     NewListener(acorp.SnooperAddr()),
+		debug:        debug,
+		supervisor:   acorp.NewSupervisor(context.Background()),
+		registry:     registry,
+		history:      &focusHistory{},
+		types:        newTypeCache(),
+		jobs:         newJobQueue(jobWorkers),
+		fileTypes:    formatableTypes,
+		configSource: builtinConfig,
 	}
+
+	a.diagnostics = newDiagWindows(a.supervisor, a.recheck, a.errorf)
+	if a.toggles, err = loadToggles(togglesPath()); err != nil {
+		a.errorf("%s\n", err)
+	}
+	a.listener.RequireSecret(acorp.SnooperSecret())
+	if _, err = a.reload(); err != nil {
+		a.errorf("%s\n", err)
+	}
+	a.fileServer = NewFileServer(a.fileTree())
+
+	a.cmds = acorp.NewTagCommands(
+		acorp.TagCommand{Name: "Clear", Help: "clear the snooper log", Exec: a.clearCommand},
+		acorp.TagCommand{Name: "fmton", Help: "enable format on save", Exec: a.fmtCommand("on")},
+		acorp.TagCommand{Name: "fmtoff", Help: "disable format on save", Exec: a.fmtCommand("off")},
+		acorp.TagCommand{Name: "dirtree", Help: "open a directory tree viewer"},
+	)
+	a.cmds.WriteTag(win)
+
+	return a
 }
 
 func (a *AcmeSnooper) logf(s string, args ...interface{}) {
+	a.logMu.Lock()
+	defer a.logMu.Unlock()
 	a.win.Write("body", []byte(prompt+fmt.Sprintf(s, args...)))
 	a.win.Ctl("clean")
 }
 
 func (a *AcmeSnooper) errorf(s string, args ...interface{}) {
+	a.logMu.Lock()
+	defer a.logMu.Unlock()
 	a.win.Write("errors", []byte(fmt.Sprintf(s, args...)))
 }
 
-func (a *AcmeSnooper) tailLog() {
-	l, _ := acme.Log()
-	for {
-		e, _ := l.Read()
-		a.chLogEvents <- e
+func (a *AcmeSnooper) fmtHandler(s string) (string, error) {
+	return a.toggleHandler(featureFmt, s)
+}
+
+func (a *AcmeSnooper) lintHandler(s string) (string, error) {
+	return a.toggleHandler(featureLint, s)
+}
+
+// toggleHandler handles '<on|off|toggle|default|status> [target]' requests for
+// feature. The target is a window id, the path of a file or the name of a file
+// type from the global config and everything is affected if it is left out.
+// Setting 'default' removes the setting for the target so that the next most
+// specific applies, and status lists the settings that have been made (or how
+// the target is affected). Responds with whether feature is now enabled for
+// the target.
+func (a *AcmeSnooper) toggleHandler(feature, s string) (string, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return "", fmt.Errorf("'%s' is not a valid %s directive", s, feature)
 	}
+	directive, target := fields[0], ""
+	if len(fields) == 2 {
+		target = fields[1]
+	}
+
+	if directive == "status" && target == "" {
+		return a.toggles.list(feature), nil
+	}
+
+	k, err := a.toggleTarget(feature, target)
+	if err != nil {
+		return "", err
+	}
+
+	switch directive {
+	case "status":
+		on, scope := a.toggleState(k)
+		return fmt.Sprintf("%s (%s)", onOff(on), scope), nil
+	case "on", "off":
+		err = a.toggles.set(k, directive == "on")
+	case "toggle":
+		on, _ := a.toggleState(k)
+		err = a.toggles.set(k, !on)
+	case "default":
+		err = a.toggles.unset(k)
+	default:
+		return "", fmt.Errorf("'%s' is not a valid %s directive", s, feature)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	on, scope := a.toggleState(k)
+	a.logf("%s on save for %s: %s (%s)\n", feature, k, onOff(on), scope)
+	return onOff(on), nil
 }
 
-func (a *AcmeSnooper) fmtHandler(s string) (string, error) {
-	switch s {
-	case "on":
-		a.formatOn = true
-		a.logf("format on save: enabled\n")
-		return "on", nil
+// toggleTarget returns the setting of feature for target (see toggleHandler).
+func (a *AcmeSnooper) toggleTarget(feature, target string) (toggleKey, error) {
+	switch {
+	case target == "":
+		return toggleKey{feature, scopeGlobal, ""}, nil
+
+	case strings.HasPrefix(target, "/"):
+		return toggleKey{feature, scopePath, target}, nil
+	}
 
-	case "off":
-		a.formatOn = false
-		a.logf("format on save: disabled\n")
-		return "off", nil
+	id, err := strconv.Atoi(target)
+	if err != nil {
+		names := a.fileTypeNames()
+		for _, name := range names {
+			if name == target {
+				return toggleKey{feature, scopeType, target}, nil
+			}
+		}
+		return toggleKey{}, fmt.Errorf("'%s' is not a known file type (one of %s)", target, strings.Join(names, ", "))
+	}
+	wi, ok := a.registry.Refresh(id)
+	if !ok {
+		return toggleKey{}, fmt.Errorf("window %d does not exist", id)
+	}
+	if wi.Name == "" || strings.HasSuffix(wi.Name, "/") {
+		return toggleKey{}, fmt.Errorf("window %d is not a file", id)
+	}
+	return toggleKey{feature, scopePath, wi.Name}, nil
+}
+
+// fileTypeNames returns the names of the file types from the global config.
+func (a *AcmeSnooper) fileTypeNames() []string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
 
+	names := make([]string, len(a.fileTypes))
+	for i, ft := range a.fileTypes {
+		names[i] = ft.name
+	}
+	return names
+}
+
+// toggleState reports whether the feature for k is enabled for the files it
+// applies to, and the scope of the setting that decided it.
+func (a *AcmeSnooper) toggleState(k toggleKey) (bool, string) {
+	switch k.scope {
+	case scopePath:
+		fileType, _, _ := a.detect(k.name)
+		return a.toggles.enabled(k.feature, fileType, k.name)
+	case scopeType:
+		return a.toggles.enabled(k.feature, k.name, "")
 	default:
-		return "", fmt.Errorf("'%s' is not a valid format directive", s)
+		return a.toggles.enabled(k.feature, "", "")
+	}
+}
+
+// reload (re)reads the FileTypes and Tools to use from the config file. The
+// current file types are kept if the config is invalid.
+func (a *AcmeSnooper) reload() (string, error) {
+	path := configPath()
+	fileTypes, trusted, err := loadFileTypes(path)
+	if err != nil {
+		return "", err
+	}
+
+	source := builtinConfig
+	if _, err = os.Stat(path); err == nil {
+		source = path
+	}
+
+	a.mu.Lock()
+	a.fileTypes, a.configSource = fileTypes, source
+	a.trusted, a.untrusted = trusted, map[string]bool{}
+	a.mu.Unlock()
+	a.types.clear()
+	return fmt.Sprintf("loaded %d file types (config: %s)", len(fileTypes), source), nil
+}
+
+func (a *AcmeSnooper) reloadHandler(s string) (string, error) {
+	msg, err := a.reload()
+	if err != nil {
+		return "", err
+	}
+	a.logf("%s\n", msg)
+
+	pmsg, err := a.loadPlugins()
+	if err != nil {
+		return "", err
+	}
+	a.logf("%s\n", pmsg)
+	return msg + "\n" + pmsg, nil
+}
+
+// runTools formats the file written in e and then checks it if there was
+// nothing to format: otherwise the put after formatting will check it. A
+// cancelled run has been superseded so anything it found is stale.
+func (a *AcmeSnooper) runTools(ctx context.Context, ft FileType, e acme.LogEvent, format, lint bool) {
+	if format {
+		w, err := acorp.OpenWindow(e.ID)
+		if err != nil {
+			a.errorf("%s\n", err)
+			return
+		}
+		changed, s := ft.Reformat(ctx, w, e.Name)
+		w.CloseFiles()
+		if ctx.Err() != nil || changed {
+			return
+		}
+		if len(s) > 0 {
+			a.errorf("%s", s)
+		}
+	}
+	if lint {
+		a.check(ctx, ft, e.Name)
+	}
+}
+
+// addWindowCommands adds windowCommands to the tags of new windows for files
+// that we have tools for.
+func (a *AcmeSnooper) addWindowCommands(sub *acorp.Subscription) {
+	for we := range sub.C {
+		e := acme.LogEvent{ID: we.Info.ID, Op: we.Op, Name: we.Info.Name}
+		if len(e.Name) == 0 {
+			continue
+		}
+		if _, _, ok := a.fileType(&e); !ok {
+			continue
+		}
+
+		w, err := acorp.OpenWindow(e.ID)
+		if err != nil {
+			continue
+		}
+		// A get of a window we have seen before will already have them
+		if tag, err := w.ReadAll("tag"); err == nil && !containsWord(string(tag), windowCommands[0]) {
+			w.Write("tag", []byte(" "+strings.Join(windowCommands, " ")))
+		}
+		w.CloseFiles()
 	}
 }
 
+func containsWord(s, word string) bool {
+	for _, f := range strings.Fields(s) {
+		if f == word {
+			return true
+		}
+	}
+	return false
+}
+
+// check runs the linters for the file name, showing what they find in the
+// +Diagnostics window for its directory.
+func (a *AcmeSnooper) check(ctx context.Context, ft FileType, name string) {
+	diags, s := ft.Check(ctx, name)
+	if ctx.Err() != nil {
+		return
+	}
+	if err := a.diagnostics.update(name, diags, s); err != nil {
+		a.errorf("%s\n", err)
+	}
+}
+
+// recheck queues a run of the linters for the file name (without formatting
+// it: the window may have unsaved changes).
+func (a *AcmeSnooper) recheck(name string) {
+	e := acme.LogEvent{ID: -1, Name: name}
+	if wi, ok := a.registry.Lookup(name); ok {
+		e.ID = wi.ID
+	}
+
+	if ft, _, ok := a.fileType(&e); ok {
+		a.jobs.submit(name, ft.name, func(ctx context.Context) {
+			a.check(ctx, ft, name)
+		})
+	}
+}
+
+func (a *AcmeSnooper) jobsHandler(s string) (string, error) {
+	return a.jobs.list(), nil
+}
+
+// projectFileTypes returns the FileTypes that apply to the file name and the
+// config they came from, merging in the project config if there is one and
+// the project is trusted. Untrusted configs are reported the first time we see
+// them after each reload.
+func (a *AcmeSnooper) projectFileTypes(name string) ([]FileType, string) {
+	a.mu.RLock()
+	fileTypes, source, trusted := a.fileTypes, a.configSource, a.trusted
+	a.mu.RUnlock()
+
+	path, ok := projectConfig(name)
+	if !ok {
+		return fileTypes, source
+	}
+	if !isTrusted(path, trusted) {
+		a.ignoreProjectConfig(path)
+		return fileTypes, source
+	}
+
+	project, err := loadProjectFileTypes(fileTypes, path)
+	if err != nil {
+		a.errorf("%s\n", err)
+		return fileTypes, source
+	}
+	return project, path
+}
+
+// ignoreProjectConfig reports that the untrusted project config at path isn't
+// being used, unless we have already done so since the last reload.
+func (a *AcmeSnooper) ignoreProjectConfig(path string) {
+	a.mu.Lock()
+	reported := a.untrusted[path]
+	if a.untrusted == nil {
+		a.untrusted = map[string]bool{}
+	}
+	a.untrusted[path] = true
+	a.mu.Unlock()
+
+	if !reported {
+		a.errorf("ignoring %s: the project isn't listed in trusted_projects in %s\n", path, configPath())
+	}
+}
+
+// fileType returns the FileType for the file written in e (if there is one)
+// and the config it came from.
+func (a *AcmeSnooper) fileType(e *acme.LogEvent) (FileType, string, bool) {
+	if e.Op == acorp.OpGet || e.Op == acorp.OpPut {
+		a.types.forget(e.ID) // the file has changed since we last looked
+	}
+	fileTypes, source := a.projectFileTypes(e.Name)
+
+	name, _, ok := a.types.detect(fileTypes, e.ID, e.Name)
+	if !ok {
+		return FileType{}, "", false
+	}
+	for _, ft := range fileTypes {
+		if ft.name == name {
+			return ft, source, true
+		}
+	}
+	return FileType{}, "", false
+}
+
+// detect returns the type of the file name, reading it from its window if it
+// is open, and how it was detected.
+func (a *AcmeSnooper) detect(name string) (string, string, bool) {
+	id := -1
+	if wi, ok := a.registry.Lookup(name); ok {
+		id = wi.ID
+	}
+
+	fileTypes, _ := a.projectFileTypes(name)
+	return a.types.detect(fileTypes, id, name)
+}
+
+// filetypeHandler returns the type of the given file, defaulting to the file
+// in the focused window, and how it was detected.
+func (a *AcmeSnooper) filetypeHandler(s string) (string, error) {
+	name := strings.TrimSpace(s)
+	if name == "" || name == "." {
+		wi, ok := a.registry.Focused()
+		if !ok || wi.Name == "" {
+			return "", fmt.Errorf("no focused window")
+		}
+		name = wi.Name
+	}
+
+	fileType, how, ok := a.detect(name)
+	if !ok {
+		return "", fmt.Errorf("unknown file type for %s", name)
+	}
+	return fileType + "\t" + how, nil
+}
+
+func (a *AcmeSnooper) clearCommand(w acorp.Window, e *acme.Event, arg string) error {
+	a.logMu.Lock()
+	defer a.logMu.Unlock()
+
+	w.Clear()
+	w.Write("body", []byte("-- acme corp --\n"))
+	return w.Ctl("clean")
+}
+
+func (a *AcmeSnooper) fmtCommand(directive string) acorp.TagCommandFunc {
+	return func(w acorp.Window, e *acme.Event, arg string) error {
+		_, err := a.fmtHandler(directive)
+		return err
+	}
+}
+
+// watchWindow handles events for the +snoop window itself, running our own
+// tag commands and passing everything else on to acme.
+func (a *AcmeSnooper) watchWindow() {
+	ef := &acorp.EventFilter{}
+	ef.Use(a.cmds.Middleware)
+	a.supervisor.Go(a.win, ef)
+}
+
+// shutdown releases any windows we are managing back to acme, removes our 9P
+// service and exits.
+func (a *AcmeSnooper) shutdown() {
+	a.supervisor.Shutdown()
+	a.jobs.close()
+	a.listener.Close()
+	a.fileServer.Close()
+	os.Exit(0)
+}
+
 func (a *AcmeSnooper) activeHandler(s string) (string, error) {
-	return fmt.Sprintf("%d", a.active), nil
+	if wi, ok := a.registry.Focused(); ok {
+		return fmt.Sprintf("%d", wi.ID), nil
+	}
+	return "-1", nil
+}
+
+// rootHandler returns the root of the project containing the given file or
+// directory, defaulting to the file in the focused window.
+func (a *AcmeSnooper) rootHandler(s string) (string, error) {
+	name := strings.TrimSpace(s)
+	if name == "" || name == "." {
+		wi, ok := a.registry.Focused()
+		if !ok || wi.Name == "" {
+			return "", fmt.Errorf("no focused window")
+		}
+		name = wi.Name
+	}
+
+	dir := name
+	if info, err := os.Stat(name); err != nil || !info.IsDir() {
+		dir = filepath.Dir(name)
+	}
+	if root, ok := projectRoot(dir); ok {
+		return root, nil
+	}
+	return "", fmt.Errorf("%s is not in a project", name)
+}
+
+// fileTree builds the file tree served over 9P:
+//
+//	active                 the id of the focused window
+//	history                recently focused windows as for the history route
+//	jobs                   running and recent tool runs as for the jobs route
+//	fmt                    'on' or 'off': write directives as for the fmt route
+//	lint                   'on' or 'off': write directives as for the lint route
+//	ctl                    accepts '<route> / <content>' messages as for TCP
+//	windows/<id>/name      the window name
+//	windows/<id>/tag       the window tag
+//	windows/<id>/dirty     1 if the window has unsaved changes, 0 otherwise
+func (a *AcmeSnooper) fileTree() *fsNode {
+	return newStaticDir("/",
+		newFile("active", func() (string, error) {
+			s, err := a.activeHandler("")
+			return s + "\n", err
+		}, nil),
+
+		newFile("history", func() (string, error) {
+			return a.historyHandler("")
+		}, nil),
+
+		newFile("jobs", func() (string, error) {
+			return a.jobs.list(), nil
+		}, nil),
+
+		a.toggleFile(featureFmt),
+		a.toggleFile(featureLint),
+
+		newFile("ctl", func() (string, error) {
+			return strings.Join(a.listener.Routes(), "\n") + "\n", nil
+		}, func(s string) (string, error) {
+			return a.listener.Dispatch(s)
+		}),
+
+		newDir("windows", func() []*fsNode {
+			var dirs []*fsNode
+			for _, wi := range a.registry.Windows() {
+				id := wi.ID
+				dirs = append(dirs, newStaticDir(strconv.Itoa(id),
+					a.windowFile(id, "name", func(wi acorp.WindowInfo) string { return wi.Name }),
+					a.windowFile(id, "tag", func(wi acorp.WindowInfo) string { return wi.Tag }),
+					a.windowFile(id, "dirty", func(wi acorp.WindowInfo) string {
+						if wi.Dirty {
+							return "1"
+						}
+						return "0"
+					}),
+				))
+			}
+			return dirs
+		}),
+	)
+}
+
+// toggleFile creates a file showing whether feature is enabled globally that
+// accepts the same directives as the route for feature.
+func (a *AcmeSnooper) toggleFile(feature string) *fsNode {
+	return newFile(feature, func() (string, error) {
+		on, _ := a.toggles.enabled(feature, "", "")
+		return onOff(on) + "\n", nil
+	}, func(s string) (string, error) {
+		return a.toggleHandler(feature, s)
+	})
+}
+
+// windowFile creates a read only file showing part of the state of window id.
+func (a *AcmeSnooper) windowFile(id int, name string, f func(acorp.WindowInfo) string) *fsNode {
+	return newFile(name, func() (string, error) {
+		wi, ok := a.registry.Refresh(id)
+		if !ok {
+			return "", fmt.Errorf("window %d does not exist", id)
+		}
+		return f(wi) + "\n", nil
+	}, nil)
+}
+
+func (a *AcmeSnooper) listen() {
+	if err := a.listener.HandleIncomingConnections(); err != nil {
+		a.errorf("unable to listen on %s: %s\n", a.listener.addr, err)
+	}
+}
+
+func (a *AcmeSnooper) serveFiles() {
+	if err := a.fileServer.Serve(); err != nil {
+		a.errorf("unable to serve 9P: %s\n", err)
+	}
 }
 
 // Snoop kicks off our local server and starts listening in on acme events.
 func (a *AcmeSnooper) Snoop(chSignals chan os.Signal) {
-	a.listener.Register("active", a.activeHandler)
-	a.listener.Register("fmt", a.fmtHandler)
+	a.listener.Register("active", ".: the id of the focused window (-1 if unknown)", a.activeHandler)
+	a.listener.Register("fmt", "on|off|toggle|default|status [id|path|type]: format on save for everything or one window, file or file type", a.fmtHandler)
+	a.listener.Register("lint", "on|off|toggle|default|status [id|path|type]: lint on save (follows fmt unless set)", a.lintHandler)
+	a.listener.Register("jobs", ".: running and recent tool runs as '<id>\t<state>\t<duration>\t<file> (<type>)'", a.jobsHandler)
+	a.listener.Register("filetype", "[file]: the type of a file (default: the focused window) as '<type>\t<how>'", a.filetypeHandler)
+	a.listener.Register("root", "[file]: the project root for a file (default: the focused window)", a.rootHandler)
+	a.listener.Register("reload", ".: reload file types and tools from the config file, and plugins", a.reloadHandler)
+	a.listener.Register("previous", ".: the id of the previously focused window (-1 if unknown)", a.previousHandler)
+	a.listener.Register("history", "[n]: recently focused windows as '<id>\t<time>\t<name>'", a.historyHandler)
+	a.listener.Register("switch", "[id|name]: show a window (default: the previous one)", a.switchHandler)
+
+	// Plugins can't replace the routes above so they have to be loaded last
+	if msg, err := a.loadPlugins(); err != nil {
+		a.errorf("unable to load plugins: %s\n", err)
+	} else {
+		a.logf("%s\n", msg)
+	}
 
-	go a.listener.HandleIncomingConnections()
-	go a.tailLog()
+	go a.listen()
+	go a.serveFiles()
+	a.watchWindow()
+	go a.history.follow(a.registry.Subscribe(acorp.Ops(acorp.OpFocus, acorp.OpDel, acorp.OpGet, acorp.OpPut)))
+	go a.types.follow(a.registry.Subscribe(acorp.Ops(acorp.OpDel)))
+	go a.addWindowCommands(a.registry.Subscribe(acorp.Ops(acorp.OpNew, acorp.OpGet)))
+	puts := a.registry.Subscribe(acorp.Ops(acorp.OpPut))
 
+	a.logMu.Lock()
 	a.win.Write("body", []byte("-- acme corp --\n"))
+	a.logMu.Unlock()
 	a.logf("snooper now running...\n")
 
 	for {
 		select {
-		case e := <-a.chLogEvents:
-			switch e.Op {
-			case "":
-				os.Exit(0) // acme was closed
-
-			case "focus":
-				a.active = e.ID
-
-			case "put":
-				if a.formatOn && len(e.Name) > 0 {
-					for _, ft := range formatableTypes {
-						if ft.Matches(&e) {
-							s := ft.Reformat(&e)
-							if len(s) > 0 {
-								a.errorf(s)
-							}
-							break
-						}
-					}
-				}
+		case we, ok := <-puts.C:
+			if !ok {
+				a.shutdown() // acme was closed
+			}
 
-			default:
-				// log.Printf("%s: %v\n", e.Op, e)
+			e := acme.LogEvent{ID: we.Info.ID, Op: we.Op, Name: we.Info.Name}
+			if len(e.Name) == 0 {
+				continue
+			}
+			if ft, source, ok := a.fileType(&e); ok {
+				format, _ := a.toggles.enabled(featureFmt, ft.name, e.Name)
+				lint, _ := a.toggles.enabled(featureLint, ft.name, e.Name)
+				if !format && !lint {
+					continue
+				}
+				a.logf("%s: running %s tools (config: %s)\n", e.Name, ft.name, source)
+				a.jobs.submit(e.Name, ft.name, func(ctx context.Context) {
+					a.runTools(ctx, ft, e, format, lint)
+				})
 			}
 
 		case <-chSignals:
-			os.Exit(0)
+			a.shutdown()
 		}
 	}
 }
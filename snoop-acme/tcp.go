@@ -1,26 +1,69 @@
 package snoop
 
-// This file implements a simple TCP based protocol allowing clients to submit
-// messages of the form '<route> / <content>' to the snooper for processing.
-// Messages at this level are all arbitrary strings with parsing and processing
-// being done by the MessageHandlers themselves. Invalid messages will have an
-// error message returned to them but the format of that error is not
-// guaranteed by the server.
+// This file implements the protocols allowing clients to submit messages to
+// the snooper for processing over a unix socket (the default) or TCP. Messages
+// are routed by name to a MessageHandler with the content of a message being an
+// arbitrary string that the handler is responsible for parsing.
+//
+// Connections that start with '{' speak the structured protocol described in
+// acorp/protocol.go: JSON requests and responses, one per line, with status
+// codes and any number of requests per connection. Anything else is treated as
+// the original protocol: a single '<route> / <content>' line with the result
+// (or error message) written back before the connection is closed. Routes with
+// a StreamHandler write their output back as it is produced when the client
+// asks for it, and always for the original protocol. Either way, a client that
+// goes idleTimeout without sending (the rest of) a request is disconnected.
+//
+// Unix sockets are only accessible to the current user. If a secret has been
+// set then TCP clients must use the structured protocol and supply it before
+// any of their requests are handled.
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/subtle"
+	jsonenc "encoding/json" // json is the FileType in ftype.go
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sminez/acme-corp/acorp"
 )
 
+// idleTimeout is how long a client has to send each request before we give up
+// on it and close the connection.
+const idleTimeout = time.Minute
+
 // A MessageHandler is a function that knows how to parse a given message type
 type MessageHandler func(s string) (string, error)
 
+// A StreamHandler is a MessageHandler that writes its output to w as it goes
+// rather than returning it all at the end.
+type StreamHandler func(s string, w io.Writer) error
+
+// A RouteError is an error from routing a message rather than from a handler.
+type RouteError struct {
+	Status int
+	Msg    string
+}
+
+func (e *RouteError) Error() string {
+	return e.Msg
+}
+
 // A Message is a simple RPC message format to allow for very simple scripts
-// that pass simple string messages to the snooper for it to process. Ideally
-// this should be exposed as a 9fs file system in the same way as acme itself
-// but for now this will have to do.
+// that pass simple string messages to the snooper for it to process. The same
+// messages can be written to the ctl file of the snooper's 9P service (see
+// fs.go): the socket is kept for clients that can't speak 9P.
 type Message struct {
 	route   string
 	content string
@@ -40,58 +83,362 @@ func NewMessage(s string) (*Message, error) {
 	}, nil
 }
 
-// A Listener runs the event loop that owns our TCP socket and routes incoming
+type route struct {
+	handler MessageHandler
+	stream  StreamHandler
+	usage   string
+}
+
+// A Listener runs the event loop that owns our socket and routes incoming
 // messages to their relevant handlers.
 type Listener struct {
-	handlers map[string]MessageHandler
-	port     int
+	mu       sync.RWMutex
+	handlers map[string]route
+	addr     string
+	secret   string
+	ln       net.Listener
 }
 
-// NewListener initialises a new Listener without any handlers
-func NewListener(port int) *Listener {
-	return &Listener{
-		handlers: make(map[string]MessageHandler),
-		port:     port,
+// NewListener initialises a new Listener with only the help handler
+func NewListener(addr string) *Listener {
+	l := &Listener{
+		handlers: make(map[string]route),
+		addr:     addr,
 	}
+	l.Register("help", "[route]: list routes and their usage", l.helpHandler)
+	return l
+}
+
+// RequireSecret sets the shared secret that TCP clients must provide.
+func (l *Listener) RequireSecret(secret string) {
+	l.secret = secret
 }
 
-// HandleIncomingConnections binds to a tcp socket and serves handler responses
-// for incoming connections. Runs in a goroutine.
-func (l *Listener) HandleIncomingConnections() {
-	s, _ := net.Listen("tcp", fmt.Sprintf("localhost:%d", l.port))
+// HandleIncomingConnections binds to our socket and serves handler responses
+// for incoming connections until Close is called. Runs in a goroutine.
+func (l *Listener) HandleIncomingConnections() error {
+	ln, err := listen(acorp.ParseSnooperAddr(l.addr))
+	if err != nil {
+		return err
+	}
+	l.ln = ln
+
 	for {
-		// silently dropping failed incoming connections
-		conn, _ := s.Accept()
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			var nerr net.Error
+			if errors.As(err, &nerr) && nerr.Temporary() {
+				continue // silently dropping failed incoming connections
+			}
+			return err
+		}
 		go l.handleConnection(conn)
 	}
 }
 
-// Register registers a new message handler with a given route
-func (l *Listener) Register(route string, handler MessageHandler) {
-	l.handlers[route] = handler
+// Close stops listening for connections, removing our socket if we have one.
+func (l *Listener) Close() error {
+	if l.ln == nil {
+		return nil
+	}
+	return l.ln.Close()
+}
+
+// listen binds to the given address. Unix sockets are only accessible to the
+// current user and we refuse to replace a socket that another snooper is
+// still listening on.
+func listen(network, addr string) (net.Listener, error) {
+	if network != "unix" {
+		return net.Listen(network, addr)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(addr), 0700); err != nil {
+		return nil, err
+	}
+	if conn, err := net.Dial("unix", addr); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s is already in use", addr)
+	}
+	os.Remove(addr) // left behind by a previous instance
+
+	ln, err := net.Listen("unix", addr)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(addr, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// Register registers a new message handler with a given route along with a
+// short description of the content it expects.
+func (l *Listener) Register(name, usage string, handler MessageHandler) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.handlers[name] = route{handler: handler, usage: usage}
+}
+
+// RegisterStream registers a StreamHandler with a given route along with a
+// short description of the content it expects.
+func (l *Listener) RegisterStream(name, usage string, handler StreamHandler) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.handlers[name] = route{stream: handler, usage: usage}
+}
+
+// A StreamRoute is a StreamHandler along with the route it is registered for
+// and its usage.
+type StreamRoute struct {
+	Name    string
+	Usage   string
+	Handler StreamHandler
+}
+
+// ReplaceStreams removes the routes named in old and registers those in
+// streams in their place under a single lock, so that requests never find a
+// route missing part way through. Routes that are registered but not in old
+// are never replaced: the names of any in streams are returned instead.
+func (l *Listener) ReplaceStreams(old []string, streams []StreamRoute) (skipped []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, name := range old {
+		delete(l.handlers, name)
+	}
+
+	for _, s := range streams {
+		if _, ok := l.handlers[s.Name]; ok {
+			skipped = append(skipped, s.Name)
+			continue
+		}
+		l.handlers[s.Name] = route{stream: s.Handler, usage: s.Usage}
+	}
+	return skipped
+}
+
+// Routes returns the names of all registered routes in sorted order.
+func (l *Listener) Routes() []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	routes := make([]string, 0, len(l.handlers))
+	for r := range l.handlers {
+		routes = append(routes, r)
+	}
+	sort.Strings(routes)
+	return routes
+}
+
+func (l *Listener) helpHandler(s string) (string, error) {
+	names := l.Routes()
+	if s != "" && s != "." {
+		names = []string{s}
+	}
+
+	var b strings.Builder
+	tw := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		l.mu.RLock()
+		r, ok := l.handlers[name]
+		l.mu.RUnlock()
+		if !ok {
+			return "", &RouteError{Status: acorp.StatusNotFound, Msg: fmt.Sprintf("'%s' is not a known handler", name)}
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", name, r.usage)
+	}
+	tw.Flush()
+	return b.String(), nil
 }
 
 // Runs in a goroutine per incoming connection
 func (l *Listener) handleConnection(conn net.Conn) {
-	s, _ := bufio.NewReader(conn).ReadString('\n')
 	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authenticated := l.secret == "" || conn.LocalAddr().Network() == "unix"
+
+	conn.SetReadDeadline(time.Now().Add(idleTimeout))
+	if b, err := r.Peek(1); err != nil || b[0] != '{' {
+		if !authenticated {
+			conn.Write([]byte("authentication required: use the structured protocol"))
+			return
+		}
+		l.handleLegacy(conn, r)
+		return
+	}
 
+	// Requests are read a line at a time so that we can carry on with the next
+	// one after a request that can't be decoded.
+	enc := jsonenc.NewEncoder(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		line, err := r.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			if eerr := enc.Encode(l.respond(line, &authenticated, enc)); eerr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// respond handles a single line of the structured protocol, marking the
+// connection as authenticated once a request with the secret is accepted.
+func (l *Listener) respond(line []byte, authenticated *bool, enc *jsonenc.Encoder) acorp.SnooperResponse {
+	var req acorp.SnooperRequest
+	resp := acorp.SnooperResponse{Version: acorp.SnooperProtocolVersion, Status: acorp.StatusBadRequest}
+
+	if err := jsonenc.Unmarshal(line, &req); err != nil {
+		resp.ID = req.ID
+		resp.Error = fmt.Sprintf("malformed request: %s", err)
+		return resp
+	}
+	resp.ID = req.ID
+
+	switch {
+	case strings.TrimSpace(req.Route) == "":
+		resp.Error = "missing route"
+		return resp
+
+	case !*authenticated && subtle.ConstantTimeCompare([]byte(req.Secret), []byte(l.secret)) != 1:
+		resp.Status = acorp.StatusUnauthorized
+		resp.Error = "invalid or missing secret"
+		return resp
+	}
+
+	*authenticated = true
+	return l.serve(&req, enc)
+}
+
+// handleLegacy serves a single request in the original protocol, writing the
+// output of streaming routes back as it is produced.
+func (l *Listener) handleLegacy(conn net.Conn, r *bufio.Reader) {
+	s, _ := r.ReadString('\n')
 	msg, err := NewMessage(s)
+	if err == nil {
+		err = l.run(msg.route, msg.content, conn)
+	}
 	if err != nil {
 		conn.Write([]byte(err.Error()))
-		return
+	}
+}
+
+// serve handles a request in the structured protocol. Partial responses for
+// streaming requests are written to enc, leaving the final response to the
+// caller.
+func (l *Listener) serve(req *acorp.SnooperRequest, enc *jsonenc.Encoder) acorp.SnooperResponse {
+	resp := acorp.SnooperResponse{Version: acorp.SnooperProtocolVersion, ID: req.ID, Status: acorp.StatusOK}
+
+	if req.Version != 0 && req.Version != acorp.SnooperProtocolVersion {
+		resp.Status = acorp.StatusBadVersion
+		resp.Error = fmt.Sprintf("unsupported protocol version %d", req.Version)
+		return resp
+	}
+
+	var body strings.Builder
+	var w io.Writer = &body
+	var cw *chunkWriter
+	if req.Stream {
+		cw = &chunkWriter{enc: enc, id: req.ID}
+		w = cw
+	}
+
+	err := l.run(strings.TrimSpace(req.Route), req.Content, w)
+	if err != nil {
+		var rerr *RouteError
+		resp.Status = acorp.StatusError
+		if errors.As(err, &rerr) {
+			resp.Status = rerr.Status
+		}
+		resp.Error = err.Error()
+		return resp
 	}
 
-	handler, ok := l.handlers[msg.route]
+	resp.Body = body.String()
+	if cw != nil {
+		resp.Body = string(cw.pending)
+	}
+	return resp
+}
+
+// A chunkWriter sends each write as a partial response, holding back any
+// incomplete UTF-8 sequence at the end until the rest of it arrives.
+type chunkWriter struct {
+	enc     *jsonenc.Encoder
+	id      int
+	pending []byte
+}
+
+func (cw *chunkWriter) Write(b []byte) (int, error) {
+	cw.pending = append(cw.pending, b...)
+
+	n := len(cw.pending)
+	for i := n - 1; i >= 0 && i >= n-utf8.UTFMax; i-- {
+		if utf8.RuneStart(cw.pending[i]) {
+			if !utf8.FullRune(cw.pending[i:]) {
+				n = i
+			}
+			break
+		}
+	}
+	if n == 0 {
+		return len(b), nil
+	}
+
+	err := cw.enc.Encode(acorp.SnooperResponse{
+		Version: acorp.SnooperProtocolVersion,
+		ID:      cw.id,
+		Status:  acorp.StatusOK,
+		Body:    string(cw.pending[:n]),
+		More:    true,
+	})
+	if err != nil {
+		return 0, err
+	}
+	cw.pending = append([]byte{}, cw.pending[n:]...)
+	return len(b), nil
+}
+
+// Dispatch parses s as a Message and passes it to the relevant handler.
+func (l *Listener) Dispatch(s string) (string, error) {
+	msg, err := NewMessage(s)
+	if err != nil {
+		return "", &RouteError{Status: acorp.StatusBadRequest, Msg: err.Error()}
+	}
+	return l.call(msg.route, msg.content)
+}
+
+func (l *Listener) call(name, content string) (string, error) {
+	var b strings.Builder
+	if err := l.run(name, content, &b); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// run passes content to the handler for the named route, writing its output
+// to w.
+func (l *Listener) run(name, content string, w io.Writer) error {
+	l.mu.RLock()
+	r, ok := l.handlers[name]
+	l.mu.RUnlock()
+
 	if !ok {
-		conn.Write([]byte(fmt.Sprintf("'%s' is not a known handler", msg.route)))
-		return
+		return &RouteError{Status: acorp.StatusNotFound, Msg: fmt.Sprintf("'%s' is not a known handler", name)}
+	}
+	if r.stream != nil {
+		return r.stream(content, w)
 	}
 
-	resp, err := handler(msg.content)
+	s, err := r.handler(content)
 	if err != nil {
-		conn.Write([]byte(err.Error()))
-		return
+		return err
 	}
-	conn.Write([]byte(resp))
+	_, err = io.WriteString(w, s)
+	return err
 }
@@ -0,0 +1,223 @@
+package snoop
+
+import (
+	"bufio"
+	jsonenc "encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sminez/acme-corp/acorp"
+)
+
+// startListener serves a Listener on addr with a few test routes, returning
+// the network and address to dial.
+func startListener(t *testing.T, addr, secret string) (string, string) {
+	t.Helper()
+
+	l := NewListener(addr)
+	l.RequireSecret(secret)
+	l.Register("echo", "text: the text", func(s string) (string, error) { return s, nil })
+	l.Register("fail", ".: always fails", func(s string) (string, error) { return "", errors.New("it broke") })
+	l.RegisterStream("count", "n: counts to n", func(s string, w io.Writer) error {
+		var n int
+		fmt.Sscan(s, &n)
+		for i := 1; i <= n; i++ {
+			fmt.Fprintf(w, "%d\n", i)
+		}
+		return nil
+	})
+
+	done := make(chan error, 1)
+	go func() { done <- l.HandleIncomingConnections() }()
+	t.Cleanup(func() {
+		l.Close()
+		<-done
+	})
+
+	network, address := acorp.ParseSnooperAddr(addr)
+	for i := 0; ; i++ {
+		conn, err := net.Dial(network, address)
+		if err == nil {
+			conn.Close()
+			return network, address
+		}
+		if i == 100 {
+			t.Fatalf("listener never came up: %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func socketAddr(t *testing.T) string {
+	return "unix:" + filepath.Join(t.TempDir(), "snooper")
+}
+
+// A testConn speaks the structured protocol a line at a time.
+type testConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialTest(t *testing.T, network, address string) *testConn {
+	t.Helper()
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &testConn{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *testConn) send(line string) acorp.SnooperResponse {
+	c.t.Helper()
+	if _, err := io.WriteString(c.conn, line+"\n"); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.read()
+}
+
+func (c *testConn) read() acorp.SnooperResponse {
+	c.t.Helper()
+	b, err := c.r.ReadBytes('\n')
+	if err != nil {
+		c.t.Fatalf("reading response: %s", err)
+	}
+	var resp acorp.SnooperResponse
+	if err = jsonenc.Unmarshal(b, &resp); err != nil {
+		c.t.Fatalf("bad response %q: %s", b, err)
+	}
+	return resp
+}
+
+func TestProtocolStatus(t *testing.T) {
+	network, address := startListener(t, socketAddr(t), "")
+	c := dialTest(t, network, address)
+
+	// All on the one connection: errors must not close it
+	tests := []struct {
+		line   string
+		id     int
+		status int
+		body   string
+	}{
+		{`{"v":1,"id":1,"route":"echo","content":"hello\nworld"}`, 1, acorp.StatusOK, "hello\nworld"},
+		{`{"id":2,"route":"echo","content":"no version"}`, 2, acorp.StatusOK, "no version"},
+		{`{"v":1,"id":3,"route":"nope","content":""}`, 3, acorp.StatusNotFound, ""},
+		{`{"v":1,"id":4,"route":"fail","content":""}`, 4, acorp.StatusError, ""},
+		{`{"v":9,"id":5,"route":"echo","content":""}`, 5, acorp.StatusBadVersion, ""},
+		{`{"v":1,"id":6,"content":"no route"}`, 6, acorp.StatusBadRequest, ""},
+		{`{"v":1,"id":"x","route":"echo","content":""}`, 0, acorp.StatusBadRequest, ""},
+		{`{"v":1,"id":8,"route":`, 0, acorp.StatusBadRequest, ""},
+		{`[1, 2, 3]`, 0, acorp.StatusBadRequest, ""},
+		{`{"v":1,"id":10,"route":"help","content":"echo"}`, 10, acorp.StatusOK, "echo  text: the text\n"},
+	}
+
+	for _, tc := range tests {
+		resp := c.send(tc.line)
+		if resp.ID != tc.id || resp.Status != tc.status || resp.Body != tc.body {
+			t.Errorf("%s: got %+v; want id %d, status %d, body %q", tc.line, resp, tc.id, tc.status, tc.body)
+		}
+		if resp.Status != acorp.StatusOK && resp.Error == "" {
+			t.Errorf("%s: status %d with no error", tc.line, resp.Status)
+		}
+		if resp.Version != acorp.SnooperProtocolVersion {
+			t.Errorf("%s: version %d", tc.line, resp.Version)
+		}
+	}
+}
+
+func TestProtocolStream(t *testing.T) {
+	network, address := startListener(t, socketAddr(t), "")
+	c := dialTest(t, network, address)
+
+	resp := c.send(`{"v":1,"id":7,"route":"count","content":"3","stream":true}`)
+	var body strings.Builder
+	for ; resp.More; resp = c.read() {
+		if resp.ID != 7 || resp.Status != acorp.StatusOK {
+			t.Fatalf("bad partial response %+v", resp)
+		}
+		body.WriteString(resp.Body)
+	}
+	body.WriteString(resp.Body)
+	if resp.ID != 7 || body.String() != "1\n2\n3\n" {
+		t.Errorf("streamed %q ending with %+v", body.String(), resp)
+	}
+
+	// Without stream set the output arrives in one piece
+	if resp = c.send(`{"v":1,"id":8,"route":"count","content":"2"}`); resp.More || resp.Body != "1\n2\n" {
+		t.Errorf("got %+v", resp)
+	}
+}
+
+func TestProtocolLegacy(t *testing.T) {
+	network, address := startListener(t, socketAddr(t), "secret")
+
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"echo / hello", "hello"},
+		{"count / 2", "1\n2\n"},
+		{"nope / x", "'nope' is not a known handler"},
+		{"no slash", "Invalid message 'no slash\n'"},
+	}
+
+	for _, tc := range tests {
+		// The secret isn't needed on the unix socket
+		conn, err := net.Dial(network, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(conn, tc.line+"\n")
+		b, _ := ioutil.ReadAll(conn)
+		conn.Close()
+		if string(b) != tc.want {
+			t.Errorf("%q: got %q; want %q", tc.line, b, tc.want)
+		}
+	}
+}
+
+func TestProtocolSecret(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("no loopback TCP:", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	network, address := startListener(t, "tcp:"+addr, "s3cret")
+
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "echo / hi\n")
+	if b, _ := ioutil.ReadAll(conn); !strings.HasPrefix(string(b), "authentication required") {
+		t.Errorf("legacy request over TCP got %q", b)
+	}
+	conn.Close()
+
+	c := dialTest(t, network, address)
+	tests := []struct {
+		line   string
+		status int
+	}{
+		{`{"id":1,"route":"echo","content":"x"}`, acorp.StatusUnauthorized},
+		{`{"id":2,"secret":"wrong","route":"echo","content":"x"}`, acorp.StatusUnauthorized},
+		{`{"id":3,"secret":"s3cret","route":"echo","content":"x"}`, acorp.StatusOK},
+		{`{"id":4,"route":"echo","content":"x"}`, acorp.StatusOK}, // already authenticated
+	}
+	for _, tc := range tests {
+		if resp := c.send(tc.line); resp.Status != tc.status {
+			t.Errorf("%s: got %+v; want status %d", tc.line, resp, tc.status)
+		}
+	}
+}
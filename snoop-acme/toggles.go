@@ -0,0 +1,206 @@
+package snoop
+
+// Formatting and linting on save can be turned on or off for everything, for a
+// file type or for a single file (usually by way of the window it is open in).
+// The most specific setting wins and linting follows formatting unless it has
+// been set itself, so that 'fmt on' on its own behaves as it always has.
+// Settings for single files are saved as they are made so that a vendored file
+// that has been turned off stays off across restarts: the rest only last as
+// long as the snooper.
+
+import (
+	jsonenc "encoding/json" // json is the FileType in ftype.go
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The things that can be turned on and off.
+const (
+	featureFmt  = "fmt"
+	featureLint = "lint"
+)
+
+// Where a setting applies, from least to most specific.
+const (
+	scopeDefault = "default" // nothing has been set
+	scopeGlobal  = "global"
+	scopeType    = "type"
+	scopePath    = "path"
+)
+
+var scopeOrder = map[string]int{scopeType: 0, scopePath: 1}
+
+// The commands added to the tags of windows for files that we have tools for
+// so that they can be toggled for that file. These are the scripts of the same
+// name, which acme runs with $winid set.
+var windowCommands = []string{"afmt", "alint"}
+
+// A toggleKey identifies a single setting. name is the file type or path for
+// type and path settings.
+type toggleKey struct {
+	feature string
+	scope   string
+	name    string
+}
+
+func (k toggleKey) String() string {
+	if k.scope == scopeGlobal {
+		return k.scope
+	}
+	return k.scope + " " + k.name
+}
+
+// toggles holds the settings that have been made, saving those for paths to
+// file.
+type toggles struct {
+	mu     sync.Mutex
+	file   string
+	values map[toggleKey]bool
+}
+
+// togglesPath returns where the settings for paths are saved.
+func togglesPath() string {
+	return filepath.Join(filepath.Dir(configPath()), "toggles.json")
+}
+
+// loadToggles loads the settings for paths saved in file, which need not
+// exist. The toggles returned are usable even if the file can't be read.
+func loadToggles(file string) (*toggles, error) {
+	t := &toggles{file: file, values: make(map[toggleKey]bool)}
+
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return t, nil
+	} else if err != nil {
+		return t, err
+	}
+
+	var saved map[string]map[string]bool
+	if err = jsonenc.Unmarshal(b, &saved); err != nil {
+		return t, fmt.Errorf("%s: %s", file, err)
+	}
+	for _, feature := range []string{featureFmt, featureLint} {
+		for path, on := range saved[feature] {
+			t.values[toggleKey{feature, scopePath, path}] = on
+		}
+	}
+	return t, nil
+}
+
+// set records the setting for k, saving it if it is for a path.
+func (t *toggles) set(k toggleKey, on bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.values[k] = on
+	if k.scope == scopePath {
+		return t.save()
+	}
+	return nil
+}
+
+// unset removes the setting for k so that the next most specific one applies.
+func (t *toggles) unset(k toggleKey) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.values, k)
+	if k.scope == scopePath {
+		return t.save()
+	}
+	return nil
+}
+
+// save writes the settings for paths to t.file. t.mu must be held.
+func (t *toggles) save() error {
+	saved := map[string]map[string]bool{featureFmt: {}, featureLint: {}}
+	for k, on := range t.values {
+		if k.scope == scopePath {
+			saved[k.feature][k.name] = on
+		}
+	}
+
+	b, err := jsonenc.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(t.file), 0755); err != nil {
+		return err
+	}
+
+	// Write then rename so that a crash can't leave a truncated file behind
+	tmp := t.file + ".tmp"
+	if err = ioutil.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.file)
+}
+
+// enabled reports whether feature is enabled for the file path, of type
+// fileType, and the scope of the setting that decided it. Either of fileType
+// and path can be empty to skip that scope.
+func (t *toggles) enabled(feature, fileType, path string) (bool, string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lookup(feature, fileType, path)
+}
+
+func (t *toggles) lookup(feature, fileType, path string) (bool, string) {
+	keys := []toggleKey{
+		{feature, scopePath, path},
+		{feature, scopeType, fileType},
+		{feature, scopeGlobal, ""},
+	}
+	for _, k := range keys {
+		if on, ok := t.values[k]; ok && (k.scope == scopeGlobal || k.name != "") {
+			return on, k.scope
+		}
+	}
+
+	if feature == featureLint {
+		on, scope := t.lookup(featureFmt, fileType, path)
+		return on, featureFmt + " " + scope
+	}
+	return false, scopeDefault
+}
+
+// list describes whether feature is enabled globally and then the settings
+// made for file types and paths, as lines of '<scope>\t<name>\t<on|off>'.
+func (t *toggles) list(feature string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var b strings.Builder
+	on, _ := t.lookup(feature, "", "")
+	fmt.Fprintf(&b, "%s\t\t%s\n", scopeGlobal, onOff(on))
+
+	var keys []toggleKey
+	for k := range t.values {
+		if k.feature == feature && k.scope != scopeGlobal {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].scope != keys[j].scope {
+			return scopeOrder[keys[i].scope] < scopeOrder[keys[j].scope]
+		}
+		return keys[i].name < keys[j].name
+	})
+
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s\t%s\t%s\n", k.scope, k.name, onOff(t.values[k]))
+	}
+	return b.String()
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
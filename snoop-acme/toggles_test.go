@@ -0,0 +1,156 @@
+package snoop
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sminez/acme-corp/acorp"
+)
+
+func TestTogglesLookup(t *testing.T) {
+	const file = "/src/main.go"
+
+	tests := []struct {
+		set     []toggleKey // turned on
+		off     []toggleKey // then turned off
+		feature string
+		on      bool
+		scope   string
+	}{
+		{nil, nil, featureFmt, false, scopeDefault},
+		{nil, nil, featureLint, false, featureFmt + " " + scopeDefault},
+		{[]toggleKey{{featureFmt, scopeGlobal, ""}}, nil, featureFmt, true, scopeGlobal},
+		{
+			[]toggleKey{{featureFmt, scopeGlobal, ""}},
+			[]toggleKey{{featureFmt, scopeType, "go"}},
+			featureFmt, false, scopeType,
+		},
+		{
+			[]toggleKey{{featureFmt, scopeType, "go"}},
+			[]toggleKey{{featureFmt, scopeGlobal, ""}},
+			featureFmt, true, scopeType,
+		},
+		{
+			[]toggleKey{{featureFmt, scopePath, file}},
+			[]toggleKey{{featureFmt, scopeType, "go"}, {featureFmt, scopeGlobal, ""}},
+			featureFmt, true, scopePath,
+		},
+		{
+			[]toggleKey{{featureFmt, scopeType, "go"}},
+			[]toggleKey{{featureFmt, scopePath, file}},
+			featureFmt, false, scopePath,
+		},
+		// Settings for other files and types don't apply
+		{
+			[]toggleKey{{featureFmt, scopeGlobal, ""}},
+			[]toggleKey{{featureFmt, scopeType, "python"}, {featureFmt, scopePath, "/src/other.go"}},
+			featureFmt, true, scopeGlobal,
+		},
+		// Linting follows formatting unless it has been set itself, at any scope
+		{[]toggleKey{{featureFmt, scopeType, "go"}}, nil, featureLint, true, featureFmt + " " + scopeType},
+		{
+			[]toggleKey{{featureFmt, scopePath, file}},
+			[]toggleKey{{featureLint, scopeGlobal, ""}},
+			featureLint, false, scopeGlobal,
+		},
+		{
+			[]toggleKey{{featureLint, scopeType, "go"}},
+			[]toggleKey{{featureFmt, scopePath, file}},
+			featureLint, true, scopeType,
+		},
+	}
+
+	for i, tc := range tests {
+		toggles, err := loadToggles(filepath.Join(t.TempDir(), "toggles.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range tc.set {
+			toggles.set(k, true)
+		}
+		for _, k := range tc.off {
+			toggles.set(k, false)
+		}
+
+		if on, scope := toggles.enabled(tc.feature, "go", file); on != tc.on || scope != tc.scope {
+			t.Errorf("%d: %s enabled = %v (%s); want %v (%s)", i, tc.feature, on, scope, tc.on, tc.scope)
+		}
+	}
+}
+
+func TestTogglesSaved(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "toggles.json")
+	toggles, _ := loadToggles(file)
+	toggles.set(toggleKey{featureFmt, scopePath, "/src/vendored.go"}, false)
+	toggles.set(toggleKey{featureLint, scopePath, "/src/main.go"}, true)
+	toggles.set(toggleKey{featureFmt, scopeType, "go"}, true)
+	toggles.set(toggleKey{featureFmt, scopeGlobal, ""}, true)
+
+	// Only the settings for paths survive a restart
+	toggles, err := loadToggles(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "global\t\toff\npath\t/src/vendored.go\toff\n"
+	if s := toggles.list(featureFmt); s != want {
+		t.Errorf("fmt settings after reload:\n%s\nwant:\n%s", s, want)
+	}
+	if on, scope := toggles.enabled(featureLint, "go", "/src/main.go"); !on || scope != scopePath {
+		t.Errorf("lint for main.go after reload = %v (%s)", on, scope)
+	}
+}
+
+func TestToggleHandler(t *testing.T) {
+	fa := acorp.NewFakeAcme()
+	fa.NewWin("/src/main.go", "package main\n")
+	fa.NewWin("/src/", "")
+	a := newTestSnooper(t, fa)
+
+	tests := []struct {
+		feature string
+		s       string
+		resp    string
+		err     string
+	}{
+		{featureFmt, "on", "on", ""},
+		{featureFmt, "off go", "off", ""},
+		{featureFmt, "status /src/main.go", "off (type)", ""},
+		{featureFmt, "on 1", "on", ""},
+		{featureFmt, "status /src/main.go", "on (path)", ""},
+		{featureLint, "status 1", "on (fmt path)", ""},
+		{featureFmt, "default 1", "off", ""},
+		{featureFmt, "toggle python", "off", ""},
+		{featureFmt, "status", "global\t\ton\ntype\tgo\toff\ntype\tpython\toff\n", ""},
+		{featureFmt, "off pyhton", "", "'pyhton' is not a known file type"},
+		{featureLint, "on Go", "", "'Go' is not a known file type"},
+		{featureFmt, "on 9", "", "window 9 does not exist"},
+		{featureFmt, "on 2", "", "window 2 is not a file"},
+		{featureFmt, "sideways", "", "not a valid fmt directive"},
+		{featureFmt, "on go extra", "", "not a valid fmt directive"},
+	}
+
+	for _, tc := range tests {
+		resp, err := a.toggleHandler(tc.feature, tc.s)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s %s: got %q, %v; want error %q", tc.feature, tc.s, resp, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || resp != tc.resp {
+			t.Errorf("%s %s = %q, %v; want %q", tc.feature, tc.s, resp, err, tc.resp)
+		}
+	}
+
+	// Types defined in the config can be toggled once it is loaded
+	writeFiles(t, filepath.Dir(configPath()), map[string]string{
+		"snoop.json": `{"filetypes": [{"name": "make", "patterns": ["Makefile"]}]}`,
+	})
+	if _, err := a.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.toggleHandler(featureLint, "off make"); err != nil {
+		t.Errorf("lint off make: %s", err)
+	}
+}